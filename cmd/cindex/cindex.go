@@ -5,6 +5,8 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -13,12 +15,21 @@ import (
 	"runtime"
 	"runtime/pprof"
 	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/google/codesearch/index"
+	"github.com/google/codesearch/walk"
 )
 
-var usageMessage = `usage: cindex [-list] [-reset] [path...]
+var usageMessage = `usage: cindex [-list [-files]] [-reset] [-resume] [-compact] [-gc] [-repo name]
+	[-codec name] [-include globs] [-exclude globs] [-skipped] [-stats [-json]]
+	[-check [-repair] [-sample n]] [-migrate] [-import file] [-export file]
+	[-keep-history duration] [-casefold] [-workers n]
+	[-maxfilelen n] [-maxlinelen n] [-maxtrigrams n] [-limit rule] [path...]
 
 Cindex prepares the trigram index for use by csearch.  The index is the
 file named by $CSEARCHINDEX, or else $HOME/.csearchindex.
@@ -42,12 +53,107 @@ already been added, in case the files have changed.  Thus, 'cindex' by
 itself is a useful command to run in a nightly cron job.
 
 The -list flag causes cindex to list the paths it has indexed and exit.
+With -files, it lists every indexed file instead, one per line, as
+
+	digest size segment repository path
+
+where segment is "-" for files not yet in a committed segment and
+repository is "-" for the default repository.
 
 By default cindex adds the named paths to the index but preserves 
 information about other paths that might already be indexed
 (the ones printed by cindex -list).  The -reset flag causes cindex to
 delete the existing index before indexing the new paths.
 With no path arguments, cindex -reset removes the index.
+
+The files indexed by a cindex run only become visible to searches, all
+at once, when the run finishes. If cindex is interrupted, the next run
+discards the files it had indexed; with the -resume flag, the next run
+picks up where the interrupted one left off instead, skipping the files
+it had already indexed if they are unchanged.
+
+Each cindex run adds a new segment to the index, and searches get
+slower as segments accumulate. The index is compacted automatically
+once it has enough segments; the -compact flag causes cindex to compact
+the repository's segments into one after indexing any paths given.
+
+Deleted and modified files leave their old contents in the index.
+The -gc flag causes cindex to remove contents that no indexed path
+refers to, after indexing any paths given, and report the space
+reclaimed.
+
+The -repo flag names the repository the paths are indexed into.
+An index can hold many repositories; csearch searches all of them
+unless told otherwise.
+
+Cindex skips files that are hidden, that look like editor backups, or
+that a .gitignore or .csearchignore file in their directory or any
+directory above it (up to the indexed path) says to ignore. Rules in
+.csearchignore take precedence, and can re-include files git ignores.
+The -include and -exclude flags take comma-separated glob patterns,
+matched against each file's base name and its path relative to the
+indexed path: with -include only matching files are indexed, and
+-exclude skips matching files and directories. The patterns are
+remembered, and used again when cindex reindexes the path.
+
+Cindex only indexes files that look like text: valid UTF-8, at most
+1 GB long, with no line longer than 2000 bytes and at most 20000
+distinct trigrams. The -maxfilelen, -maxlinelen and -maxtrigrams flags
+change these limits, and the -limit flag, which may be repeated,
+changes them for files matching a glob, as in
+
+	cindex -limit '*.min.js:maxlinelen=1000000' -limit '*.pb.go:maxtrigrams=100000' path
+
+where a zero limit keeps the default. The -skipped flag causes cindex
+to list the files it did not index, with the reason, and exit.
+
+The -stats flag causes cindex to print statistics about the index and
+exit: for each repository, the number of indexed paths, of live and
+dead contents and of skipped files, the size of the contents before
+and after compression, and the number of segments, trigrams and bytes
+of posting lists; then the distribution of posting list lengths and
+the longest lists. With -json, the statistics are printed as JSON.
+
+The -check flag causes cindex to check that the entries of the index
+agree with each other, print the problems it finds, and exit, with
+status 1 if there were any. It also derives the trigrams of a sample
+of -sample files (all files if -sample is -1) from their contents and
+compares them with the posting lists. The -repair flag causes cindex
+-check to fix the problems it can, dropping damaged files from the index
+so that reindexing adds them again. Do not run cindex -check while
+another cindex is writing to the index.
+
+The index records the version of its format. When a new release of
+cindex changes the format, it refuses to use an index written in an
+older one until the -migrate flag has been used to upgrade the index in
+place. Searches are not possible while the migration runs.
+
+The -import and -export flags convert between this index and the
+single-file index of the original codesearch tools. The -import flag
+adds the files listed in the named classic index file to the -repo
+repository, reading them again from the file system, and records its
+paths as roots to be reindexed. The -export flag writes the -repo
+repository to the named file, which the original csearch can use
+through its $CSEARCHINDEX variable, and exits.
+
+The -codec flag chooses how newly indexed file contents are compressed:
+none, snappy (the default) or flate. Contents already in the index are
+left as they are and stay readable.
+
+The -casefold flag causes cindex to also write posting lists of
+lowercased trigrams, which make case-insensitive searches such as
+csearch -i about as fast as case-sensitive ones, at the cost of more
+space for posting lists. Segments written without -casefold are
+still searched correctly, if more slowly, and compaction keeps the
+case-folded lists only if every compacted segment has them.
+
+Cindex records each change to the contents of a file in the file's
+history, which csearch -history lists and csearch -at searches. The
+-keep-history flag sets how long the versions of files that were
+replaced or deleted stay in the index: compaction and -gc retire them
+once they were replaced longer ago, such as -keep-history 720h for 30
+days. By default only the current versions are kept; a negative
+duration keeps every version.
 `
 
 func usage() {
@@ -56,19 +162,50 @@ func usage() {
 }
 
 var (
+	listFlag    = flag.Bool("list", false, "list indexed paths and exit")
+	filesFlag   = flag.Bool("files", false, "with -list, list every indexed file")
+	skippedFlag = flag.Bool("skipped", false, "list files that were not indexed, and why, and exit")
+	statsFlag   = flag.Bool("stats", false, "print index statistics and exit")
+	jsonFlag    = flag.Bool("json", false, "with -stats, print statistics as JSON")
+	checkFlag   = flag.Bool("check", false, "check the index for consistency and exit")
+	repairFlag  = flag.Bool("repair", false, "with -check, repair the problems found")
+	sampleFlag  = flag.Int("sample", 100, "with -check, number of files whose trigrams to verify (-1 for all)")
 	resetFlag   = flag.Bool("reset", false, "discard existing index")
+	migrateFlag = flag.Bool("migrate", false, "upgrade the index to the current format and exit")
+	importFlag  = flag.String("import", "", "add the files listed in this classic csearch index file")
+	exportFlag  = flag.String("export", "", "write the repository to this classic csearch index file and exit")
+	resumeFlag  = flag.Bool("resume", false, "continue the files indexed by an interrupted run")
+	repoFlag    = flag.String("repo", "", "repository to index into")
+	codecFlag   = flag.String("codec", "snappy", "compression codec for file contents")
+	foldFlag    = flag.Bool("casefold", false, "also write case-folded posting lists")
+	keepHistory = flag.Duration("keep-history", 0, "keep replaced versions of files for this long (negative for ever)")
+	includeFlag = flag.String("include", "", "comma-separated globs; index only matching files")
+	excludeFlag = flag.String("exclude", "", "comma-separated globs; skip matching files and directories")
+	compactFlag = flag.Bool("compact", false, "compact the repository's segments")
+	gcFlag      = flag.Bool("gc", false, "remove contents no longer referenced by any path")
+	workersFlag = flag.Int("workers", 0, "number of files to scan in parallel (default GOMAXPROCS)")
 	verboseFlag = flag.Bool("verbose", false, "print extra information")
+	maxFileLen  = flag.Int64("maxfilelen", 0, "skip files longer than this many bytes")
+	maxLineLen  = flag.Int("maxlinelen", 0, "skip files with lines longer than this many bytes")
+	maxTrigrams = flag.Int("maxtrigrams", 0, "skip files with more than this many distinct trigrams")
+	limitRules  []index.LimitRule
 	cpuProfile  = flag.String("cpuprofile", "", "write cpu profile to this file")
 )
 
 type indexReader interface {
-	Paths() []string
-	Close()
+	Roots() ([]index.Root, error)
+	Paths() *index.PathIter
+	Skipped() ([]index.SkippedFile, error)
+	Stats() (*index.Stats, error)
 }
 
 type indexWriter interface {
 	AddFile(string) error
+	Unchanged(string, os.FileInfo) (bool, error)
+	DeleteMissing(string, map[string]bool) (int, error)
+	AddRoot(index.Root) error
 	Flush() error
+	Close() error
 }
 
 func indexDir() string {
@@ -85,6 +222,7 @@ func indexDir() string {
 }
 
 func main() {
+	flag.Var(limitFlag{}, "limit", "per-file limits, as glob:name=value,...")
 	flag.Usage = usage
 	flag.Parse()
 	args := flag.Args()
@@ -101,8 +239,78 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	if *migrateFlag {
+		db, err := pebble.Open(indexDir(), &pebble.Options{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := index.Migrate(db); err != nil {
+			log.Fatal(err)
+		}
+		db.Close()
+		log.Printf("index is at format version %d", index.FormatVersion)
+		return
+	}
+
+	if *checkFlag {
+		db, err := pebble.Open(indexDir(), &pebble.Options{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		ok := check(db)
+		db.Close()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *exportFlag != "" {
+		db, err := pebble.Open(indexDir(), &pebble.Options{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		ix, err := index.Open(db, &index.ReaderOptions{Repositories: []string{*repoFlag}})
+		if err != nil {
+			log.Fatal(err)
+		}
+		export(ix, *exportFlag, *repoFlag)
+		db.Close()
+		return
+	}
+
+	if *listFlag || *skippedFlag || *statsFlag {
+		db, err := pebble.Open(indexDir(), &pebble.Options{})
+		if err != nil {
+			log.Fatal(err)
+		}
+		var opts *index.ReaderOptions
+		if *repoFlag != "" {
+			opts = &index.ReaderOptions{Repositories: []string{*repoFlag}}
+		}
+		ix, err := index.Open(db, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		switch {
+		case *statsFlag:
+			printStats(ix)
+		case *skippedFlag:
+			listSkipped(ix)
+		case *filesFlag:
+			listFiles(ix)
+		default:
+			listRoots(ix)
+		}
+		db.Close()
+		return
+	}
+
 	if *resetFlag {
 		os.RemoveAll(indexDir())
+		if len(args) == 0 {
+			return
+		}
 	}
 
 	// Translate paths to absolute paths so that we can
@@ -127,43 +335,323 @@ func main() {
 		log.Fatal(err)
 	}
 
+	codec, err := index.ParseCodec(*codecFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
 	var ix indexWriter
-	i, err := index.Create(db)
+	i, err := index.Create(db, &index.WriterOptions{
+		Repository: *repoFlag,
+		Codec:      codec,
+		Workers:    *workersFlag,
+		Limits: index.Limits{
+			MaxFileLen:      *maxFileLen,
+			MaxLineLen:      *maxLineLen,
+			MaxTextTrigrams: *maxTrigrams,
+		},
+		LimitRules: limitRules,
+		Resume:     *resumeFlag,
+		CaseFolded: *foldFlag,
+		History:    *keepHistory,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 	i.Verbose = *verboseFlag
 	ix = i
 
+	if (*compactFlag || *gcFlag) && len(args) == 0 {
+		maintain(i)
+		log.Printf("done")
+		return
+	}
+
+	var roots []index.Root
+	if *importFlag != "" {
+		n, err := i.ImportClassic(*importFlag)
+		if err != nil {
+			abort(ix, err)
+		}
+		log.Printf("%s: imported %d files", *importFlag, n)
+	} else if len(args) == 0 {
+		roots, err = i.Roots()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(roots) == 0 {
+			log.Printf("no paths indexed yet")
+		}
+	}
 	for _, arg := range args {
-		log.Printf("index %s", arg)
-		filepath.Walk(arg, func(path string, info os.FileInfo, err error) error {
-			if _, elem := filepath.Split(path); elem != "" {
-				// Skip various temporary or "hidden" files or directories.
-				if elem[0] == '.' || elem[0] == '#' || elem[0] == '~' || elem[len(elem)-1] == '~' {
-					if info.IsDir() {
-						return filepath.SkipDir
-					}
-					return nil
-				}
-			}
-			if err != nil {
-				log.Printf("%s: %s", path, err)
-				return nil
-			}
-			if info != nil && info.Mode()&os.ModeType == 0 {
-				if err := ix.AddFile(path); err != nil {
-					log.Fatal(err)
-				}
-			}
-			return nil
+		roots = append(roots, index.Root{
+			Path:    arg,
+			Include: splitList(*includeFlag),
+			Exclude: splitList(*excludeFlag),
 		})
 	}
+	for _, root := range roots {
+		indexRoot(ix, root)
+	}
 	log.Printf("flush index")
 	if err := ix.Flush(); err != nil {
-		log.Fatal(err)
+		abort(ix, err)
 	}
+	if st := i.Stats(); st.ContentBytes > 0 {
+		log.Printf("stored %d bytes of contents in %d bytes (%s, ratio %.2f)",
+			st.ContentBytes, st.StoredBytes, codec, st.CompressionRatio())
+	}
+	maintain(i)
 
 	log.Printf("done")
 	return
 }
+
+// indexRoot walks root, adding new and changed files to the index
+// and deleting the files that have gone away since it was last indexed.
+func indexRoot(ix indexWriter, root index.Root) {
+	log.Printf("index %s", root.Path)
+	if _, err := os.Stat(root.Path); err != nil {
+		// Leave the index alone rather than deleting
+		// everything under a root that may come back.
+		log.Printf("%s: %s", root.Path, err)
+		return
+	}
+	seen := make(map[string]bool)
+	opts := &walk.Options{Include: root.Include, Exclude: root.Exclude}
+	err := walk.Walk(root.Path, opts, func(path string, info os.FileInfo) error {
+		seen[path] = true
+		unchanged, err := ix.Unchanged(path, info)
+		if err != nil || unchanged {
+			return err
+		}
+		return ix.AddFile(path)
+	})
+	if err != nil {
+		abort(ix, err)
+	}
+	n, err := ix.DeleteMissing(root.Path, seen)
+	if err != nil {
+		abort(ix, err)
+	}
+	if n > 0 {
+		log.Printf("%s: %d files removed", root.Path, n)
+	}
+	root.Indexed = time.Now()
+	if err := ix.AddRoot(root); err != nil {
+		abort(ix, err)
+	}
+}
+
+// abort closes ix, discarding the files added since it was created,
+// and exits with err.
+func abort(ix indexWriter, err error) {
+	if err := ix.Close(); err != nil {
+		log.Print(err)
+	}
+	log.Fatal(err)
+}
+
+// export writes repository repo of ix to the classic index file named
+// file, replacing it only once it has been written in full.
+func export(ix *index.Index, file, repo string) {
+	tmp := file + "~"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ix.WriteClassic(f, repo); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		log.Fatal(err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// listRoots prints the roots recorded in ix.
+func listRoots(ix indexReader) {
+	roots, err := ix.Roots()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, r := range roots {
+		if r.Repo != "" {
+			fmt.Printf("%s:%s\n", r.Repo, r.Path)
+		} else {
+			fmt.Printf("%s\n", r.Path)
+		}
+	}
+}
+
+// listFiles prints every indexed file in ix.
+func listFiles(ix indexReader) {
+	w := bufio.NewWriter(os.Stdout)
+	defer w.Flush()
+	it := ix.Paths()
+	for it.Next() {
+		p := it.Path()
+		seg, repo := p.Segment, p.Repo
+		if seg == "" {
+			seg = "-"
+		}
+		if repo == "" {
+			repo = "-"
+		}
+		fmt.Fprintf(w, "%s %d %s %s %s\n", p.Digest, p.Size, seg, repo, p.Name)
+	}
+	if err := it.Close(); err != nil {
+		w.Flush()
+		log.Fatal(err)
+	}
+}
+
+// splitList splits a comma-separated flag value.
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// listSkipped prints the files in ix that were not indexed.
+func listSkipped(ix indexReader) {
+	skipped, err := ix.Skipped()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, sk := range skipped {
+		name := sk.Name
+		if sk.Repo != "" {
+			name = sk.Repo + ":" + name
+		}
+		fmt.Printf("%s: %s (%d bytes)\n", name, sk.Reason, sk.Size)
+	}
+}
+
+// printStats prints statistics about ix.
+func printStats(ix indexReader) {
+	st, err := ix.Stats()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *jsonFlag {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(st); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(w, "repository\tpaths\tlive\tdead\tskipped\tcontent\tstored\tratio\tsegments\ttrigrams\tpostings\t\n")
+	row := func(name string, rs *index.RepoStats) {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%.2f\t%d\t%d\t%d\t\n",
+			name, rs.Paths, rs.LiveFiles, rs.DeadFiles, rs.Skipped, rs.ContentBytes, rs.StoredBytes,
+			rs.CompressionRatio(), rs.Segments, rs.Trigrams, rs.PostingBytes)
+	}
+	for i := range st.Repositories {
+		rs := &st.Repositories[i]
+		name := rs.Repo
+		if name == "" {
+			name = "-"
+		}
+		row(name, rs)
+	}
+	if len(st.Repositories) > 1 {
+		row("total", &st.Total)
+	}
+	w.Flush()
+
+	fmt.Printf("\nposting list lengths:\n")
+	for _, b := range st.Total.Lengths {
+		fmt.Printf("%10d-%d\t%d\n", b.Min, b.Max, b.Count)
+	}
+	fmt.Printf("\nlargest posting lists:\n")
+	for _, p := range st.Total.Largest {
+		name := fmt.Sprintf("%q", p.Trigram)
+		if p.Repo != "" {
+			name = p.Repo + ":" + name
+		}
+		fmt.Printf("%10d\t%s\n", p.Docs, name)
+	}
+}
+
+// check checks the index in db, repairing it if asked, and reports
+// whether there were no problems left unrepaired.
+func check(db *pebble.DB) bool {
+	opts := &index.CheckOptions{Sample: *sampleFlag, Repair: *repairFlag}
+	if *repoFlag != "" {
+		opts.Repositories = []string{*repoFlag}
+	}
+	problems, err := index.Check(db, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("%d problems found\n", len(problems))
+	if len(problems) > 0 && *repairFlag {
+		fmt.Printf("reindex with cindex to restore the files dropped by repairs\n")
+		return true
+	}
+	return len(problems) == 0
+}
+
+// A limitFlag adds a LimitRule to limitRules each time it is set.
+type limitFlag struct{}
+
+func (limitFlag) String() string { return "" }
+
+// Set parses a rule of the form glob:name=value,... where each name
+// is maxfilelen, maxlinelen or maxtrigrams.
+func (limitFlag) Set(s string) error {
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return fmt.Errorf("missing ':' in %q", s)
+	}
+	r := index.LimitRule{Pattern: s[:i]}
+	for _, f := range strings.Split(s[i+1:], ",") {
+		name, value, _ := strings.Cut(f, "=")
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("bad limit %q: %v", f, err)
+		}
+		switch name {
+		case "maxfilelen":
+			r.Limits.MaxFileLen = n
+		case "maxlinelen":
+			r.Limits.MaxLineLen = int(n)
+		case "maxtrigrams":
+			r.Limits.MaxTextTrigrams = int(n)
+		default:
+			return fmt.Errorf("unknown limit %q", name)
+		}
+	}
+	limitRules = append(limitRules, r)
+	return nil
+}
+
+// maintain runs the compaction or garbage collection asked for
+// on the command line.
+func maintain(iw *index.IndexWriter) {
+	switch {
+	case *gcFlag:
+		log.Printf("garbage collect index")
+		reclaimed, err := iw.GC()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("reclaimed %d bytes\n", reclaimed)
+	case *compactFlag:
+		log.Printf("compact index")
+		if err := iw.Compact(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
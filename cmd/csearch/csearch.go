@@ -13,6 +13,9 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/google/codesearch/index"
@@ -20,7 +23,11 @@ import (
 	"github.com/google/codesearch/regexp"
 )
 
-var usageMessage = `usage: csearch [-c] [-f fileregexp] [-h] [-i] [-l] [-n] regexp
+var usageMessage = `usage: csearch [-c] [-f fileregexp] [-h] [-i] [-l] [-n] [-repo names] [-collapse]
+               [-lang languages] [-size range] [-newer time] [-exclude-generated]
+               [-at time|segment:id] regexp
+       csearch -sym [-repo names] name
+       csearch -history [-repo names] path
 
 Csearch behaves like grep over all indexed files, searching for regexp,
 an RE2 (nearly PCRE) regular expression.
@@ -30,7 +37,49 @@ flag parsing convention, they cannot be combined: the option pair -i -n
 cannot be abbreviated to -in.
 
 The -f flag restricts the search to files whose names match the RE2 regular
-expression fileregexp.
+expression fileregexp. The index holds the trigrams of file names as well as
+of their contents, so -f '_test\.go$' leaves out other files before any
+contents are searched.
+
+Files with the same contents, such as copies of a LICENSE file, are
+searched once, but their matches are reported for each of their names.
+The -collapse flag reports them once instead, under the first name,
+noting how many other files have the same contents.
+
+The -repo flag restricts the search to a comma-separated list of
+repositories. By default every repository in the index is searched.
+
+The -lang, -size, -newer and -exclude-generated flags restrict the search
+using the metadata cindex records for each file:
+
+	-lang go,python      files in one of these languages, as detected from
+	                     their names or #! lines
+	-size 1k-64k         files of 1k to 64k bytes; -size +1M and -size -4k
+	                     give only a lower or upper bound (k, M and G are
+	                     powers of 1024)
+	-newer 24h           files modified in the last 24 hours; also takes a
+	                     date such as 2024-01-31 or an RFC 3339 time
+	-exclude-generated   leave out generated and vendored files
+
+With -sym, csearch instead lists where the Go functions, methods, types,
+constants and variables named name, or whose names start with name, are
+declared, exact matches first. A name of the form T.Name lists only the
+methods of type T.
+
+The -at flag searches the files as cindex had indexed them at a past time,
+given as for -newer, or, as -at segment:id, when the segment with the
+given ID was committed. Versions of files that were replaced before then
+are searched only while they are still in the index: cindex -keep-history
+sets how long they stay.
+
+With -history, csearch instead lists the indexed versions of the file
+path, oldest first: when each was committed, by which segment, and its
+size and digest, or that the file was deleted. Versions no longer in the
+index are marked retired.
+
+The -cache flag sets how much memory csearch uses to cache the posting
+lists it reads, such as -cache 256M; -cache 0 turns the cache off.
+With -verbose, csearch reports how often the cache was used.
 
 Csearch relies on the existence of an up-to-date index created ahead of time.
 To build or rebuild the index that csearch uses, run:
@@ -52,6 +101,7 @@ func usage() {
 
 var (
 	fFlag           = flag.String("f", "", "search only files with names matching this regexp")
+	repoFlag        = flag.String("repo", "", "search only these comma-separated repositories")
 	iFlag           = flag.Bool("i", false, "case-insensitive search")
 	verboseFlag     = flag.Bool("verbose", false, "print extra information")
 	bruteFlag       = flag.Bool("brute", false, "brute force - search all files in index")
@@ -63,6 +113,16 @@ var (
 	showLineNumbers = flag.Bool("n", false, "show line numbers")
 	omitFileNames   = flag.Bool("h", false, "omit file names")
 
+	langFlag         = flag.String("lang", "", "search only files in these comma-separated languages")
+	sizeFlag         = flag.String("size", "", "search only files with sizes in this range")
+	newerFlag        = flag.String("newer", "", "search only files modified after this time, or in this last duration")
+	excludeGenerated = flag.Bool("exclude-generated", false, "do not search generated or vendored files")
+	symFlag          = flag.Bool("sym", false, "list the Go declarations of the named symbol")
+	cacheFlag        = flag.String("cache", "", "cache up to this many bytes of posting lists (default 32M, 0 for none)")
+	collapseFlag     = flag.Bool("collapse", false, "report files with the same contents once")
+	atFlag           = flag.String("at", "", "search the files as indexed at this time, or when segment:id was committed")
+	historyFlag      = flag.Bool("history", false, "list the indexed versions of the named file")
+
 	matches bool
 )
 
@@ -79,33 +139,98 @@ func indexDir() string {
 	return filepath.Clean(home + "/.csindex")
 }
 
-func runQuery(ix *index.Index, q *query.Query, fre *regexp.Regexp) []uint32 {
-	var post []uint32
+// parseSize parses a size such as 512, 4k or 1M.
+func parseSize(s string) (int64, error) {
+	mult := int64(1)
+	if i := strings.IndexAny(s, "kKmMgG"); i >= 0 && i == len(s)-1 {
+		mult = map[byte]int64{'k': 1 << 10, 'm': 1 << 20, 'g': 1 << 30}[s[i]|0x20]
+		s = s[:i]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * mult, nil
+}
+
+// parseSizeRange parses the -size flag: min-max, +min or -max.
+func parseSizeRange(s string) (min, max int64, err error) {
+	switch {
+	case strings.HasPrefix(s, "+"):
+		min, err = parseSize(s[1:])
+	case strings.HasPrefix(s, "-"):
+		max, err = parseSize(s[1:])
+	default:
+		lo, hi, ok := strings.Cut(s, "-")
+		if !ok {
+			return 0, 0, fmt.Errorf("bad size range %q: want min-max, +min or -max", s)
+		}
+		if min, err = parseSize(lo); err == nil {
+			max, err = parseSize(hi)
+		}
+	}
+	return min, max, err
+}
+
+// parseNewer parses the -newer flag: a duration before now, a date or
+// an RFC 3339 time.
+func parseNewer(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	for _, layout := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("bad time %q: want a duration, date or RFC 3339 time", s)
+}
+
+// makeFilter returns the index filter given by the flags.
+func makeFilter() (*index.Filter, error) {
+	f := &index.Filter{ExcludeGenerated: *excludeGenerated}
+	if *langFlag != "" {
+		f.Languages = strings.Split(*langFlag, ",")
+	}
+	var err error
+	if *sizeFlag != "" {
+		if f.MinSize, f.MaxSize, err = parseSizeRange(*sizeFlag); err != nil {
+			return nil, err
+		}
+	}
+	if *newerFlag != "" {
+		if f.NewerThan, err = parseNewer(*newerFlag); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func runQuery(ix *index.Index, q *query.Query, fre *regexp.Regexp, filter *index.Filter) []index.Hit {
+	var post []index.Hit
 	var err error
 	if *bruteFlag {
-		post, err = ix.PostingQuery(&query.Query{Op: query.QAll})
+		post, err = ix.FilteredQuery(&query.Query{Op: query.QAll}, filter)
 	} else {
-		post, err = ix.PostingQuery(q)
+		post, err = ix.FilteredQuery(q, filter)
 	}
 	if err != nil {
 		log.Fatal(err)
 	}
 	if *verboseFlag {
 		log.Printf("post query identified %d possible files\n", len(post))
+		st := ix.CacheStats()
+		log.Printf("posting cache: %d hits, %d misses, %d lists in %d bytes\n", st.Hits, st.Misses, st.Entries, st.Bytes)
 	}
 
 	if fre != nil {
-		fnames := make([]uint32, 0, len(post))
+		fnames := make([]index.Hit, 0, len(post))
 
-		for _, fileid := range post {
-			name, err := ix.Name(fileid)
-			if err != nil {
-				log.Fatal(err)
-			}
-			if fre.MatchString(name, true, true) < 0 {
+		for _, hit := range post {
+			if len(hitNames(ix, hit, fre, filter)) == 0 {
 				continue
 			}
-			fnames = append(fnames, fileid)
+			fnames = append(fnames, hit)
 		}
 
 		if *verboseFlag {
@@ -116,6 +241,108 @@ func runQuery(ix *index.Index, q *query.Query, fre *regexp.Regexp) []uint32 {
 	return post
 }
 
+// hitNames returns the names of the files with the contents identified
+// by hit that match filter and, if it is not nil, fre.
+func hitNames(ix *index.Index, hit index.Hit, fre *regexp.Regexp, filter *index.Filter) []string {
+	names, err := ix.FilteredNames(hit, filter)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fre == nil {
+		return names
+	}
+	var matched []string
+	for _, name := range names {
+		if fre.MatchString(name, true, true) >= 0 {
+			matched = append(matched, name)
+		}
+	}
+	return matched
+}
+
+// openIndex opens the index, reading the repositories named by -repo.
+func openIndex() *index.Index {
+	db, err := pebble.Open(indexDir(), &pebble.Options{})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var repos []string
+	if *repoFlag != "" {
+		repos = strings.Split(*repoFlag, ",")
+	}
+	opts := &index.ReaderOptions{Repositories: repos}
+	if id, ok := strings.CutPrefix(*atFlag, "segment:"); ok {
+		opts.AtSegment = id
+	} else if *atFlag != "" {
+		if opts.At, err = parseNewer(*atFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *cacheFlag != "" {
+		if opts.CacheSize, err = parseSize(*cacheFlag); err != nil {
+			log.Fatal(err)
+		}
+		if opts.CacheSize == 0 {
+			opts.CacheSize = -1
+		}
+	}
+	ix, err := index.Open(db, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ix.Verbose = *verboseFlag
+	return ix
+}
+
+// symbolSearch prints where the symbols matching name are declared.
+func symbolSearch(ix *index.Index, name string) {
+	hits, err := ix.SymbolSearch(name, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, hit := range hits {
+		file, err := ix.Name(hit.Hit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s:%d: %s\n", file, hit.Line, hit.Symbol)
+	}
+	matches = len(hits) > 0
+}
+
+// history prints the indexed versions of the file name.
+func history(ix *index.Index, name string) {
+	if !filepath.IsAbs(name) {
+		// cindex records absolute paths.
+		if abs, err := filepath.Abs(name); err == nil {
+			name = abs
+		}
+	}
+	versions, err := ix.History(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, v := range versions {
+		segment := v.Segment
+		if segment == "" {
+			segment = "(migrated)"
+		}
+		what := "deleted"
+		if v.Digest != "" {
+			what = fmt.Sprintf("%d bytes, %.12s", v.Size, v.Digest)
+			if !v.Indexed {
+				what += " (retired)"
+			}
+		}
+		if v.Repo != "" {
+			fmt.Printf("%s: ", v.Repo)
+		}
+		fmt.Printf("%s %s %s\n", v.Time.Format(time.RFC3339), segment, what)
+	}
+	matches = len(versions) > 0
+}
+
 func Main() {
 	g := regexp.Grep{
 		Stdout: os.Stdout,
@@ -142,6 +369,15 @@ func Main() {
 		defer pprof.StopCPUProfile()
 	}
 
+	if *symFlag {
+		symbolSearch(openIndex(), args[0])
+		return
+	}
+	if *historyFlag {
+		history(openIndex(), args[0])
+		return
+	}
+
 	pat := "(?m)" + args[0]
 	if *iFlag {
 		pat = "(?i)" + pat
@@ -159,38 +395,52 @@ func Main() {
 			log.Fatal(err)
 		}
 	}
+	filter, err := makeFilter()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if fre != nil {
+		// The paths of the candidates are narrowed down with
+		// their trigrams before any is matched against fre.
+		filter.Path = query.RegexpQuery(fre.Syntax)
+		if *verboseFlag {
+			log.Printf("path query: %s\n", filter.Path)
+		}
+	}
 	q := query.RegexpQuery(re.Syntax)
 	if *verboseFlag {
 		log.Printf("query: %s\n", q)
 	}
 
-	db, err := pebble.Open(indexDir(), &pebble.Options{})
-	if err != nil {
-		log.Fatal(err)
-	}
+	ix := openIndex()
+	post2 := runQuery(ix, q, fre, filter)
 
-	ix := index.Open(db)
-	ix.Verbose = *verboseFlag
-
-	post2 := runQuery(ix, q, fre)
-
-	for _, fileid := range post2 {
-		name, err := ix.Name(fileid)
-		if err != nil {
-			log.Fatal(err)
+	for _, hit := range post2 {
+		names := hitNames(ix, hit, fre, filter)
+		if len(names) == 0 {
+			continue
+		}
+		duplicates := 0
+		if *collapseFlag {
+			duplicates = len(names) - 1
+			names = names[:1]
 		}
-		buf, err := ix.Contents(fileid)
+		buf, err := ix.Contents(hit)
 		if err != nil {
 			log.Fatal(err)
 		}
-		if !*newStyleResults {
-			g.Reader(bytes.NewReader(buf), name)
-		} else {
-			res, err := g.MakeResult(bytes.NewReader(buf), name)
-			if err != nil {
-				log.Fatal(err)
+		for _, name := range names {
+			if !*newStyleResults {
+				g.Reader(bytes.NewReader(buf), name)
+			} else {
+				res, err := g.MakeResult(bytes.NewReader(buf), name)
+				if err != nil {
+					log.Fatal(err)
+				}
+				res.Project = hit.Repo
+				res.Duplicates = duplicates
+				fmt.Printf("%+v", res)
 			}
-			fmt.Printf("%+v", res)
 		}
 	}
 
@@ -9,13 +9,18 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/cockroachdb/pebble"
 	"github.com/google/codesearch/index"
 	"github.com/google/codesearch/query"
 	"github.com/google/codesearch/regexp"
+	"github.com/google/codesearch/walk"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 
 	csspb "github.com/google/codesearch/proto/codesearch_service"
 	inpb "github.com/google/codesearch/proto/index"
@@ -23,12 +28,21 @@ import (
 )
 
 var (
-	listen   = flag.String("listen", ":2633", "Address and port to listen on")
-	indexDir = flag.String("index_dir", "", "Directory to store index in. Default: '~/.csindex/'")
+	listen    = flag.String("listen", ":2633", "Address and port to listen on")
+	indexDir  = flag.String("index_dir", "", "Directory to store index in. Default: '~/.csindex/'")
+	codec     = flag.String("codec", "snappy", "Compression codec for indexed contents: none, snappy or flate")
+	cacheSize = flag.Int64("cache_size", index.DefaultCacheSize, "Bytes of posting lists to cache across searches; 0 for none")
+	casefold  = flag.Bool("casefold", false, "Also write case-folded posting lists, for faster case-insensitive search")
 )
 
 type codesearchServer struct {
-	db *pebble.DB
+	db    *pebble.DB
+	codec index.Codec
+	cache *index.PostingCache // nil if disabled
+
+	// indexMu serializes Index RPCs; an IndexWriter is not safe
+	// to run concurrently with another writer.
+	indexMu sync.Mutex
 }
 
 func defaultDir() string {
@@ -45,28 +59,120 @@ func New() (*codesearchServer, error) {
 	if d == "" {
 		d = defaultDir()
 	}
+	c, err := index.ParseCodec(*codec)
+	if err != nil {
+		return nil, err
+	}
 	db, err := pebble.Open(d, &pebble.Options{})
 	if err != nil {
 		return nil, err
 	}
-	return &codesearchServer{
-		db: db,
-	}, nil
+	css := &codesearchServer{
+		db:    db,
+		codec: c,
+	}
+	if *cacheSize > 0 {
+		css.cache = index.NewPostingCache(*cacheSize)
+	}
+	return css, nil
 }
 
 func (css *codesearchServer) Index(ctx context.Context, req *inpb.IndexRequest) (*inpb.IndexResponse, error) {
 	log.Printf("Index RPC")
-	iw, err := index.Create(css.db)
+	if len(req.GetPaths()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no paths to index")
+	}
+
+	css.indexMu.Lock()
+	defer css.indexMu.Unlock()
+
+	iw, err := index.Create(css.db, &index.WriterOptions{
+		Repository: req.GetRepository(),
+		Codec:      css.codec,
+		CaseFolded: *casefold,
+	})
 	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	// Stop the writer's workers, and discard what it staged, if the
+	// request fails or is cancelled before Flush.
+	defer iw.Close()
+	for _, p := range req.GetPaths() {
+		root, err := filepath.Abs(p)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%s: %s", p, err)
+		}
+		if _, err := os.Stat(root); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%s: %s", p, err)
+		}
+		log.Printf("index %s", root)
+		seen := make(map[string]bool)
+		opts := &walk.Options{Include: req.GetInclude(), Exclude: req.GetExclude()}
+		err = walk.Walk(root, opts, func(path string, info os.FileInfo) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			seen[path] = true
+			if unchanged, err := iw.Unchanged(path, info); err != nil || unchanged {
+				return err
+			}
+			return iw.AddFile(path)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := iw.DeleteMissing(root, seen); err != nil {
+			return nil, err
+		}
+		err = iw.AddRoot(index.Root{
+			Path:    root,
+			Indexed: time.Now(),
+			Include: req.GetInclude(),
+			Exclude: req.GetExclude(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := iw.Flush(); err != nil {
 		return nil, err
 	}
-	_ = iw
-	return &inpb.IndexResponse{}, nil
+
+	st := iw.Stats()
+	return &inpb.IndexResponse{
+		IndexedFiles:      int64(st.FilesIndexed),
+		SkippedFiles:      int64(st.FilesSkipped),
+		DeduplicatedFiles: int64(st.FilesDeduped),
+		ContentBytes:      st.ContentBytes,
+		StoredBytes:       st.StoredBytes,
+	}, nil
+}
+
+// makeFilter converts a search filter to an index filter.
+func makeFilter(f *srpb.Filter) *index.Filter {
+	filter := &index.Filter{
+		Languages:        f.GetLanguages(),
+		MinSize:          f.GetMinSize(),
+		MaxSize:          f.GetMaxSize(),
+		ExcludeGenerated: f.GetExcludeGenerated(),
+	}
+	if t := f.GetNewerThan(); t != 0 {
+		filter.NewerThan = time.Unix(t, 0)
+	}
+	return filter
 }
 
 func (css *codesearchServer) Search(ctx context.Context, req *srpb.SearchRequest) (*srpb.SearchResponse, error) {
 	log.Printf("Search RPC")
-	ir := index.Open(css.db)
+	// Searches share the server's cache, or use none at all.
+	ir, err := index.Open(css.db, &index.ReaderOptions{
+		Repositories: req.GetRepositories(),
+		Cache:        css.cache,
+		CacheSize:    -1,
+	})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	g := regexp.Grep{
 		Stdout: os.Stdout,
@@ -85,31 +191,84 @@ func (css *codesearchServer) Search(ctx context.Context, req *srpb.SearchRequest
 	q := query.RegexpQuery(re.Syntax)
 	log.Printf("query: %s\n", q)
 
-	matchingFiles, err := ir.PostingQuery(q)
+	filter := makeFilter(req.GetFilter())
+	matchingFiles, err := ir.FilteredQuery(q, filter)
 	if err != nil {
 		return nil, err
 	}
+	if st := ir.CacheStats(); st.Hits+st.Misses > 0 {
+		log.Printf("posting cache: %d hits, %d misses, %d lists in %d bytes\n", st.Hits, st.Misses, st.Entries, st.Bytes)
+	}
 
 	rsp := &srpb.SearchResponse{}
-	for _, fileid := range matchingFiles {
-		name, err := ir.Name(fileid)
+	for _, hit := range matchingFiles {
+		// Files with the same contents may differ in what the
+		// filter says of them.
+		names, err := ir.FilteredNames(hit, filter)
 		if err != nil {
 			return nil, err
 		}
-		buf, err := ir.Contents(fileid)
+		if len(names) == 0 {
+			continue
+		}
+		buf, err := ir.Contents(hit)
 		if err != nil {
 			return nil, err
 		}
-		result, err := g.MakeResult(bytes.NewReader(buf), name)
+		result, err := g.MakeResult(bytes.NewReader(buf), names[0])
 		if err != nil {
 			return nil, err
 		}
-		rsp.Results = append(rsp.Results, result.ToProto())
+		result.Project = hit.Repo
+		// Files with the same contents have the same matches.
+		if req.GetCollapseDuplicates() {
+			result.Duplicates = len(names) - 1
+			names = names[:1]
+		}
+		for _, name := range names {
+			result.Filename = name
+			rsp.Results = append(rsp.Results, result.ToProto())
+		}
 	}
 
 	return rsp, nil
 }
 
+func (css *codesearchServer) SymbolSearch(ctx context.Context, req *srpb.SymbolSearchRequest) (*srpb.SymbolSearchResponse, error) {
+	log.Printf("SymbolSearch RPC")
+	if req.GetQuery() == "" {
+		return nil, status.Error(codes.InvalidArgument, "empty query")
+	}
+	ir, err := index.Open(css.db, &index.ReaderOptions{
+		Repositories: req.GetRepositories(),
+		Cache:        css.cache,
+		CacheSize:    -1,
+	})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	hits, err := ir.SymbolSearch(req.GetQuery(), int(req.GetMaxResults()))
+	if err != nil {
+		return nil, err
+	}
+	rsp := &srpb.SymbolSearchResponse{}
+	for _, hit := range hits {
+		name, err := ir.Name(hit.Hit)
+		if err != nil {
+			return nil, err
+		}
+		rsp.Symbols = append(rsp.Symbols, &srpb.Symbol{
+			Repo:     hit.Repo,
+			Filename: name,
+			Name:     hit.Name,
+			Kind:     hit.Kind,
+			Receiver: hit.Recv,
+			Line:     int32(hit.Line),
+		})
+	}
+	return rsp, nil
+}
+
 func main() {
 	flag.Parse()
 	lis, err := net.Listen("tcp", *listen)
@@ -0,0 +1,133 @@
+package index
+
+import (
+	"container/list"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// DefaultCacheSize is the number of bytes of posting lists an Index
+// caches, unless ReaderOptions says otherwise.
+const DefaultCacheSize = 32 << 20
+
+// A PostingCache is an LRU cache of merged posting lists, keyed by the
+// segments they were read from. It is safe for concurrent use.
+type PostingCache struct {
+	mu      sync.Mutex
+	max     int64
+	size    int64
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[cacheKey]*list.Element
+	hits    int64
+	misses  int64
+}
+
+type cacheKey struct {
+	repo    string
+	trigram uint32 // possibly marked with foldedTrigram or pathTrigram
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	gen  string // generation of the segments the list was read from
+	bm   *roaring.Bitmap
+	size int64
+}
+
+// CacheStats reports the use of a PostingCache.
+type CacheStats struct {
+	Hits    int64 // lookups that found a current list
+	Misses  int64 // lookups that had to read the list
+	Entries int   // lists held
+	Bytes   int64 // approximate size of the lists held
+}
+
+// NewPostingCache returns an empty PostingCache holding at most size
+// bytes of posting lists.
+func NewPostingCache(size int64) *PostingCache {
+	return &PostingCache{
+		max:     size,
+		lru:     list.New(),
+		entries: make(map[cacheKey]*list.Element),
+	}
+}
+
+// Stats returns the number of hits and misses so far, and what c
+// holds now. A nil PostingCache, which caches nothing, has no stats.
+func (c *PostingCache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits, Misses: c.misses, Entries: c.lru.Len(), Bytes: c.size}
+}
+
+// get returns the cached posting list for key read from the segments
+// of generation gen, or nil. The list must not be modified.
+func (c *PostingCache) get(key cacheKey, gen string) *roaring.Bitmap {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		if e := el.Value.(*cacheEntry); e.gen == gen {
+			c.hits++
+			c.lru.MoveToFront(el)
+			return e.bm
+		}
+	}
+	c.misses++
+	return nil
+}
+
+// add caches bm as the posting list for key read from the segments of
+// generation gen, replacing any list cached for an older generation.
+// The caller must not modify bm afterwards.
+func (c *PostingCache) add(key cacheKey, gen string, bm *roaring.Bitmap) {
+	if c == nil {
+		return
+	}
+	e := &cacheEntry{key: key, gen: gen, bm: bm}
+	e.size = int64(bm.GetSizeInBytes()) + int64(len(key.repo)+len(gen)) + 64
+	if e.size > c.max {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	c.size += e.size
+	for c.size > c.max {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *PostingCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.size -= e.size
+}
+
+// generation identifies the committed segments segs, and whether each
+// has case-folded lists. A committed segment's lists do not change,
+// except while compaction writes them into a new segment; until it
+// deletes the segments they replace, reading either gives the same
+// live docs.
+func generation(segs map[string]*segmentInfo) string {
+	ids := make([]string, 0, len(segs))
+	for id, si := range segs {
+		if si.Folded {
+			id += "+"
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
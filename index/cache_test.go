@@ -0,0 +1,102 @@
+package index
+
+import (
+	"os"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/cockroachdb/pebble"
+)
+
+func TestPostingCacheEviction(t *testing.T) {
+	bm := roaring.BitmapOf(1, 2, 3)
+	size := int64(bm.GetSizeInBytes()) + 1 + 64
+	c := NewPostingCache(2 * size)
+	a, b, x := cacheKey{"", 1}, cacheKey{"", 2}, cacheKey{"", 3}
+	c.add(a, "g", bm)
+	c.add(b, "g", bm)
+	if c.get(a, "g") == nil {
+		t.Fatal("a not cached")
+	}
+	c.add(x, "g", bm) // evicts b, the least recently used
+	if c.get(b, "g") != nil {
+		t.Error("b still cached after eviction")
+	}
+	if c.get(a, "g") == nil || c.get(x, "g") == nil {
+		t.Error("a or x not cached")
+	}
+	if c.get(a, "h") != nil {
+		t.Error("a cached for another generation")
+	}
+	c.add(a, "h", bm) // replaces a's entry
+	want := CacheStats{Hits: 3, Misses: 2, Entries: 2, Bytes: 2 * size}
+	if got := c.Stats(); got != want {
+		t.Errorf("Stats() = %+v, want %+v", got, want)
+	}
+
+	var none *PostingCache
+	none.add(a, "g", bm)
+	if none.get(a, "g") != nil || none.Stats() != (CacheStats{}) {
+		t.Error("nil cache caches")
+	}
+}
+
+func TestPostingCache(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	noCompact := &WriterOptions{CompactThreshold: -1}
+	addFiles(t, db, noCompact, map[string]string{"a": "Google Code Search", "b": "Google Web Search"})
+	cache := NewPostingCache(DefaultCacheSize)
+	postingList := func(trigram uint32) []uint32 {
+		ix, err := Open(db, &ReaderOptions{Cache: cache})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := ix.PostingList("", trigram)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	check := func(when string, l, want []uint32, hits, misses int64) {
+		t.Helper()
+		if !equalList(l, want) {
+			t.Errorf("%s: PostingList = %v, want %v", when, l, want)
+		}
+		if st := cache.Stats(); st.Hits != hits || st.Misses != misses {
+			t.Errorf("%s: %d hits, %d misses, want %d, %d", when, st.Hits, st.Misses, hits, misses)
+		}
+	}
+
+	check("first read", postingList(tri('S', 'e', 'a')), []uint32{0, 1}, 0, 1)
+	check("second read", postingList(tri('S', 'e', 'a')), []uint32{0, 1}, 1, 1)
+
+	// A new segment makes the cached list stale.
+	iw := addFiles(t, db, noCompact, map[string]string{"c": "Search"})
+	check("after commit", postingList(tri('S', 'e', 'a')), []uint32{0, 1, 2}, 1, 2)
+	check("after commit, again", postingList(tri('S', 'e', 'a')), []uint32{0, 1, 2}, 2, 2)
+
+	// So does compaction, which drops the IDs of replaced contents.
+	addFiles(t, db, noCompact, map[string]string{"a": "Google Code"})
+	if err := iw.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("after compaction", postingList(tri('S', 'e', 'a')), []uint32{1, 2}, 2, 3)
+
+	// Callers may modify the lists they are given.
+	ix, err := Open(db, &ReaderOptions{Cache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ix.PostingOr("", []uint32{7}, tri('S', 'e', 'a')); err != nil {
+		t.Fatal(err)
+	}
+	check("after PostingOr", postingList(tri('S', 'e', 'a')), []uint32{1, 2}, 4, 3)
+}
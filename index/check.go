@@ -0,0 +1,664 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/cockroachdb/pebble"
+)
+
+// A Problem is an inconsistency found by Check.
+type Problem struct {
+	Repo     string
+	Key      string // the key at fault
+	Desc     string
+	Repaired bool
+}
+
+func (p Problem) String() string {
+	s := fmt.Sprintf("%q: %s", p.Key, p.Desc)
+	if p.Repaired {
+		s += " (repaired)"
+	}
+	return s
+}
+
+// CheckOptions configures Check.
+type CheckOptions struct {
+	// Repositories lists the repositories to check.
+	// If empty, all registered repositories are checked.
+	Repositories []string
+
+	// Sample is the number of files whose trigrams are derived again
+	// from their contents and compared with the posting lists.
+	// A negative value means every file.
+	Sample int
+
+	// Repair fixes the problems found where it can. Files whose
+	// entries are broken are dropped from the index, so that the next
+	// run of cindex over their roots indexes them again.
+	Repair bool
+}
+
+// Check verifies that the entries of the index in db agree with each
+// other. It must not be run while a writer is active.
+func Check(db *pebble.DB, opts *CheckOptions) ([]Problem, error) {
+	if opts == nil {
+		opts = &CheckOptions{}
+	}
+	if err := checkVersion(db); err != nil {
+		return nil, err
+	}
+	repos := opts.Repositories
+	if len(repos) == 0 {
+		var err error
+		if repos, err = listRepositories(db); err != nil {
+			return nil, err
+		}
+		if len(repos) == 0 {
+			repos = []string{""}
+		}
+	}
+
+	snap := db.NewSnapshot()
+	defer snap.Close()
+
+	var problems []Problem
+	for _, repo := range repos {
+		c := &checker{
+			ns:      namespace(repo),
+			db:      snap,
+			batch:   db.NewBatch(),
+			opts:    opts,
+			docs:    make(map[uint32]string),
+			digests: make(map[string]uint32),
+			retired: make(map[string]bool),
+		}
+		if err := c.check(); err != nil {
+			return nil, err
+		}
+		if opts.Repair {
+			if err := c.batch.Commit(pebble.Sync); err != nil {
+				return nil, err
+			}
+		}
+		problems = append(problems, c.problems...)
+	}
+	return problems, nil
+}
+
+type checker struct {
+	ns    namespace
+	db    pebble.Reader
+	batch *pebble.Batch // repairs
+	opts  *CheckOptions
+
+	segs     map[string]*segmentInfo
+	docs     map[uint32]string // doc ID to digest
+	digests  map[string]uint32 // digest to doc ID
+	retired  map[string]bool   // digests dropped by repairs
+	problems []Problem
+}
+
+// report records a problem with key.
+func (c *checker) report(key []byte, format string, args ...interface{}) {
+	c.problems = append(c.problems, Problem{
+		Repo:     string(c.ns),
+		Key:      string(key),
+		Desc:     fmt.Sprintf(format, args...),
+		Repaired: c.opts.Repair,
+	})
+}
+
+// delete deletes key if repairing.
+func (c *checker) delete(key []byte) error {
+	if !c.opts.Repair {
+		return nil
+	}
+	return c.batch.Delete(key, nil)
+}
+
+// retire drops the file with the given contents from the index, as
+// compaction does for dead files, if repairing.
+func (c *checker) retire(digest string) error {
+	if c.retired[digest] {
+		return nil
+	}
+	c.retired[digest] = true
+	keys := [][]byte{c.ns.filenameKey(digest), c.ns.digestKey(digest)}
+	id, ok := c.digests[digest]
+	if ok {
+		keys = append(keys, c.ns.docKey(id))
+	}
+	for _, key := range keys {
+		if err := c.delete(key); err != nil {
+			return err
+		}
+	}
+	if ok && c.opts.Repair {
+		_, err := c.ns.deleteMeta(c.batch, c.db, id)
+		return err
+	}
+	return nil
+}
+
+func (c *checker) exists(key []byte) (bool, error) {
+	_, closer, err := c.db.Get(key)
+	if err == pebble.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	closer.Close()
+	return true, nil
+}
+
+func (c *checker) check() error {
+	var err error
+	if c.segs, err = c.ns.segments(c.db); err != nil {
+		return err
+	}
+	for _, step := range []func() error{
+		c.checkDocs,
+		c.checkFilenames,
+		c.checkDigests,
+		c.checkMeta,
+		c.checkSymbols,
+		c.checkNamehashes,
+		c.checkPaths,
+		c.checkLinks,
+		c.checkTrigrams,
+		c.checkPostings,
+		c.checkCounts,
+		c.checkHistory, // after every step that retires contents
+	} {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inSegment reports whether doc id belongs to a committed segment.
+func (c *checker) inSegment(id uint32) bool {
+	for _, si := range c.segs {
+		if si.FirstDoc <= id && id-si.FirstDoc < si.NumDocs {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDocs checks that every doc has a name, contents, a digest
+// entry and a committed segment.
+func (c *checker) checkDocs() error {
+	return c.ns.scan(c.db, docPrefix, func(key, val []byte) error {
+		id, err := c.ns.parseDocKey(key)
+		if err != nil {
+			return err
+		}
+		digest := string(val)
+		c.docs[id] = digest
+		c.digests[digest] = id
+		if !c.inSegment(id) {
+			c.report(key, "doc is in no committed segment")
+			return c.retire(digest)
+		}
+		for _, k := range []struct {
+			what string
+			key  []byte
+		}{
+			{"name", c.ns.filenameKey(digest)},
+			{"data", c.ns.dataKey(digest)},
+		} {
+			ok, err := c.exists(k.key)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				c.report(key, "contents %s have no %s", digest, k.what)
+				return c.retire(digest)
+			}
+		}
+		buf, err := getValue(c.db, c.ns.digestKey(digest))
+		if err != nil && err != pebble.ErrNotFound {
+			return err
+		}
+		if err == pebble.ErrNotFound || bytesToUint32(buf) != id {
+			c.report(c.ns.digestKey(digest), "does not map contents to doc %d", id)
+			if c.opts.Repair {
+				return c.batch.Set(c.ns.digestKey(digest), uint32ToBytes(id), nil)
+			}
+		}
+		return nil
+	})
+}
+
+// checkFilenames checks that every name entry belongs to a doc, since
+// the contents of a name entry are never indexed again.
+func (c *checker) checkFilenames() error {
+	return c.ns.scan(c.db, filenamePrefix, func(key, val []byte) error {
+		digest := string(bytes.TrimPrefix(key, c.ns.filenameKey("")))
+		if _, ok := c.digests[digest]; ok || c.retired[digest] {
+			return nil
+		}
+		c.report(key, "contents have a name but no doc")
+		return c.retire(digest)
+	})
+}
+
+// checkDigests checks that every digest entry names the doc that has
+// those contents.
+func (c *checker) checkDigests() error {
+	return c.ns.scan(c.db, digestPrefix, func(key, val []byte) error {
+		digest := string(bytes.TrimPrefix(key, c.ns.digestKey("")))
+		if _, ok := c.digests[digest]; ok || c.retired[digest] {
+			return nil
+		}
+		c.report(key, "maps contents to missing doc %d", bytesToUint32(val))
+		return c.delete(key)
+	})
+}
+
+// checkMeta checks that every doc has metadata, and that every
+// metadata and attribute entry belongs to a doc.
+func (c *checker) checkMeta() error {
+	hasMeta := make(map[uint32]bool)
+	prefix := c.ns.makeKey(metaPrefix, "")
+	err := c.ns.scan(c.db, metaPrefix, func(key, val []byte) error {
+		id, err := strconv.ParseUint(string(bytes.TrimPrefix(key, prefix)), 16, 32)
+		if err != nil {
+			return fmt.Errorf("bad metadata key %q: %v", key, err)
+		}
+		if digest, ok := c.docs[uint32(id)]; ok && !c.retired[digest] {
+			hasMeta[uint32(id)] = true
+			return nil
+		}
+		c.report(key, "metadata of missing doc %d", id)
+		if c.opts.Repair {
+			_, err := c.ns.deleteMeta(c.batch, c.db, uint32(id))
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = c.ns.scan(c.db, attrPrefix, func(key, val []byte) error {
+		i := bytes.LastIndexByte(key, ':')
+		id, err := strconv.ParseUint(string(key[i+1:]), 16, 32)
+		if err != nil {
+			return fmt.Errorf("bad attribute key %q: %v", key, err)
+		}
+		if hasMeta[uint32(id)] {
+			return nil
+		}
+		c.report(key, "attribute of doc %d, which has no metadata", id)
+		return c.delete(key)
+	})
+	if err != nil {
+		return err
+	}
+	ids := make([]uint32, 0, len(c.docs))
+	for id := range c.docs {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		if digest := c.docs[id]; !hasMeta[id] && !c.retired[digest] {
+			c.report(c.ns.metaKey(id), "doc has no metadata")
+			if err := c.retire(digest); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkSymbols checks that every symbol belongs to a doc.
+func (c *checker) checkSymbols() error {
+	return c.ns.scan(c.db, symbolPrefix, func(key, val []byte) error {
+		_, digest, err := c.ns.parseSymbolKey(key)
+		if err != nil {
+			return err
+		}
+		if _, ok := c.digests[digest]; ok && !c.retired[digest] {
+			return nil
+		}
+		if !c.retired[digest] {
+			c.report(key, "symbol of contents with no doc")
+		}
+		return c.delete(key)
+	})
+}
+
+// checkNamehashes checks that every path hash refers to stored contents.
+func (c *checker) checkNamehashes() error {
+	return c.ns.scan(c.db, namehashPrefix, func(key, val []byte) error {
+		ok, err := c.exists(c.ns.dataKey(string(val)))
+		if err != nil || ok {
+			return err
+		}
+		c.report(key, "refers to missing contents %s", val)
+		return c.delete(key)
+	})
+}
+
+// checkPaths checks that every path state refers to stored contents,
+// and to the same contents as the path's hash.
+func (c *checker) checkPaths() error {
+	return c.ns.scan(c.db, pathPrefix, func(key, val []byte) error {
+		var ps pathState
+		if err := json.Unmarshal(val, &ps); err != nil {
+			c.report(key, "bad path state: %v", err)
+			return c.delete(key)
+		}
+		name := string(bytes.TrimPrefix(key, c.ns.pathKey("")))
+		buf, err := getValue(c.db, c.ns.namehashKey(hashString(name)))
+		if err != nil && err != pebble.ErrNotFound {
+			return err
+		}
+		ok, err := c.exists(c.ns.dataKey(ps.Digest))
+		if err != nil {
+			return err
+		}
+		switch {
+		case !ok:
+			c.report(key, "refers to missing contents %s", ps.Digest)
+		case string(buf) != ps.Digest:
+			c.report(key, "refers to contents %s, but its hash entry to %q", ps.Digest, buf)
+		default:
+			ok, err := c.exists(c.ns.linkKey(ps.Digest, name))
+			if err != nil || ok {
+				return err
+			}
+			c.report(key, "is not linked from its contents %s", ps.Digest)
+			if !c.opts.Repair {
+				return nil
+			}
+			return c.batch.Set(c.ns.linkKey(ps.Digest, name), nil, nil)
+		}
+		// Without its path state, the path is indexed again
+		// the next time its root is.
+		return c.delete(key)
+	})
+}
+
+// checkLinks checks that every path linked from contents has those
+// contents, and that they are stored.
+func (c *checker) checkLinks() error {
+	return c.ns.scan(c.db, linkPrefix, func(key, val []byte) error {
+		digest, name, err := c.ns.parseLinkKey(key)
+		if err != nil {
+			c.report(key, "%v", err)
+			return c.delete(key)
+		}
+		buf, err := getValue(c.db, c.ns.namehashKey(hashString(name)))
+		if err != nil && err != pebble.ErrNotFound {
+			return err
+		}
+		ok, err := c.exists(c.ns.dataKey(digest))
+		if err != nil {
+			return err
+		}
+		switch {
+		case !ok:
+			c.report(key, "links missing contents to %s", name)
+		case string(buf) != digest:
+			c.report(key, "links %s, whose hash entry refers to %q", name, buf)
+		default:
+			return nil
+		}
+		return c.delete(key)
+	})
+}
+
+// checkHistory checks that every version in the history of a path
+// refers to indexed contents, unless it is a deletion. Compaction
+// forgets the versions whose contents it retires.
+func (c *checker) checkHistory() error {
+	return c.ns.scan(c.db, historyPrefix, func(key, val []byte) error {
+		if _, _, err := c.ns.parseHistoryKey(key); err != nil {
+			c.report(key, "%v", err)
+			return c.delete(key)
+		}
+		var e historyEntry
+		if err := json.Unmarshal(val, &e); err != nil {
+			c.report(key, "bad history entry: %v", err)
+			return c.delete(key)
+		}
+		if e.Digest == "" {
+			return nil
+		}
+		ok, err := c.exists(c.ns.digestKey(e.Digest))
+		if err != nil || ok && !c.retired[e.Digest] {
+			return err
+		}
+		c.report(key, "records retired contents %s of %s", e.Digest, e.Name)
+		return c.delete(key)
+	})
+}
+
+// checkTrigrams derives the trigrams of a sample of docs from their
+// contents and compares them with the posting lists the docs are in.
+func (c *checker) checkTrigrams() error {
+	sample := c.sample()
+	if sample.IsEmpty() {
+		return nil
+	}
+	found := make(map[uint32][]uint32) // sampled doc to its trigrams
+	bm := roaring.New()
+	err := c.ns.scan(c.db, trigramPrefix, func(key, val []byte) error {
+		tri, seg, err := c.ns.parsePostingKey(key)
+		if err != nil {
+			return err
+		}
+		if _, ok := c.segs[seg]; !ok {
+			return nil
+		}
+		bm.Clear()
+		if _, err := bm.ReadFrom(bytes.NewReader(val)); err != nil {
+			return nil // reported by checkPostings
+		}
+		bm.And(sample)
+		t := uint32(tri[0])<<16 | uint32(tri[1])<<8 | uint32(tri[2])
+		for it := bm.Iterator(); it.HasNext(); {
+			id := it.Next()
+			if l := found[id]; len(l) == 0 || l[len(l)-1] != t {
+				found[id] = append(l, t)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for it := sample.Iterator(); it.HasNext(); {
+		id := it.Next()
+		digest := c.docs[id]
+		buf, err := getValue(c.db, c.ns.dataKey(digest))
+		if err != nil {
+			return err
+		}
+		data, err := decodeContents(buf)
+		if err != nil {
+			c.report(c.ns.dataKey(digest), "cannot decode contents: %v", err)
+			if err := c.retire(digest); err != nil {
+				return err
+			}
+			continue
+		}
+		missing, extra := diffTrigrams(fileTrigrams(data), found[id])
+		if missing > 0 || extra > 0 {
+			c.report(c.ns.docKey(id), "posting lists miss %d of its trigrams and add %d", missing, extra)
+			if err := c.retire(digest); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkPostings checks that every posting list, case-folded, of paths
+// or neither, belongs to a committed segment and lists only docs in
+// that segment, and that its count is right. The lists of paths may
+// list docs of any segment. When repairing, it also drops the docs
+// retired by the earlier checks from the lists.
+func (c *checker) checkPostings() error {
+	for _, prefix := range []string{trigramPrefix, foldedPrefix, pathListPrefix} {
+		if err := c.checkLists(prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLists implements checkPostings for the lists of the key family
+// with the given prefix.
+func (c *checker) checkLists(prefix string) error {
+	retired := roaring.New()
+	for digest := range c.retired {
+		if id, ok := c.digests[digest]; ok {
+			retired.Add(id)
+		}
+	}
+	bm := roaring.New()
+	return c.ns.scan(c.db, prefix, func(key, val []byte) error {
+		tri, seg, err := c.ns.parseListKey(prefix, key)
+		if err != nil {
+			return err
+		}
+		ckey := c.ns.countKey(prefix, tri, seg)
+		si, ok := c.segs[seg]
+		if !ok {
+			c.report(key, "posting list of uncommitted segment %s", seg)
+			return c.deleteList(key, ckey)
+		}
+		if prefix == foldedPrefix && !si.Folded {
+			c.report(key, "case-folded posting list of segment %s, which has none", seg)
+			return c.deleteList(key, ckey)
+		}
+		bm.Clear()
+		if _, err := bm.ReadFrom(bytes.NewReader(val)); err != nil {
+			c.report(key, "bad posting list: %v", err)
+			return c.deleteList(key, ckey)
+		}
+		n := uint32(bm.GetCardinality())
+		badCount := true
+		switch buf, err := getValue(c.db, ckey); {
+		case err == pebble.ErrNotFound:
+			c.report(key, "posting list of %d docs has no count", n)
+		case err != nil:
+			return err
+		case len(buf) != 4 || bytesToUint32(buf) != n:
+			c.report(ckey, "count %x of posting list of %d docs", buf, n)
+		default:
+			badCount = false
+		}
+		drop := roaring.And(bm, retired)
+		var bad []uint32
+		for it := bm.Iterator(); it.HasNext(); {
+			id := it.Next()
+			outside := prefix != pathListPrefix && (id < si.FirstDoc || id-si.FirstDoc >= si.NumDocs)
+			if _, ok := c.docs[id]; !ok || outside {
+				bad = append(bad, id)
+				drop.Add(id)
+			}
+		}
+		if len(bad) > 0 {
+			c.report(key, "lists %d docs that are missing or outside the segment, such as %d", len(bad), bad[0])
+		}
+		if !c.opts.Repair || drop.IsEmpty() && !badCount {
+			return nil
+		}
+		bm.AndNot(drop)
+		_, err = c.ns.setList(c.batch, prefix, tri, seg, bm)
+		return err
+	})
+}
+
+// deleteList deletes the posting list with the given key and its count
+// if repairing.
+func (c *checker) deleteList(key, countKey []byte) error {
+	if err := c.delete(key); err != nil {
+		return err
+	}
+	return c.delete(countKey)
+}
+
+// checkCounts checks that every posting list count is that of a list.
+func (c *checker) checkCounts() error {
+	return c.ns.scan(c.db, countPrefix, func(key, val []byte) error {
+		prefix, tri, seg, err := c.ns.parseCountKey(key)
+		if err != nil {
+			c.report(key, "%v", err)
+			return c.delete(key)
+		}
+		_, err = getValue(c.db, c.ns.makeKey(prefix, tri+":"+seg))
+		if err == pebble.ErrNotFound {
+			c.report(key, "count of missing posting list")
+			return c.delete(key)
+		}
+		return err
+	})
+}
+
+// sample returns the IDs of the docs whose trigrams are compared with
+// the posting lists, spread evenly over the docs not already retired.
+func (c *checker) sample() *roaring.Bitmap {
+	var ids []uint32
+	for id, digest := range c.docs {
+		if !c.retired[digest] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	sample := roaring.New()
+	n := c.opts.Sample
+	if n < 0 || n > len(ids) {
+		n = len(ids)
+	}
+	for i := 0; i < n; i++ {
+		sample.Add(ids[i*len(ids)/n])
+	}
+	return sample
+}
+
+// fileTrigrams returns the distinct trigrams of data, in increasing order.
+func fileTrigrams(data []byte) []uint32 {
+	seen := make(map[uint32]bool)
+	var tris []uint32
+	for i := 0; i+3 <= len(data); i++ {
+		t := uint32(data[i])<<16 | uint32(data[i+1])<<8 | uint32(data[i+2])
+		if !seen[t] {
+			seen[t] = true
+			tris = append(tris, t)
+		}
+	}
+	sort.Slice(tris, func(i, j int) bool { return tris[i] < tris[j] })
+	return tris
+}
+
+// diffTrigrams counts the trigrams in want but not got, and in got
+// but not want. Both must be sorted.
+func diffTrigrams(want, got []uint32) (missing, extra int) {
+	for len(want) > 0 && len(got) > 0 {
+		switch {
+		case want[0] < got[0]:
+			missing++
+			want = want[1:]
+		case want[0] > got[0]:
+			extra++
+			got = got[1:]
+		default:
+			want, got = want[1:], got[1:]
+		}
+	}
+	return missing + len(want), extra + len(got)
+}
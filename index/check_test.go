@@ -0,0 +1,108 @@
+package index
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/cockroachdb/pebble"
+)
+
+func TestCheck(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	iw := addFiles(t, db, &WriterOptions{Codec: CodecFlate}, map[string]string{
+		"a": "alpha beta\n",
+		"b": "gamma delta\n",
+		"c": "epsilon\n",
+		"d": "zeta eta ⇒ θ\n",
+	})
+	// Compaction must keep the lists of trigrams of multibyte runes.
+	if err := iw.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check := func(repair bool) []Problem {
+		problems, err := Check(db, &CheckOptions{Sample: -1, Repair: repair})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return problems
+	}
+	if problems := check(false); len(problems) != 0 {
+		t.Fatalf("Check found problems in a good index: %v", problems)
+	}
+
+	ns := namespace("")
+	set := func(key []byte, val []byte) {
+		if err := db.Set(key, val, pebble.Sync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	del := func(key []byte) {
+		if err := db.Delete(key, pebble.Sync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	digest := func(id uint32) string {
+		buf, err := getValue(db, ns.docKey(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+
+	// Contents of b lost.
+	del(ns.dataKey(digest(1)))
+	// A path hash to nowhere.
+	set(ns.namehashKey(hashString("gone")), []byte("feed"))
+	// A doc from an interrupted run, with a posting list.
+	set(ns.docKey(9), []byte("beef"))
+	set(ns.filenameKey("beef"), []byte("e"))
+	set(ns.dataKey("beef"), []byte("xyz"))
+	buf := new(bytes.Buffer)
+	roaring.BitmapOf(9).WriteTo(buf)
+	set(ns.postingKey("xyz", "unfinished"), buf.Bytes())
+	// c missing from one of its posting lists.
+	segs, err := ns.segments(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seg := range segs {
+		buf := new(bytes.Buffer)
+		roaring.New().WriteTo(buf)
+		set(ns.postingKey("eps", seg), buf.Bytes())
+	}
+
+	problems := check(false)
+	if len(problems) < 5 {
+		t.Errorf("Check found %d problems, want at least 5:\n%v", len(problems), problems)
+	}
+	for _, p := range problems {
+		if p.Repaired {
+			t.Errorf("%v repaired without Repair", p)
+		}
+	}
+	if n := len(check(false)); n != len(problems) {
+		t.Errorf("second Check found %d problems, want the same %d", n, len(problems))
+	}
+	if n := len(check(true)); n != len(problems) {
+		t.Errorf("Check with Repair found %d problems, want %d", n, len(problems))
+	}
+	if problems := check(false); len(problems) != 0 {
+		t.Errorf("Check found problems after repair: %v", problems)
+	}
+
+	// Only a and d are left, and re-adding c indexes it again.
+	iw = addFiles(t, db, nil, map[string]string{"c": "epsilon\n"})
+	if st := iw.Stats(); st.FilesIndexed != 1 {
+		t.Errorf("re-adding c: %+v, want 1 file indexed", st)
+	}
+}
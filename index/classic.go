@@ -0,0 +1,323 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// Classic index files are the single-file indexes of the original
+// codesearch tools, whose index/read.go documents their layout.
+const (
+	classicMagic         = "csearch index 1\n"
+	classicTrailerMagic  = "\ncsearch trailr\n"
+	classicPostEntrySize = 3 + 4 + 4
+)
+
+// WriteClassic writes repository repo of ix to w as a classic index
+// file that the original codesearch tools can read. Since csearch
+// reads matching files from the file system, it returns an error if
+// a root or file of repo is not named by an absolute path, as the
+// files that cindex adds are.
+func (ix *Index) WriteClassic(w io.Writer, repo string) error {
+	if err := validRepository(repo); err != nil {
+		return err
+	}
+	ns := namespace(repo)
+	snap := ix.db.NewSnapshot()
+	defer snap.Close()
+
+	roots, err := ns.roots(snap)
+	if err != nil {
+		return err
+	}
+	for _, r := range roots {
+		if !filepath.IsAbs(r.Path) {
+			return fmt.Errorf("%q: root is not an absolute path", r.Path)
+		}
+	}
+	segs, err := ns.segments(snap)
+	if err != nil {
+		return err
+	}
+
+	// Number the files in name order. Files with the same contents
+	// share a doc, but each has its own file ID.
+	var (
+		names     bytes.Buffer
+		nameIndex []uint32
+		docFiles  = make(map[uint32][]uint32)
+	)
+	err = ns.scan(snap, pathPrefix, func(key, val []byte) error {
+		name := bytes.TrimPrefix(key, ns.pathKey(""))
+		if bytes.IndexByte(name, 0) >= 0 {
+			return fmt.Errorf("%q: file has NUL byte in name", name)
+		}
+		if !filepath.IsAbs(string(name)) {
+			return fmt.Errorf("%q: file is not named by an absolute path", name)
+		}
+		var ps pathState
+		if err := json.Unmarshal(val, &ps); err != nil {
+			return err
+		}
+		doc, ok, err := ns.lookupDoc(snap, ps.Digest)
+		if err != nil || !ok {
+			return err
+		}
+		docFiles[doc] = append(docFiles[doc], uint32(len(nameIndex)))
+		nameIndex = append(nameIndex, uint32(names.Len()))
+		names.Write(name)
+		names.WriteByte(0)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	nameIndex = append(nameIndex, uint32(names.Len()))
+	names.WriteByte(0)
+
+	cw := &classicWriter{w: bufio.NewWriter(w)}
+	var off [5]int64
+	cw.writeString(classicMagic)
+	off[0] = cw.off
+	for _, r := range roots {
+		cw.writeString(r.Path)
+		cw.writeString("\x00")
+	}
+	cw.writeString("\x00")
+	off[1] = cw.off
+	cw.write(names.Bytes())
+	off[2] = cw.off
+
+	type postIndexEntry struct {
+		trigram string
+		count   uint32
+		offset  uint32
+	}
+	var (
+		postIndex   []postIndexEntry
+		trigram     string
+		resultSet   = roaring.New()
+		postingList = roaring.New()
+	)
+	writeList := func(trigram string, files *roaring.Bitmap) {
+		postIndex = append(postIndex, postIndexEntry{trigram, uint32(files.GetCardinality()), uint32(cw.off - off[2])})
+		cw.writeString(trigram)
+		prev := ^uint32(0)
+		for it := files.Iterator(); it.HasNext(); {
+			id := it.Next()
+			cw.writeUvarint(id - prev)
+			prev = id
+		}
+		cw.writeUvarint(0)
+	}
+	// finish writes the list of trigram, mapped to file IDs.
+	finish := func() {
+		if trigram == "" {
+			return
+		}
+		files := roaring.New()
+		for it := resultSet.Iterator(); it.HasNext(); {
+			files.AddMany(docFiles[it.Next()])
+		}
+		if !files.IsEmpty() {
+			writeList(trigram, files)
+		}
+		resultSet.Clear()
+	}
+	err = ns.scan(snap, trigramPrefix, func(key, val []byte) error {
+		tri, seg, err := ns.parsePostingKey(key)
+		if err != nil {
+			return err
+		}
+		if segs[seg] == nil || tri == "\xff\xff\xff" {
+			return nil
+		}
+		if tri != trigram {
+			finish()
+			trigram = tri
+		}
+		postingList.Clear()
+		if _, err := postingList.ReadFrom(bytes.NewReader(val)); err != nil {
+			return err
+		}
+		resultSet.Or(postingList)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	finish()
+	writeList("\xff\xff\xff", roaring.New())
+
+	off[3] = cw.off
+	for _, x := range nameIndex {
+		cw.writeUint32(x)
+	}
+	off[4] = cw.off
+	for _, e := range postIndex {
+		cw.writeString(e.trigram)
+		cw.writeUint32(e.count)
+		cw.writeUint32(e.offset)
+	}
+	if cw.off > math.MaxUint32 {
+		return fmt.Errorf("index too large for the classic format (%d bytes)", cw.off)
+	}
+	for _, x := range off {
+		cw.writeUint32(uint32(x))
+	}
+	cw.writeString(classicTrailerMagic)
+	return cw.w.Flush()
+}
+
+// A classicWriter writes a classic index file, tracking its offset.
+// Errors are left for the final Flush of w to report.
+type classicWriter struct {
+	w   *bufio.Writer
+	off int64
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (cw *classicWriter) write(b []byte) {
+	cw.w.Write(b)
+	cw.off += int64(len(b))
+}
+
+func (cw *classicWriter) writeString(s string) {
+	cw.w.WriteString(s)
+	cw.off += int64(len(s))
+}
+
+func (cw *classicWriter) writeUint32(x uint32) {
+	binary.BigEndian.PutUint32(cw.buf[:], x)
+	cw.write(cw.buf[:4])
+}
+
+func (cw *classicWriter) writeUvarint(x uint32) {
+	n := binary.PutUvarint(cw.buf[:], uint64(x))
+	cw.write(cw.buf[:n])
+}
+
+// A classicIndex is a classic index file read into memory.
+type classicIndex struct {
+	data      []byte
+	pathData  uint32
+	nameData  uint32
+	postData  uint32
+	nameIndex uint32
+	postIndex uint32
+	numName   int
+	numPost   int
+}
+
+func readClassic(data []byte) (*classicIndex, error) {
+	n := len(data) - len(classicTrailerMagic)
+	if n < len(classicMagic)+5*4 || string(data[n:]) != classicTrailerMagic || string(data[:len(classicMagic)]) != classicMagic {
+		return nil, fmt.Errorf("not a classic index file")
+	}
+	ci := &classicIndex{data: data}
+	for i, p := range []*uint32{&ci.pathData, &ci.nameData, &ci.postData, &ci.nameIndex, &ci.postIndex} {
+		*p = binary.BigEndian.Uint32(data[n-(5-i)*4:])
+		if int(*p) > n-5*4 {
+			return nil, fmt.Errorf("corrupt classic index: bad section offset %d", *p)
+		}
+	}
+	if ci.postIndex < ci.nameIndex {
+		return nil, fmt.Errorf("corrupt classic index: sections out of order")
+	}
+	ci.numName = int((ci.postIndex-ci.nameIndex)/4) - 1
+	ci.numPost = (n - 5*4 - int(ci.postIndex)) / classicPostEntrySize
+	return ci, nil
+}
+
+// str returns the NUL-terminated string at offset off.
+func (ci *classicIndex) str(off uint32) (string, error) {
+	if int(off) >= len(ci.data) {
+		return "", fmt.Errorf("corrupt classic index: bad string offset %d", off)
+	}
+	i := bytes.IndexByte(ci.data[off:], 0)
+	if i < 0 {
+		return "", fmt.Errorf("corrupt classic index: unterminated string")
+	}
+	return string(ci.data[off : int(off)+i]), nil
+}
+
+// paths returns the roots recorded in ci.
+func (ci *classicIndex) paths() ([]string, error) {
+	var paths []string
+	for off := ci.pathData; ; {
+		p, err := ci.str(off)
+		if err != nil {
+			return nil, err
+		}
+		if p == "" {
+			return paths, nil
+		}
+		paths = append(paths, p)
+		off += uint32(len(p)) + 1
+	}
+}
+
+// name returns the name of file id.
+func (ci *classicIndex) name(id int) (string, error) {
+	off := binary.BigEndian.Uint32(ci.data[ci.nameIndex+uint32(4*id):])
+	return ci.str(ci.nameData + off)
+}
+
+// ImportClassic adds the files named in the classic index file to the
+// index, and records its paths as roots. Classic index files do not
+// hold file contents, so the files are read again from the file system,
+// and those that no longer exist are logged and skipped. It returns the
+// number of files added or found unchanged.
+func (iw *IndexWriter) ImportClassic(file string) (int, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	ci, err := readClassic(data)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", file, err)
+	}
+	paths, err := ci.paths()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", file, err)
+	}
+	n := 0
+	for id := 0; id < ci.numName; id++ {
+		name, err := ci.name(id)
+		if err != nil {
+			return n, fmt.Errorf("%s: %v", file, err)
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			log.Printf("%s: %v", name, err)
+			continue
+		}
+		unchanged, err := iw.Unchanged(name, info)
+		if err != nil {
+			return n, err
+		}
+		if !unchanged {
+			if err := iw.AddFile(name); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	for _, p := range paths {
+		if err := iw.AddRoot(Root{Path: p, Indexed: time.Now()}); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
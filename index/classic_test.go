@@ -0,0 +1,179 @@
+package index
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// postingList returns the file IDs in ci's posting list for trigram,
+// decoding it as upstream csearch does.
+func (ci *classicIndex) postingList(t *testing.T, trigram uint32) []uint32 {
+	for i := 0; i < ci.numPost; i++ {
+		e := ci.data[int(ci.postIndex)+i*classicPostEntrySize:]
+		if uint32(e[0])<<16|uint32(e[1])<<8|uint32(e[2]) != trigram {
+			continue
+		}
+		count := binary.BigEndian.Uint32(e[3:])
+		d := ci.data[ci.postData+binary.BigEndian.Uint32(e[7:]):]
+		if !bytes.Equal(d[:3], e[:3]) {
+			t.Fatalf("posting list for %q starts with trigram %q", e[:3], d[:3])
+		}
+		d = d[3:]
+		var ids []uint32
+		for id := ^uint32(0); ; {
+			delta, n := binary.Uvarint(d)
+			if n <= 0 {
+				t.Fatalf("bad posting list for %q", e[:3])
+			}
+			d = d[n:]
+			if delta == 0 {
+				break
+			}
+			id += uint32(delta)
+			ids = append(ids, id)
+		}
+		if len(ids) != int(count) {
+			t.Errorf("posting list for %q has %d files, index says %d", e[:3], len(ids), count)
+		}
+		return ids
+	}
+	return nil
+}
+
+func TestClassic(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+	src := filepath.Join(d, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"a.go": "func alpha() {}\n",
+		"b.go": "func beta() {}\n",
+		"c.go": "func alpha() {}\n", // same contents as a.go
+	}
+	var names []string
+	for _, name := range []string{"a.go", "b.go", "c.go"} {
+		path := filepath.Join(src, name)
+		if err := os.WriteFile(path, []byte(files[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, path)
+	}
+
+	db, err := pebble.Open(filepath.Join(d, "index"), &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	iw, err := Create(db, &WriterOptions{Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := iw.AddFile(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := iw.AddRoot(Root{Path: src}); err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	ix, err := Open(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ix.WriteClassic(&buf, ""); err != nil {
+		t.Fatal(err)
+	}
+	ci, err := readClassic(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if paths, err := ci.paths(); err != nil || !reflect.DeepEqual(paths, []string{src}) {
+		t.Errorf("paths = %q, %v, want [%q]", paths, err, src)
+	}
+	if ci.numName != len(names) {
+		t.Fatalf("%d names, want %d", ci.numName, len(names))
+	}
+	for id, want := range names {
+		if got, err := ci.name(id); err != nil || got != want {
+			t.Errorf("name(%d) = %q, %v, want %q", id, got, err, want)
+		}
+	}
+	for tri, want := range map[uint32][]uint32{
+		tri('a', 'l', 'p'): {0, 2},
+		tri('b', 'e', 't'): {1},
+		tri('f', 'u', 'n'): {0, 1, 2},
+		tri('x', 'y', 'z'): nil,
+	} {
+		if got := ci.postingList(t, tri); !reflect.DeepEqual(got, want) {
+			t.Errorf("posting list for %q = %v, want %v", trigramToString(tri), got, want)
+		}
+	}
+	if got := ci.postingList(t, 1<<24-1); len(got) != 0 {
+		t.Errorf("final posting list = %v, want empty", got)
+	}
+
+	// Import the classic index into a new repository.
+	classic := filepath.Join(d, "csearchindex")
+	if err := os.WriteFile(classic, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	iw, err = Create(db, &WriterOptions{Repository: "imported"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := iw.ImportClassic(classic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(names) {
+		t.Errorf("imported %d files, want %d", n, len(names))
+	}
+	if err := iw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	roots, err := iw.Roots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 || roots[0].Path != src {
+		t.Errorf("imported roots %+v, want %q", roots, src)
+	}
+	ix, err = Open(db, &ReaderOptions{Repositories: []string{"imported"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	it := ix.Paths()
+	for it.Next() {
+		got = append(got, it.Path().Name)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, names) {
+		t.Errorf("imported paths %q, want %q", got, names)
+	}
+
+	// Files added by relative name cannot be found by csearch.
+	addFiles(t, db, &WriterOptions{Repository: "relative"}, map[string]string{"a.go": files["a.go"]})
+	if err := ix.WriteClassic(&buf, "relative"); err == nil {
+		t.Errorf("WriteClassic of files with relative names succeeded")
+	}
+
+	if _, err := readClassic([]byte("not an index")); err == nil {
+		t.Errorf("readClassic accepted a file that is not an index")
+	}
+}
@@ -0,0 +1,103 @@
+package index
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+
+	"github.com/golang/snappy"
+)
+
+// A Codec is a compression scheme for the file contents stored in the
+// index.
+type Codec byte
+
+const (
+	CodecNone   Codec = iota // store contents as is
+	CodecSnappy              // fast, moderate compression
+	CodecFlate               // slower, better compression
+)
+
+var codecNames = []string{
+	CodecNone:   "none",
+	CodecSnappy: "snappy",
+	CodecFlate:  "flate",
+}
+
+func (c Codec) String() string {
+	if int(c) < len(codecNames) {
+		return codecNames[c]
+	}
+	return fmt.Sprintf("Codec(%d)", byte(c))
+}
+
+// ParseCodec returns the Codec with the given name.
+func ParseCodec(name string) (Codec, error) {
+	for c, n := range codecNames {
+		if n == name {
+			return Codec(c), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown codec %q", name)
+}
+
+// Compressed contents are stored behind a two-byte header: codecMagic
+// followed by the Codec. Indexed contents are valid UTF-8, which never
+// contains the byte 0xff, so contents stored without a header (by
+// CodecNone, or by indexes that predate compression) cannot be
+// mistaken for compressed ones.
+const codecMagic = 0xff
+
+// encodeContents returns data compressed with c, or data itself if
+// compressing it would not save space.
+func encodeContents(c Codec, data []byte) ([]byte, error) {
+	var buf []byte
+	switch c {
+	case CodecNone:
+		return data, nil
+	case CodecSnappy:
+		buf = make([]byte, 2+snappy.MaxEncodedLen(len(data)))
+		buf = buf[:2+len(snappy.Encode(buf[2:], data))]
+	case CodecFlate:
+		b := bytes.NewBuffer([]byte{0, 0})
+		w, err := flate.NewWriter(b, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		buf = b.Bytes()
+	default:
+		return nil, fmt.Errorf("unknown codec %v", c)
+	}
+	if len(buf) >= len(data) {
+		return data, nil
+	}
+	buf[0], buf[1] = codecMagic, byte(c)
+	return buf, nil
+}
+
+// decodeContents returns the contents stored in buf.
+func decodeContents(buf []byte) ([]byte, error) {
+	if len(buf) == 0 || buf[0] != codecMagic {
+		return buf, nil
+	}
+	if len(buf) < 2 {
+		return nil, fmt.Errorf("truncated contents header")
+	}
+	switch c := Codec(buf[1]); c {
+	case CodecSnappy:
+		return snappy.Decode(nil, buf[2:])
+	case CodecFlate:
+		r := flate.NewReader(bytes.NewReader(buf[2:]))
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("unknown codec %v", c)
+	}
+}
@@ -0,0 +1,78 @@
+package index
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+)
+
+func TestCodecs(t *testing.T) {
+	text := []byte(strings.Repeat("func main() { fmt.Println(\"hello\") }\n", 100))
+	for _, c := range []Codec{CodecNone, CodecSnappy, CodecFlate} {
+		enc, err := encodeContents(c, text)
+		if err != nil {
+			t.Fatalf("%v: %v", c, err)
+		}
+		if c != CodecNone && len(enc) >= len(text) {
+			t.Errorf("%v: encoded %d bytes as %d", c, len(text), len(enc))
+		}
+		dec, err := decodeContents(enc)
+		if err != nil {
+			t.Fatalf("%v: %v", c, err)
+		}
+		if !bytes.Equal(dec, text) {
+			t.Errorf("%v: round trip changed contents", c)
+		}
+	}
+
+	// Short contents do not compress and are stored as is.
+	short := []byte("hi\n")
+	if enc, _ := encodeContents(CodecFlate, short); !bytes.Equal(enc, short) {
+		t.Errorf("encodeContents(%q) = %q, want it unchanged", short, enc)
+	}
+	if _, err := decodeContents([]byte{codecMagic, 42, 'x'}); err == nil {
+		t.Errorf("decodeContents with unknown codec succeeded")
+	}
+	if c, err := ParseCodec("snappy"); err != nil || c != CodecSnappy {
+		t.Errorf("ParseCodec(snappy) = %v, %v", c, err)
+	}
+	if _, err := ParseCodec("zip"); err == nil {
+		t.Errorf("ParseCodec(zip) succeeded")
+	}
+}
+
+func TestCompressedContents(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	big := strings.Repeat("package main\n", 200)
+	addFiles(t, db, nil, map[string]string{"old.go": big})
+	iw := addFiles(t, db, &WriterOptions{Codec: CodecSnappy}, map[string]string{"new.go": big + "// new\n"})
+	st := iw.Stats()
+	if st.ContentBytes != int64(len(big)+7) || st.StoredBytes >= st.ContentBytes {
+		t.Errorf("stats = %d content bytes, %d stored, want %d content bytes, fewer stored", st.ContentBytes, st.StoredBytes, len(big)+7)
+	}
+
+	ix, err := Open(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, want := range []string{big, big + "// new\n"} {
+		buf, err := ix.Contents(Hit{FileID: uint32(id)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != want {
+			t.Errorf("Contents(%d) = %d bytes, want %d", id, len(buf), len(want))
+		}
+	}
+}
@@ -1,14 +1,18 @@
 package index
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
-	"flag"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"strconv"
+	"strings"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/cockroachdb/pebble"
 )
 
@@ -16,12 +20,28 @@ const (
 	dataPrefix     = "dat:"
 	filenamePrefix = "fil:"
 	trigramPrefix  = "tri:"
+	foldedPrefix   = "fld:"
+	countPrefix    = "cnt:"
 	namehashPrefix = "nam:"
-)
+	docPrefix      = "doc:"
+	segmentPrefix  = "seg:"
+	nextDocPrefix  = "nxt:"
+	rootPrefix     = "roo:"
+	pathPrefix     = "pth:"
+	digestPrefix   = "dig:"
+	skipPrefix     = "skp:"
+	pendingPrefix  = "pnd:"
+	metaPrefix     = "met:"
+	attrPrefix     = "att:"
+	symbolPrefix   = "sym:"
+	linkPrefix     = "lnk:"
+	historyPrefix  = "his:"
+	pathListPrefix = "ptr:"
 
-var (
-	// TODO(tylerw): set via API instead.
-	repository = flag.String("repo", "", "A repository to index to / filter to")
+	// repositoryPrefix keys are not namespaced; there is one
+	// per repository that has ever been written to.
+	repositoryPrefix = "rep:"
+	versionPrefix    = "ver:"
 )
 
 func trigramToBytes(tv uint32) []byte {
@@ -84,31 +104,364 @@ func hashString(s string) string {
 	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-func hashFile(f io.ReadSeeker) ([]byte, error) {
+func hashFile(f io.ReadSeeker) ([]byte, int64, error) {
 	// Compute the SHA256 hash of the file.
 	h := sha256.New()
-	if _, err := io.Copy(h, f); err != nil {
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return h.Sum(nil), n, nil
+}
+
+// A namespace holds the keys of a single repository. Every key
+// family of the repository is stored under the repository name.
+type namespace string
+
+// validRepository returns an error if name cannot be used as a
+// repository name. Names may not contain ':', which keeps one
+// repository's keys from falling inside another's key ranges.
+func validRepository(name string) error {
+	if strings.Contains(name, ":") {
+		return fmt.Errorf("invalid repository name %q: must not contain ':'", name)
+	}
+	return nil
+}
+
+func (ns namespace) makeKey(prefix, key string) []byte {
+	return []byte(string(ns) + prefix + key)
+}
+
+func (ns namespace) dataKey(key string) []byte {
+	return ns.makeKey(dataPrefix, key)
+}
+
+func (ns namespace) filenameKey(key string) []byte {
+	return ns.makeKey(filenamePrefix, key)
+}
+
+func (ns namespace) trigramKey(key string) []byte {
+	return ns.makeKey(trigramPrefix, key)
+}
+
+func (ns namespace) namehashKey(key string) []byte {
+	return ns.makeKey(namehashPrefix, key)
+}
+
+// docKey returns the key mapping a doc ID to the digest of its
+// contents. IDs are fixed-width hex so that keys sort by ID.
+func (ns namespace) docKey(id uint32) []byte {
+	return ns.makeKey(docPrefix, fmt.Sprintf("%08x", id))
+}
+
+// postingKey returns the key of the posting list for trigram
+// written by the given segment.
+func (ns namespace) postingKey(trigram, segmentID string) []byte {
+	return ns.makeKey(trigramPrefix, trigram+":"+segmentID)
+}
+
+// foldedKey returns the key of the posting list for the case-folded
+// trigram written by the given segment. The list holds the docs that
+// contain any of the trigram's ASCII case variants.
+func (ns namespace) foldedKey(trigram, segmentID string) []byte {
+	return ns.makeKey(foldedPrefix, trigram+":"+segmentID)
+}
+
+// countKey returns the key of the number of docs in the posting list
+// for trigram written by the given segment, in the family of lists with
+// the given prefix: trigramPrefix or foldedPrefix. Counts are kept so
+// that queries can be planned without reading the lists themselves.
+func (ns namespace) countKey(prefix, trigram, segmentID string) []byte {
+	return ns.makeKey(countPrefix, prefix+trigram+":"+segmentID)
+}
+
+// parseCountKey splits a key made by countKey into its list prefix,
+// trigram and segment ID.
+func (ns namespace) parseCountKey(key []byte) (prefix, trigram, segmentID string, err error) {
+	rest := bytes.TrimPrefix(key, ns.makeKey(countPrefix, ""))
+	if len(rest) < len(trigramPrefix)+4 || rest[len(trigramPrefix)+3] != ':' {
+		return "", "", "", fmt.Errorf("bad posting list count key %q", key)
+	}
+	n := len(trigramPrefix)
+	return string(rest[:n]), string(rest[n : n+3]), string(rest[n+4:]), nil
+}
+
+// setList adds to batch the posting list bm for trigram written by the
+// given segment, in the family of lists with the given prefix, along
+// with its count. It returns the number of bytes written.
+func (ns namespace) setList(batch *pebble.Batch, prefix, trigram, segmentID string, bm *roaring.Bitmap) (int, error) {
+	buf := new(bytes.Buffer)
+	if _, err := bm.WriteTo(buf); err != nil {
+		return 0, err
+	}
+	key := ns.makeKey(prefix, trigram+":"+segmentID)
+	if err := batch.Set(key, buf.Bytes(), nil); err != nil {
+		return 0, err
+	}
+	ckey := ns.countKey(prefix, trigram, segmentID)
+	if err := batch.Set(ckey, uint32ToBytes(uint32(bm.GetCardinality())), nil); err != nil {
+		return 0, err
+	}
+	return len(key) + buf.Len() + len(ckey) + 4, nil
+}
+
+// foldedTrigram marks a trigram as case-folded, in post entries and
+// in the trigrams passed to postingListBM. Trigrams are only 24 bits.
+const foldedTrigram = 1 << 24
+
+// foldTrigram returns trigram with its ASCII upper-case letters made
+// lower case.
+func foldTrigram(trigram uint32) uint32 {
+	var f uint32
+	for shift := 16; shift >= 0; shift -= 8 {
+		c := trigram >> shift & 0xff
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		f |= c << shift
+	}
+	return f
+}
+
+// caseVariants returns the trigrams that fold to the case-folded
+// trigram: one for each combination of cases of its ASCII letters.
+func caseVariants(trigram uint32) []uint32 {
+	variants := []uint32{trigram}
+	for shift := 16; shift >= 0; shift -= 8 {
+		c := trigram >> shift & 0xff
+		if c < 'a' || c > 'z' {
+			continue
+		}
+		for _, v := range variants {
+			variants = append(variants, v&^(0xff<<shift)|(c-'a'+'A')<<shift)
+		}
+	}
+	return variants
+}
+
+// parsePostingKey splits a key made by postingKey into its trigram
+// and segment ID. The trigram is always 3 bytes, and may contain ':'.
+func (ns namespace) parsePostingKey(key []byte) (trigram, segmentID string, err error) {
+	return ns.parseListKey(trigramPrefix, key)
+}
+
+// parseListKey is like parsePostingKey, for the lists of the key
+// family with the given prefix: trigramPrefix or foldedPrefix.
+func (ns namespace) parseListKey(prefix string, key []byte) (trigram, segmentID string, err error) {
+	rest := bytes.TrimPrefix(key, ns.makeKey(prefix, ""))
+	if len(rest) < 4 || rest[3] != ':' {
+		return "", "", fmt.Errorf("bad posting list key %q", key)
+	}
+	return string(rest[:3]), string(rest[4:]), nil
+}
+
+// digestKey returns the key mapping the digest of some contents to
+// the doc ID they were indexed as; the inverse of docKey.
+func (ns namespace) digestKey(digest string) []byte {
+	return ns.makeKey(digestPrefix, digest)
+}
+
+// lookupDoc returns the ID of the doc with the given contents, or
+// false if they have been retired, as compaction and GC may do at any
+// time.
+func (ns namespace) lookupDoc(db pebble.Reader, digest string) (uint32, bool, error) {
+	buf, err := getValue(db, ns.digestKey(digest))
+	if err == pebble.ErrNotFound {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return bytesToUint32(buf), true, nil
+}
+
+// lookupDigest is the inverse of lookupDoc.
+func (ns namespace) lookupDigest(db pebble.Reader, id uint32) (string, bool, error) {
+	buf, err := getValue(db, ns.docKey(id))
+	if err == pebble.ErrNotFound {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(buf), true, nil
+}
+
+func (ns namespace) segmentKey(segmentID string) []byte {
+	return ns.makeKey(segmentPrefix, segmentID)
+}
+
+// nextDocKey holds the next unallocated doc ID of the namespace.
+func (ns namespace) nextDocKey() []byte {
+	return ns.makeKey(nextDocPrefix, "")
+}
+
+// parseDocKey returns the doc ID encoded in a key made by docKey.
+func (ns namespace) parseDocKey(key []byte) (uint32, error) {
+	id, err := strconv.ParseUint(string(bytes.TrimPrefix(key, ns.makeKey(docPrefix, ""))), 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("bad doc key %q: %v", key, err)
+	}
+	return uint32(id), nil
+}
+
+// A segmentInfo describes a segment committed by IndexWriter.Flush.
+// Each segment allocates a contiguous run of doc IDs.
+type segmentInfo struct {
+	FirstDoc uint32 `json:"first_doc"`
+	NumDocs  uint32 `json:"num_docs"`
+
+	// Folded records that the segment has case-folded posting lists
+	// as well as the usual ones.
+	Folded bool `json:"folded,omitempty"`
+
+	// Committed is when the segment recorded its changes, in Unix
+	// nanoseconds; for a compacted segment, the latest of its own.
+	Committed int64 `json:"committed,omitempty"`
+}
+
+func (si *segmentInfo) encode() []byte {
+	buf, err := json.Marshal(si)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return buf
+}
+
+func decodeSegmentInfo(buf []byte) (*segmentInfo, error) {
+	si := &segmentInfo{}
+	if err := json.Unmarshal(buf, si); err != nil {
 		return nil, err
 	}
-	return h.Sum(nil), nil
+	return si, nil
+}
+
+// linkKey returns the key recording that the path name has the
+// contents with the given digest. Keys sort by digest, so that every
+// path with the same contents is found with a range scan.
+func (ns namespace) linkKey(digest, name string) []byte {
+	return ns.makeKey(linkPrefix, digest+":"+name)
+}
+
+// parseLinkKey splits a key made by linkKey into its digest and path.
+func (ns namespace) parseLinkKey(key []byte) (digest, name string, err error) {
+	rest := bytes.TrimPrefix(key, ns.makeKey(linkPrefix, ""))
+	i := bytes.IndexByte(rest, ':')
+	if i < 0 {
+		return "", "", fmt.Errorf("bad link key %q", key)
+	}
+	return string(rest[:i]), string(rest[i+1:]), nil
+}
+
+// paths returns the paths whose current contents have the given
+// digest, in increasing order.
+func (ns namespace) paths(db pebble.Reader, digest string) ([]string, error) {
+	var names []string
+	err := ns.scan(db, linkPrefix+digest+":", func(key, val []byte) error {
+		_, name, err := ns.parseLinkKey(key)
+		names = append(names, name)
+		return err
+	})
+	return names, err
+}
+
+// isCurrent reports whether the contents with the given digest are
+// still the current contents of some path: of the file they were
+// indexed under, or of another with the same contents. Contents go
+// stale when every such file is re-indexed with different contents or
+// deleted, and are retired when compaction drops them.
+func (ns namespace) isCurrent(db pebble.Reader, digest string) (bool, error) {
+	prefix := ns.linkKey(digest, "")
+	iter := db.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixEnd(prefix),
+	})
+	found := iter.First()
+	if err := iter.Close(); err != nil {
+		return false, err
+	}
+	return found, nil
+}
+
+// segments returns the segments committed to the namespace, by ID.
+func (ns namespace) segments(db pebble.Reader) (map[string]*segmentInfo, error) {
+	iter := db.NewIter(&pebble.IterOptions{
+		LowerBound: ns.segmentKey(""),
+		UpperBound: prefixEnd(ns.segmentKey("")),
+	})
+	defer iter.Close()
+
+	segs := make(map[string]*segmentInfo)
+	for iter.First(); iter.Valid(); iter.Next() {
+		si, err := decodeSegmentInfo(iter.Value())
+		if err != nil {
+			return nil, fmt.Errorf("bad segment %q: %v", iter.Key(), err)
+		}
+		segs[string(bytes.TrimPrefix(iter.Key(), ns.segmentKey("")))] = si
+	}
+	return segs, iter.Error()
 }
 
-func makeKey(prefix, key string) []byte {
-	return []byte(*repository + prefix + key)
+// prefixEnd returns the smallest key greater than every key that
+// starts with prefix, for use as an iterator's UpperBound.
+// Keys may contain any byte after a prefix, so appending a high byte
+// to the prefix does not do.
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil // every key is greater than prefix
 }
 
-func dataKey(key string) []byte {
-	return makeKey(dataPrefix, key)
+// getValue returns a copy of the value stored under key.
+// maxBatch is the size in bytes at which a long write commits its
+// batch and starts another, to bound the memory it holds.
+const maxBatch = 64 << 20
+
+// commitIfFull commits *batch and replaces it with a new batch of db
+// once it has grown to maxBatch.
+func commitIfFull(db *pebble.DB, batch **pebble.Batch) error {
+	if (*batch).Len() < maxBatch {
+		return nil
+	}
+	if err := (*batch).Commit(pebble.Sync); err != nil {
+		return err
+	}
+	*batch = db.NewBatch()
+	return nil
 }
 
-func filenameKey(key string) []byte {
-	return makeKey(filenamePrefix, key)
+func getValue(db pebble.Reader, key []byte) ([]byte, error) {
+	val, closer, err := db.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+	buf := make([]byte, len(val))
+	copy(buf, val)
+	return buf, nil
 }
 
-func trigramKey(key string) []byte {
-	return makeKey(trigramPrefix, key)
+func repositoryKey(name string) []byte {
+	return []byte(repositoryPrefix + name)
 }
 
-func namehashKey(key string) []byte {
-	return makeKey(namehashPrefix, key)
+// listRepositories returns the names of the repositories recorded
+// in db, in sorted order.
+func listRepositories(db *pebble.DB) ([]string, error) {
+	iter := db.NewIter(&pebble.IterOptions{
+		LowerBound: repositoryKey(""),
+		UpperBound: prefixEnd(repositoryKey("")),
+	})
+	defer iter.Close()
+
+	var repos []string
+	for iter.First(); iter.Valid(); iter.Next() {
+		repos = append(repos, strings.TrimPrefix(string(iter.Key()), repositoryPrefix))
+	}
+	return repos, iter.Error()
 }
@@ -0,0 +1,371 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"math"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/cockroachdb/pebble"
+	"github.com/google/uuid"
+)
+
+// DefaultCompactThreshold is the number of committed segments at which
+// Flush compacts a repository, unless WriterOptions says otherwise.
+const DefaultCompactThreshold = 16
+
+// Compact folds the committed segments of iw's repository into one,
+// dropping docs that are no longer live. It does not block readers.
+func (iw *IndexWriter) Compact() error {
+	_, err := iw.compact()
+	return err
+}
+
+// compact implements Compact, retiring the dropped docs. It returns
+// the number of bytes reclaimed.
+func (iw *IndexWriter) compact() (int64, error) {
+	snap := iw.db.NewSnapshot()
+	defer snap.Close()
+
+	segs, err := iw.ns.segments(snap)
+	if err != nil {
+		return 0, err
+	}
+	if len(segs) == 0 {
+		return 0, nil
+	}
+	keep, forget, err := iw.ns.keptHistory(snap, iw.horizon())
+	if err != nil {
+		return 0, err
+	}
+	live, dead, err := iw.ns.liveDocs(snap, segs, keep)
+	if err != nil {
+		return 0, err
+	}
+	sID, err := uuid.NewV7()
+	if err != nil {
+		return 0, err
+	}
+	segmentID := sID.String()
+
+	// The compacted segment covers the doc IDs of all the segments
+	// it replaces.
+	// It keeps case-folded posting lists only if every one of them
+	// has them; otherwise readers fall back to the case variants of
+	// each trigram, and GC removes the folded lists left behind.
+	merged := &segmentInfo{FirstDoc: math.MaxUint32, Folded: true}
+	end := uint32(0)
+	for _, si := range segs {
+		merged.Folded = merged.Folded && si.Folded
+		if si.Committed > merged.Committed {
+			merged.Committed = si.Committed
+		}
+		if si.FirstDoc < merged.FirstDoc {
+			merged.FirstDoc = si.FirstDoc
+		}
+		if e := si.FirstDoc + si.NumDocs; e > end {
+			end = e
+		}
+	}
+	merged.NumDocs = end - merged.FirstDoc
+
+	// The new segment is recorded before any of its posting lists
+	// are written; until the old ones are deleted, a reader sees the
+	// same IDs in both, which is harmless.
+	batch := iw.db.NewBatch()
+	if err := batch.Set(iw.ns.segmentKey(segmentID), merged.encode(), nil); err != nil {
+		return 0, err
+	}
+
+	families := []string{trigramPrefix, pathListPrefix}
+	if merged.Folded {
+		families = append(families, foldedPrefix)
+	}
+	var (
+		prefix      string
+		trigram     string
+		resultSet   = roaring.New()
+		postingList = roaring.New()
+		nread       = 0
+		nwritten    = 0
+		reclaimed   = int64(0)
+	)
+	// finish writes the folded posting list for trigram. Batches are
+	// only committed between trigrams, never part way through one.
+	finish := func() error {
+		if trigram == "" {
+			return nil
+		}
+		resultSet.And(live)
+		if !resultSet.IsEmpty() {
+			n, err := iw.ns.setList(batch, prefix, trigram, segmentID, resultSet)
+			if err != nil {
+				return err
+			}
+			reclaimed -= int64(n)
+			nwritten++
+		}
+		resultSet.Clear()
+		return commitIfFull(iw.db, &batch)
+	}
+	// compactLists folds every posting list of the family with the
+	// given prefix that belongs to one of segs.
+	compactLists := func() error {
+		iter := snap.NewIter(&pebble.IterOptions{
+			LowerBound: iw.ns.makeKey(prefix, ""),
+			UpperBound: prefixEnd(iw.ns.makeKey(prefix, "")),
+		})
+		defer iter.Close()
+		for iter.First(); iter.Valid(); iter.Next() {
+			tri, seg, err := iw.ns.parseListKey(prefix, iter.Key())
+			if err != nil {
+				return err
+			}
+			if _, ok := segs[seg]; !ok {
+				continue
+			}
+			if tri != trigram {
+				if err := finish(); err != nil {
+					return err
+				}
+				trigram = tri
+			}
+			if _, err := postingList.ReadFrom(bytes.NewReader(iter.Value())); err != nil {
+				return err
+			}
+			resultSet.Or(postingList)
+			postingList.Clear()
+			if err := batch.Delete(iter.Key(), nil); err != nil {
+				return err
+			}
+			if err := batch.Delete(iw.ns.countKey(prefix, tri, seg), nil); err != nil {
+				return err
+			}
+			reclaimed += int64(len(iter.Key()) + len(iter.Value()))
+			nread++
+		}
+		if err := iter.Error(); err != nil {
+			return err
+		}
+		return finish()
+	}
+
+	for _, prefix = range families {
+		trigram = ""
+		if err := compactLists(); err != nil {
+			return 0, err
+		}
+	}
+	for id := range segs {
+		if err := batch.Delete(iw.ns.segmentKey(id), nil); err != nil {
+			return 0, err
+		}
+	}
+	for fileid, digest := range dead {
+		for _, key := range [][]byte{iw.ns.docKey(fileid), iw.ns.digestKey(digest), iw.ns.filenameKey(digest)} {
+			val, err := getValue(snap, key)
+			if err == pebble.ErrNotFound {
+				continue
+			}
+			if err != nil {
+				return 0, err
+			}
+			if err := batch.Delete(key, nil); err != nil {
+				return 0, err
+			}
+			reclaimed += int64(len(key) + len(val))
+		}
+		n, err := iw.ns.deleteMeta(batch, snap, fileid)
+		if err != nil {
+			return 0, err
+		}
+		reclaimed += n
+	}
+	for _, key := range forget {
+		if err := batch.Delete(key, nil); err != nil {
+			return 0, err
+		}
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return 0, err
+	}
+	log.Printf("compacted %d segments (%d posting lists) into %s (%d posting lists, %d live docs, %d retired)",
+		len(segs), nread, segmentID, nwritten, live.GetCardinality(), len(dead))
+	return reclaimed, nil
+}
+
+// horizon returns the time before which replaced versions are retired
+// by compaction, as set by WriterOptions.History.
+func (iw *IndexWriter) horizon() time.Time {
+	if iw.history < 0 {
+		return time.Time{}
+	}
+	return iw.now().Add(-iw.history)
+}
+
+// GC removes content that no live path references, after compacting
+// the repository to rewrite its posting lists without dead IDs.
+// It returns the number of bytes reclaimed.
+func (iw *IndexWriter) GC() (int64, error) {
+	reclaimed, err := iw.compact()
+	if err != nil {
+		return 0, err
+	}
+
+	snap := iw.db.NewSnapshot()
+	defer snap.Close()
+
+	// After compaction, every digest with a filename entry belongs to
+	// a live doc. The docs of segments still being written have
+	// only pending changes so far, and must be kept too.
+	indexed := make(map[string]bool)
+	err = iw.ns.scan(snap, filenamePrefix, func(key, val []byte) error {
+		indexed[string(bytes.TrimPrefix(key, iw.ns.filenameKey("")))] = true
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	pending := map[string]bool{iw.segmentID: true}
+	err = iw.ns.scan(snap, pendingPrefix, func(key, val []byte) error {
+		var pf pendingFile
+		if err := json.Unmarshal(val, &pf); err != nil {
+			return err
+		}
+		if pf.Doc != nil {
+			indexed[pf.State.Digest] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	ids, err := iw.ns.pendingSegments(snap)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		pending[id] = true
+	}
+	segs, err := iw.ns.segments(snap)
+	if err != nil {
+		return 0, err
+	}
+
+	batch := iw.db.NewBatch()
+	sweep := func(lower, upper []byte, unreferenced func(key, val []byte) bool) error {
+		iter := snap.NewIter(&pebble.IterOptions{LowerBound: lower, UpperBound: upper})
+		defer iter.Close()
+		for iter.First(); iter.Valid(); iter.Next() {
+			if !unreferenced(iter.Key(), iter.Value()) {
+				continue
+			}
+			if err := batch.Delete(iter.Key(), nil); err != nil {
+				return err
+			}
+			reclaimed += int64(len(iter.Key()) + len(iter.Value()))
+			if err := commitIfFull(iw.db, &batch); err != nil {
+				return err
+			}
+		}
+		return iter.Error()
+	}
+
+	// Posting lists, case-folded, of paths or neither, left by
+	// segments that were discarded or compacted away, and their counts.
+	for _, prefix := range []string{trigramPrefix, foldedPrefix, pathListPrefix} {
+		err = sweep(iw.ns.makeKey(prefix, ""), prefixEnd(iw.ns.makeKey(prefix, "")), func(key, val []byte) bool {
+			_, seg, err := iw.ns.parseListKey(prefix, key)
+			return err == nil && segs[seg] == nil && !pending[seg]
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	err = sweep(iw.ns.makeKey(countPrefix, ""), prefixEnd(iw.ns.makeKey(countPrefix, "")), func(key, val []byte) bool {
+		_, _, seg, err := iw.ns.parseCountKey(key)
+		return err == nil && segs[seg] == nil && !pending[seg]
+	})
+	if err != nil {
+		return 0, err
+	}
+	// File contents that are no longer indexed.
+	err = sweep(iw.ns.dataKey(""), prefixEnd(iw.ns.dataKey("")), func(key, val []byte) bool {
+		return !indexed[string(bytes.TrimPrefix(key, iw.ns.dataKey("")))]
+	})
+	if err != nil {
+		return 0, err
+	}
+	// Symbols of contents that are no longer indexed.
+	err = sweep(iw.ns.makeKey(symbolPrefix, ""), prefixEnd(iw.ns.makeKey(symbolPrefix, "")), func(key, val []byte) bool {
+		_, digest, err := iw.ns.parseSymbolKey(key)
+		return err == nil && !indexed[digest]
+	})
+	if err != nil {
+		return 0, err
+	}
+	// Paths whose contents were retired.
+	err = sweep(iw.ns.namehashKey(""), prefixEnd(iw.ns.namehashKey("")), func(key, val []byte) bool {
+		return !indexed[string(val)]
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = sweep(iw.ns.makeKey(linkPrefix, ""), prefixEnd(iw.ns.makeKey(linkPrefix, "")), func(key, val []byte) bool {
+		digest, _, err := iw.ns.parseLinkKey(key)
+		return err == nil && !indexed[digest]
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = sweep(iw.ns.pathKey(""), prefixEnd(iw.ns.pathKey("")), func(key, val []byte) bool {
+		var ps pathState
+		return json.Unmarshal(val, &ps) == nil && !indexed[ps.Digest]
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return 0, err
+	}
+	return reclaimed, nil
+}
+
+// liveDocs returns the IDs of the docs in the namespace whose contents
+// are still current or kept, and the digests of the docs in segs that
+// are neither.
+func (ns namespace) liveDocs(db pebble.Reader, segs map[string]*segmentInfo, keep map[string]bool) (*roaring.Bitmap, map[uint32]string, error) {
+	committed := roaring.New()
+	for _, si := range segs {
+		committed.AddRange(uint64(si.FirstDoc), uint64(si.FirstDoc)+uint64(si.NumDocs))
+	}
+
+	iter := db.NewIter(&pebble.IterOptions{
+		LowerBound: ns.docKey(0),
+		UpperBound: prefixEnd(ns.makeKey(docPrefix, "")),
+	})
+	defer iter.Close()
+
+	live := roaring.New()
+	dead := make(map[uint32]string)
+	for iter.First(); iter.Valid(); iter.Next() {
+		fileid, err := ns.parseDocKey(iter.Key())
+		if err != nil {
+			return nil, nil, err
+		}
+		digest := string(iter.Value())
+		current, err := ns.isCurrent(db, digest)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch {
+		case current || keep[digest]:
+			live.Add(fileid)
+		case committed.Contains(fileid):
+			dead[fileid] = digest
+		}
+	}
+	return live, dead, iter.Error()
+}
@@ -0,0 +1,155 @@
+package index
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/google/codesearch/query"
+)
+
+// addFiles indexes files in name order as a single new segment.
+func addFiles(t *testing.T, db *pebble.DB, opts *WriterOptions, files map[string]string) *IndexWriter {
+	iw, err := Create(db, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := iw.Add(name, strings.NewReader(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := iw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return iw
+}
+
+func countKeys(t *testing.T, db *pebble.DB, prefix string) int {
+	iter := db.NewIter(&pebble.IterOptions{
+		LowerBound: []byte(prefix),
+		UpperBound: []byte(prefix + "\xff"),
+	})
+	defer iter.Close()
+	n := 0
+	for iter.First(); iter.Valid(); iter.Next() {
+		n++
+	}
+	return n
+}
+
+func TestCompact(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	noCompact := &WriterOptions{CompactThreshold: -1}
+	addFiles(t, db, noCompact, map[string]string{"a.go": "func alpha() {}\n", "b.go": "func beta() {}\n"})
+	addFiles(t, db, noCompact, map[string]string{"a.go": "func gamma() {}\n"})
+	iw := addFiles(t, db, noCompact, map[string]string{"c.go": "func alphabet() {}\n"})
+
+	if n := countKeys(t, db, "seg:"); n != 3 {
+		t.Fatalf("%d segments before compaction, want 3", n)
+	}
+	if n := countKeys(t, db, "tri:fun:"); n != 3 {
+		t.Fatalf("%d posting lists for %q before compaction, want 3", n, "fun")
+	}
+	if err := iw.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countKeys(t, db, "seg:"); n != 1 {
+		t.Errorf("%d segments after compaction, want 1", n)
+	}
+	if n := countKeys(t, db, "tri:fun:"); n != 1 {
+		t.Errorf("%d posting lists for %q after compaction, want 1", n, "fun")
+	}
+
+	ix, err := Open(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first version of a.go (doc 0) is no longer live.
+	if l, err := ix.PostingList("", tri('f', 'u', 'n')); err != nil || !equalList(l, []uint32{1, 2, 3}) {
+		t.Errorf("PostingList(fun) = %v, %v, want [1 2 3]", l, err)
+	}
+	if l, err := ix.PostingList("", tri('a', 'l', 'p')); err != nil || !equalList(l, []uint32{3}) {
+		t.Errorf("PostingList(alp) = %v, %v, want [3]", l, err)
+	}
+
+	// Reaching the threshold compacts automatically.
+	addFiles(t, db, &WriterOptions{CompactThreshold: 2}, map[string]string{"d.go": "func delta() {}\n"})
+	if n := countKeys(t, db, "seg:"); n != 1 {
+		t.Errorf("%d segments after automatic compaction, want 1", n)
+	}
+	if l, err := ix.PostingList("", tri('f', 'u', 'n')); err != nil || !equalList(l, []uint32{1, 2, 3, 4}) {
+		t.Errorf("PostingList(fun) = %v, %v, want [1 2 3 4]", l, err)
+	}
+}
+
+func TestGC(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	noCompact := &WriterOptions{CompactThreshold: -1}
+	addFiles(t, db, noCompact, map[string]string{"a.go": "func alpha() {}\n", "b.go": "func beta() {}\n"})
+	addFiles(t, db, noCompact, map[string]string{"a.go": "func gamma() {}\n"})
+
+	iw, err := Create(db, noCompact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.Delete("b.go"); err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reclaimed, err := iw.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reclaimed <= 0 {
+		t.Errorf("GC reclaimed %d bytes, want > 0", reclaimed)
+	}
+	// Only the current a.go remains.
+	for _, prefix := range []string{"dat:", "fil:", "doc:", "nam:"} {
+		if n := countKeys(t, db, prefix); n != 1 {
+			t.Errorf("%d %s keys after GC, want 1", n, prefix)
+		}
+	}
+
+	// Re-adding collected contents indexes them again.
+	addFiles(t, db, noCompact, map[string]string{"b.go": "func beta() {}\n"})
+	ix, err := Open(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits, err := ix.PostingQuery(query.RegexpQuery(mustParse(t, `beta`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 {
+		t.Fatalf("PostingQuery(beta) = %v, want 1 hit", hits)
+	}
+	if name, err := ix.Name(hits[0]); err != nil || name != "b.go" {
+		t.Errorf("Name(%v) = %q, %v, want b.go", hits[0], name, err)
+	}
+}
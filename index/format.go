@@ -0,0 +1,624 @@
+package index
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/cockroachdb/pebble"
+	"github.com/google/uuid"
+)
+
+// FormatVersion is the version of the on-disk layout that this package
+// reads and writes; migrations describes each change.
+const FormatVersion = 8
+
+// versionKey holds the format version of the index. Like the
+// repository keys, it is not namespaced.
+func versionKey() []byte {
+	return []byte(versionPrefix)
+}
+
+// A VersionError reports that an index has a format version this
+// package cannot use.
+type VersionError struct {
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	if e.Version > FormatVersion {
+		return fmt.Sprintf("index format version %d is newer than the supported version %d; upgrade codesearch", e.Version, FormatVersion)
+	}
+	return fmt.Sprintf("index format version %d is older than the supported version %d; run cindex -migrate", e.Version, FormatVersion)
+}
+
+// readVersion returns the format version of the index in db, or 0 if
+// the index is empty. Indexes written before the version was recorded
+// are recognized by their keys, and any other db is rejected.
+func readVersion(db pebble.Reader) (int, error) {
+	buf, err := getValue(db, versionKey())
+	if err == nil {
+		v, err := strconv.Atoi(string(buf))
+		if err != nil {
+			return 0, fmt.Errorf("bad format version %q", buf)
+		}
+		return v, nil
+	}
+	if err != pebble.ErrNotFound {
+		return 0, err
+	}
+	iter := db.NewIter(&pebble.IterOptions{
+		LowerBound: repositoryKey(""),
+		UpperBound: prefixEnd(repositoryKey("")),
+	})
+	found := iter.First()
+	if err := iter.Close(); err != nil {
+		return 0, err
+	}
+	if found {
+		return 2, nil
+	}
+	repos, err := legacyRepositories(db)
+	if err != nil {
+		return 0, err
+	}
+	if len(repos) > 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+// legacyPrefixes are the key prefixes of a version 1 index, along with
+// those that an interrupted migrate1 adds.
+var legacyPrefixes = map[string]bool{
+	dataPrefix:     true,
+	filenamePrefix: true,
+	namehashPrefix: true,
+	trigramPrefix:  true,
+	docPrefix:      true,
+	digestPrefix:   true,
+}
+
+// legacyRepositories returns the repositories of a version 1 index in
+// db, in sorted order. Version 1 did not record its repositories, but
+// made each key of the repository name, a prefix and the rest, as
+// namespace does. It returns an error if db has a key of another form.
+func legacyRepositories(db pebble.Reader) ([]string, error) {
+	iter := db.NewIter(&pebble.IterOptions{})
+	defer iter.Close()
+
+	seen := make(map[string]bool)
+	for valid := iter.First(); valid; {
+		key := iter.Key()
+		i := bytes.IndexByte(key, ':') - 3
+		if i < 0 || !legacyPrefixes[string(key[i:i+4])] {
+			return nil, fmt.Errorf("unrecognized key %q in index with no format version", key)
+		}
+		seen[string(key[:i])] = true
+		// Skip the rest of the keys with this repository and prefix.
+		valid = iter.SeekGE(prefixEnd(key[:i+4]))
+	}
+	repos := make([]string, 0, len(seen))
+	for repo := range seen {
+		repos = append(repos, repo)
+	}
+	sort.Strings(repos)
+	return repos, iter.Error()
+}
+
+// checkVersion returns a *VersionError if the index in db is not empty
+// and has a format version other than FormatVersion.
+func checkVersion(db pebble.Reader) error {
+	v, err := readVersion(db)
+	if err != nil {
+		return err
+	}
+	if v != 0 && v != FormatVersion {
+		return &VersionError{Version: v}
+	}
+	return nil
+}
+
+// A migration upgrades an index from one format version to the next.
+// It may commit batches as it goes, but must leave the writes that
+// finish the upgrade to final, which is committed along with the new
+// version. If it is interrupted, running it again must finish the job.
+type migration struct {
+	desc string
+	run  func(db *pebble.DB, final *pebble.Batch) error
+}
+
+// migrations holds the migration from each old format version.
+var migrations = map[int]migration{
+	1: {"number docs and record segments", migrate1},
+	2: {"record doc metadata", migrate2},
+	3: {"record Go symbols", migrate3},
+	4: {"count posting lists", migrate4},
+	5: {"link contents to every path that has them", migrate5},
+	6: {"record the history of each path", migrate6},
+	7: {"index the trigrams of paths", migrate7},
+}
+
+// Migrate upgrades the index in db to FormatVersion in place, one
+// version at a time, logging each step using package log. It returns
+// a *VersionError if the index is newer than FormatVersion.
+// Nothing else may use the index while it is being migrated.
+func Migrate(db *pebble.DB) error {
+	v, err := readVersion(db)
+	if err != nil {
+		return err
+	}
+	if v > FormatVersion {
+		return &VersionError{Version: v}
+	}
+	if v == 0 {
+		v = FormatVersion
+	}
+	for ; v < FormatVersion; v++ {
+		m, ok := migrations[v]
+		if !ok {
+			return fmt.Errorf("no migration from index format version %d", v)
+		}
+		log.Printf("migrating from format version %d to %d: %s", v, v+1, m.desc)
+		final := db.NewBatch()
+		if err := m.run(db, final); err != nil {
+			return fmt.Errorf("migrating from format version %d: %v", v, err)
+		}
+		if err := final.Set(versionKey(), []byte(strconv.Itoa(v+1)), nil); err != nil {
+			return err
+		}
+		if err := final.Commit(pebble.Sync); err != nil {
+			return err
+		}
+	}
+	return db.Set(versionKey(), []byte(strconv.Itoa(v)), pebble.Sync)
+}
+
+// migratedSegment is the segment that migrate1 moves the posting lists
+// of a version 1 index into. It is fixed so that an interrupted
+// migration can tell the lists it has moved from those it has not.
+var migratedSegment = uuid.NewSHA1(uuid.NameSpaceURL, []byte("codesearch:migrate1")).String()
+
+// migrate1 upgrades a version 1 index. In each of its repositories,
+// the docs are given sequential IDs in digest order, recorded under
+// doc: and dig:, and the posting lists of all the old, unrecorded
+// segments are folded into a single committed one that uses the new
+// IDs. The repositories are then recorded.
+func migrate1(db *pebble.DB, final *pebble.Batch) error {
+	repos, err := legacyRepositories(db)
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		if err := migrateRepository1(db, final, namespace(repo)); err != nil {
+			return fmt.Errorf("repository %q: %v", repo, err)
+		}
+		if err := final.Set(repositoryKey(repo), nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateRepository1 does the work of migrate1 for the repository ns.
+func migrateRepository1(db *pebble.DB, final *pebble.Batch, ns namespace) error {
+	batch := db.NewBatch()
+
+	// Version 1 IDs are prefixes of digests, so more than one doc
+	// may have had the same ID. Such IDs map to all of those docs.
+	ids := make(map[uint32][]uint32)
+	ndocs := uint32(0)
+	err := ns.scan(db, filenamePrefix, func(key, val []byte) error {
+		digest := string(bytes.TrimPrefix(key, ns.filenameKey("")))
+		sum, err := hex.DecodeString(digest)
+		if err != nil || len(sum) < 4 {
+			return fmt.Errorf("bad filename key %q", key)
+		}
+		old := bytesToUint32(sum[:4])
+		ids[old] = append(ids[old], ndocs)
+		if err := batch.Set(ns.docKey(ndocs), []byte(digest), nil); err != nil {
+			return err
+		}
+		if err := batch.Set(ns.digestKey(digest), uint32ToBytes(ndocs), nil); err != nil {
+			return err
+		}
+		ndocs++
+		return commitIfFull(db, &batch)
+	})
+	if err != nil {
+		return err
+	}
+
+	var (
+		trigram     string
+		resultSet   = roaring.New()
+		postingList = roaring.New()
+	)
+	// finish writes the migrated list for trigram in the batch that
+	// deletes its old lists, so that each trigram is either wholly
+	// migrated or not at all.
+	finish := func() error {
+		if trigram == "" || resultSet.IsEmpty() {
+			return nil
+		}
+		buf := new(bytes.Buffer)
+		if _, err := resultSet.WriteTo(buf); err != nil {
+			return err
+		}
+		if err := batch.Set(ns.postingKey(trigram, migratedSegment), buf.Bytes(), nil); err != nil {
+			return err
+		}
+		resultSet.Clear()
+		return commitIfFull(db, &batch)
+	}
+	err = ns.scan(db, trigramPrefix, func(key, val []byte) error {
+		tri, seg, err := ns.parsePostingKey(key)
+		if err != nil {
+			return err
+		}
+		if seg == migratedSegment {
+			return nil
+		}
+		if tri != trigram {
+			if err := finish(); err != nil {
+				return err
+			}
+			trigram = tri
+		}
+		postingList.Clear()
+		if _, err := postingList.ReadFrom(bytes.NewReader(val)); err != nil {
+			return fmt.Errorf("bad posting list %q: %v", key, err)
+		}
+		for it := postingList.Iterator(); it.HasNext(); {
+			resultSet.AddMany(ids[it.Next()])
+		}
+		return batch.Delete(key, nil)
+	})
+	if err != nil {
+		return err
+	}
+	if err := finish(); err != nil {
+		return err
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return err
+	}
+
+	si := &segmentInfo{FirstDoc: 0, NumDocs: ndocs}
+	if err := final.Set(ns.segmentKey(migratedSegment), si.encode(), nil); err != nil {
+		return err
+	}
+	return final.Set(ns.nextDocKey(), uint32ToBytes(ndocs), nil)
+}
+
+// migrateDocs calls fn with the ID, digest, name and contents of every
+// doc in every repository of db, committing the batch fn adds to as it
+// grows.
+func migrateDocs(db *pebble.DB, fn func(batch *pebble.Batch, ns namespace, id uint32, digest, name string, data []byte) error) error {
+	repos, err := listRepositories(db)
+	if err != nil {
+		return err
+	}
+	batch := db.NewBatch()
+	for _, repo := range repos {
+		ns := namespace(repo)
+		err := ns.scan(db, docPrefix, func(key, val []byte) error {
+			id, err := ns.parseDocKey(key)
+			if err != nil {
+				return err
+			}
+			digest := string(val)
+			name, err := getValue(db, ns.filenameKey(digest))
+			if err != nil {
+				return fmt.Errorf("name of doc %d: %v", id, err)
+			}
+			stored, err := getValue(db, ns.dataKey(digest))
+			if err != nil {
+				return fmt.Errorf("contents of doc %d: %v", id, err)
+			}
+			data, err := decodeContents(stored)
+			if err != nil {
+				return fmt.Errorf("contents of doc %d: %v", id, err)
+			}
+			if err := fn(batch, ns, id, digest, string(name), data); err != nil {
+				return err
+			}
+			return commitIfFull(db, &batch)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// migrate2 upgrades a version 2 index by recording the metadata of
+// every doc, computed from its stored contents and the name it was
+// indexed under, and widened to cover every path that has its
+// contents. The state of each path records whether its file is
+// generated or vendored.
+func migrate2(db *pebble.DB, final *pebble.Batch) error {
+	paths, err := migratePaths(db)
+	if err != nil {
+		return err
+	}
+	return migrateDocs(db, func(batch *pebble.Batch, ns namespace, id uint32, digest, name string, data []byte) error {
+		m := newMeta(name, data, 0)
+		if ps, ok := paths[ns][digest]; ok {
+			m.widen(ps)
+		}
+		return ns.setMeta(batch, id, m)
+	})
+}
+
+// migratePaths records in the state of every path in every repository
+// of db whether its file is generated or vendored. It returns the
+// states of the paths with each doc's contents, merged into one, by
+// namespace and digest.
+func migratePaths(db *pebble.DB) (map[namespace]map[string]*pathState, error) {
+	repos, err := listRepositories(db)
+	if err != nil {
+		return nil, err
+	}
+	merged := make(map[namespace]map[string]*pathState)
+	batch := db.NewBatch()
+	for _, repo := range repos {
+		ns := namespace(repo)
+		paths := make(map[string]*pathState)
+		merged[ns] = paths
+		err := ns.scan(db, pathPrefix, func(key, val []byte) error {
+			name := string(bytes.TrimPrefix(key, ns.pathKey("")))
+			var ps pathState
+			if err := json.Unmarshal(val, &ps); err != nil {
+				return fmt.Errorf("bad path state for %q: %v", name, err)
+			}
+			stored, err := getValue(db, ns.dataKey(ps.Digest))
+			if err == pebble.ErrNotFound {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("contents of %q: %v", name, err)
+			}
+			data, err := decodeContents(stored)
+			if err != nil {
+				return fmt.Errorf("contents of %q: %v", name, err)
+			}
+			ps.Generated, ps.Vendored = isGenerated(name, data), isVendored(name)
+			buf, err := json.Marshal(ps)
+			if err != nil {
+				return err
+			}
+			if err := batch.Set(key, buf, nil); err != nil {
+				return err
+			}
+			if all, ok := paths[ps.Digest]; ok {
+				all.Generated = all.Generated && ps.Generated
+				all.Vendored = all.Vendored && ps.Vendored
+				if ps.ModTime > all.ModTime {
+					all.ModTime = ps.ModTime
+				}
+			} else {
+				paths[ps.Digest] = &ps
+			}
+			return commitIfFull(db, &batch)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return merged, batch.Commit(pebble.Sync)
+}
+
+// migrate3 upgrades a version 3 index by recording the symbols
+// declared by every Go doc.
+func migrate3(db *pebble.DB, final *pebble.Batch) error {
+	return migrateDocs(db, func(batch *pebble.Batch, ns namespace, id uint32, digest, name string, data []byte) error {
+		if detectLanguage(name, data) != "go" {
+			return nil
+		}
+		return ns.setSymbols(batch, digest, goSymbols(name, data))
+	})
+}
+
+// migrate4 upgrades a version 4 index by recording the number of docs
+// in every posting list, case-folded or not.
+func migrate4(db *pebble.DB, final *pebble.Batch) error {
+	repos, err := listRepositories(db)
+	if err != nil {
+		return err
+	}
+	batch := db.NewBatch()
+	bm := roaring.New()
+	for _, repo := range repos {
+		ns := namespace(repo)
+		for _, prefix := range []string{trigramPrefix, foldedPrefix} {
+			err := ns.scan(db, prefix, func(key, val []byte) error {
+				tri, seg, err := ns.parseListKey(prefix, key)
+				if err != nil {
+					return err
+				}
+				bm.Clear()
+				if _, err := bm.ReadFrom(bytes.NewReader(val)); err != nil {
+					return fmt.Errorf("bad posting list %q: %v", key, err)
+				}
+				if err := batch.Set(ns.countKey(prefix, tri, seg), uint32ToBytes(uint32(bm.GetCardinality())), nil); err != nil {
+					return err
+				}
+				return commitIfFull(db, &batch)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// migrate5 upgrades a version 5 index by linking the contents of every
+// path to it. Paths are known by their path state or, if they have
+// none, as the name their contents were first indexed under.
+func migrate5(db *pebble.DB, final *pebble.Batch) error {
+	repos, err := listRepositories(db)
+	if err != nil {
+		return err
+	}
+	batch := db.NewBatch()
+	link := func(ns namespace, digest, name string) error {
+		current, err := getValue(db, ns.namehashKey(hashString(name)))
+		if err == pebble.ErrNotFound || err == nil && string(current) != digest {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := batch.Set(ns.linkKey(digest, name), nil, nil); err != nil {
+			return err
+		}
+		return commitIfFull(db, &batch)
+	}
+	for _, repo := range repos {
+		ns := namespace(repo)
+		err := ns.scan(db, pathPrefix, func(key, val []byte) error {
+			var ps pathState
+			if err := json.Unmarshal(val, &ps); err != nil {
+				return fmt.Errorf("bad path state %q: %v", key, err)
+			}
+			return link(ns, ps.Digest, string(bytes.TrimPrefix(key, ns.pathKey(""))))
+		})
+		if err != nil {
+			return err
+		}
+		err = ns.scan(db, filenamePrefix, func(key, val []byte) error {
+			return link(ns, string(bytes.TrimPrefix(key, ns.filenameKey(""))), string(val))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// migrate6 upgrades a version 6 index. Each path's history starts with
+// its current contents, recorded as of the migration with no segment;
+// earlier versions were never recorded. Paths with a history already
+// were recorded by an interrupted run.
+func migrate6(db *pebble.DB, final *pebble.Batch) error {
+	repos, err := listRepositories(db)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	batch := db.NewBatch()
+	for _, repo := range repos {
+		ns := namespace(repo)
+		err := ns.scan(db, linkPrefix, func(key, val []byte) error {
+			digest, name, err := ns.parseLinkKey(key)
+			if err != nil {
+				return err
+			}
+			recorded := false
+			err = ns.scan(db, historyPrefix+hashString(name)+":", func(key, val []byte) error {
+				recorded = true
+				return nil
+			})
+			if err != nil || recorded {
+				return err
+			}
+			ps := &pathState{Digest: digest}
+			buf, err := getValue(db, ns.pathKey(name))
+			switch {
+			case err == nil:
+				if err := json.Unmarshal(buf, ps); err != nil {
+					return fmt.Errorf("bad path state for %q: %v", name, err)
+				}
+			case err != pebble.ErrNotFound:
+				return err
+			}
+			if err := ns.record(batch, name, "", now, ps); err != nil {
+				return err
+			}
+			return commitIfFull(db, &batch)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return batch.Commit(pebble.Sync)
+}
+
+// migrate7 upgrades a version 7 index by writing path posting lists
+// for every path and kept version, in the first committed segment.
+func migrate7(db *pebble.DB, final *pebble.Batch) error {
+	repos, err := listRepositories(db)
+	if err != nil {
+		return err
+	}
+	for _, repo := range repos {
+		ns := namespace(repo)
+		segs, err := ns.segments(db)
+		if err != nil {
+			return err
+		}
+		first := ""
+		for id := range segs {
+			if first == "" || id < first {
+				first = id
+			}
+		}
+		if first == "" {
+			continue
+		}
+		lists := make(map[uint32]*roaring.Bitmap)
+		add := func(digest, name string) error {
+			id, ok, err := ns.lookupDoc(db, digest)
+			if err != nil || !ok {
+				return err
+			}
+			for _, t := range fileTrigrams([]byte(name)) {
+				if lists[t] == nil {
+					lists[t] = roaring.New()
+				}
+				lists[t].Add(id)
+			}
+			return nil
+		}
+		err = ns.scan(db, linkPrefix, func(key, val []byte) error {
+			digest, name, err := ns.parseLinkKey(key)
+			if err != nil {
+				return err
+			}
+			return add(digest, name)
+		})
+		if err != nil {
+			return err
+		}
+		err = ns.scanHistory(db, "", func(key []byte, namehash string, t time.Time, e *historyEntry) error {
+			if e.Digest == "" {
+				return nil
+			}
+			return add(e.Digest, e.Name)
+		})
+		if err != nil {
+			return err
+		}
+		batch := db.NewBatch()
+		for t, bm := range lists {
+			if _, err := ns.setList(batch, pathListPrefix, trigramToString(t), first, bm); err != nil {
+				return err
+			}
+			if err := commitIfFull(db, &batch); err != nil {
+				return err
+			}
+		}
+		if err := batch.Commit(pebble.Sync); err != nil {
+			return err
+		}
+	}
+	return nil
+}
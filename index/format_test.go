@@ -0,0 +1,299 @@
+package index
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/cockroachdb/pebble"
+	"github.com/google/codesearch/query"
+)
+
+func TestVersion(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	addFiles(t, db, nil, map[string]string{"a.go": "package a\n"})
+	if v, err := readVersion(db); err != nil || v != FormatVersion {
+		t.Errorf("version after Create = %d, %v, want %d", v, err, FormatVersion)
+	}
+	if _, err := Open(db, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Set(versionKey(), []byte("99"), pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+	var ve *VersionError
+	if _, err := Open(db, nil); !errors.As(err, &ve) || ve.Version != 99 {
+		t.Errorf("Open of version 99 index: %v, want VersionError", err)
+	}
+	if _, err := Create(db, nil); !errors.As(err, &ve) {
+		t.Errorf("Create on version 99 index: %v, want VersionError", err)
+	}
+	if _, err := Check(db, nil); !errors.As(err, &ve) {
+		t.Errorf("Check of version 99 index: %v, want VersionError", err)
+	}
+	if err := Migrate(db); !errors.As(err, &ve) {
+		t.Errorf("Migrate of version 99 index: %v, want VersionError", err)
+	}
+}
+
+// writeVersion1 writes files to db in the version 1 layout of repo,
+// with their posting lists split between two unrecorded segments.
+func writeVersion1(t *testing.T, db *pebble.DB, repo string, files map[string]string) {
+	lists := make(map[string]*roaring.Bitmap)
+	i := 0
+	for name, text := range files {
+		sum := sha256.Sum256([]byte(text))
+		digest := fmt.Sprintf("%x", sum)
+		for key, val := range map[string]string{
+			repo + "fil:" + digest:           name,
+			repo + "dat:" + digest:           text,
+			repo + "nam:" + hashString(name): digest,
+		} {
+			if err := db.Set([]byte(key), []byte(val), pebble.Sync); err != nil {
+				t.Fatal(err)
+			}
+		}
+		seg := []string{"seg-a", "seg-b"}[i%2]
+		i++
+		for _, tri := range fileTrigrams([]byte(text)) {
+			key := repo + "tri:" + trigramToString(tri) + ":" + seg
+			if lists[key] == nil {
+				lists[key] = roaring.New()
+			}
+			lists[key].Add(bytesToUint32(sum[:4]))
+		}
+	}
+	for key, bm := range lists {
+		buf := new(bytes.Buffer)
+		if _, err := bm.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Set([]byte(key), buf.Bytes(), pebble.Sync); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	writeVersion1(t, db, "", map[string]string{
+		"a.go": "package a\nfunc alpha() {}\n",
+		"b.go": "package a\nfunc beta() {}\n",
+		"c.go": "package a\nfunc alphabet() {}\n",
+	})
+	var ve *VersionError
+	if _, err := Open(db, nil); !errors.As(err, &ve) || ve.Version != 1 {
+		t.Fatalf("Open of version 1 index: %v, want VersionError", err)
+	}
+
+	// Run the first migration without finishing it, as if it had
+	// been interrupted, before migrating for real.
+	if err := migrate1(db, db.NewBatch()); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := readVersion(db); err != nil || v != FormatVersion {
+		t.Errorf("version after Migrate = %d, %v, want %d", v, err, FormatVersion)
+	}
+	if err := Migrate(db); err != nil {
+		t.Errorf("Migrate of current index: %v", err)
+	}
+
+	// Each path's history starts with the contents it was migrated
+	// with, recorded once however often migrate6 runs.
+	if err := migrate6(db, db.NewBatch()); err != nil {
+		t.Fatal(err)
+	}
+	if n := countKeys(t, db, historyPrefix); n != 3 {
+		t.Errorf("%d history entries after Migrate, want 3", n)
+	}
+
+	addFiles(t, db, nil, map[string]string{"d.go": "package a\nfunc alphanumeric() {}\n"})
+	for re, want := range map[string][]string{
+		"alpha": {"a.go", "c.go", "d.go"},
+		"beta":  {"b.go"},
+	} {
+		if got := search(t, db, re); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s matches %v, want %v", re, got, want)
+		}
+	}
+
+	// migrate2 records which paths are vendored, leaving the Meta of a
+	// doc with an unvendored copy unvendored.
+	addFiles(t, db, nil, map[string]string{"vendor/a.go": "func alpha() {}\n"})
+	key := namespace("").pathKey("vendor/a.go")
+	buf, err := getValue(db, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ps pathState
+	if err := json.Unmarshal(buf, &ps); err != nil {
+		t.Fatal(err)
+	}
+	ps.Vendored = false
+	if buf, err = json.Marshal(ps); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(key, buf, pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate2(db, db.NewBatch()); err != nil {
+		t.Fatal(err)
+	}
+	ix, err := Open(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &Filter{ExcludeGenerated: true}
+	hits, err := ix.FilteredQuery(query.RegexpQuery(mustParse(t, `alpha\(`)), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, h := range hits {
+		names, err := ix.FilteredNames(h, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, names...)
+	}
+	if want := []string{"a.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("alpha( in files neither generated nor vendored after migrate2 = %v, want %v", got, want)
+	}
+	if buf, err = getValue(db, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(buf, &ps); err != nil || !ps.Vendored {
+		t.Errorf("state of vendor/a.go after migrate2 = %+v, %v, want vendored", ps, err)
+	}
+	problems, err := Check(db, &CheckOptions{Sample: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("after Migrate: %v", p)
+	}
+
+	// The paths of migrated files are indexed too.
+	for re, want := range map[string]int{"alpha": 0, "beta": 1} {
+		hits, err := ix.FilteredQuery(query.RegexpQuery(mustParse(t, re)), &Filter{Path: query.RegexpQuery(mustParse(t, `^b\.go$`))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != want {
+			t.Errorf("%s in paths matching b.go: %d files, want %d", re, len(hits), want)
+		}
+	}
+
+	symbols, err := ix.SymbolSearch("alpha", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, h := range symbols {
+		got = append(got, h.Name)
+	}
+	if want := []string{"alpha", "alphabet", "alphanumeric"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("symbols after Migrate %v, want %v", got, want)
+	}
+}
+
+func TestMigrateRepositories(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The keys of an index written with -repo foo fall between those
+	// of the default repository.
+	writeVersion1(t, db, "foo", map[string]string{
+		"a.go": "package a\nfunc alpha() {}\n",
+		"b.go": "package a\nfunc beta() {}\n",
+	})
+	if v, err := readVersion(db); err != nil || v != 1 {
+		t.Fatalf("version of -repo foo index = %d, %v, want 1", v, err)
+	}
+	writeVersion1(t, db, "", map[string]string{
+		"c.go": "package c\nfunc alphabet() {}\n",
+	})
+	if err := Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	repos, err := listRepositories(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"", "foo"}; !reflect.DeepEqual(repos, want) {
+		t.Errorf("repositories after Migrate = %q, want %q", repos, want)
+	}
+	for _, tt := range []struct {
+		repo, re string
+		want     int
+	}{
+		{"foo", "alpha", 1},
+		{"foo", "beta", 1},
+		{"", "alpha", 1},
+		{"", "beta", 0},
+	} {
+		ix, err := Open(db, &ReaderOptions{Repositories: []string{tt.repo}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits, err := ix.PostingQuery(query.RegexpQuery(mustParse(t, tt.re)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) != tt.want {
+			t.Errorf("%s in repository %q: %d files, want %d", tt.re, tt.repo, len(hits), tt.want)
+		}
+	}
+	problems, err := Check(db, &CheckOptions{Sample: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("after Migrate: %v", p)
+	}
+
+	// A db with no format version and keys of no index is not taken
+	// for an empty one.
+	d2, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d2)
+	db2, err := pebble.Open(d2, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db2.Close()
+	if err := db2.Set([]byte("junk"), nil, pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Create(db2, nil); err == nil {
+		t.Errorf("Create on db with unrecognized keys succeeded")
+	}
+}
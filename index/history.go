@@ -0,0 +1,214 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// A historyEntry records a change to the contents of a path, made by
+// a committed segment. It is stored under the hash of the path and
+// the time the segment was committed, so that a path's entries sort
+// oldest first.
+type historyEntry struct {
+	Name    string `json:"name"`
+	Segment string `json:"segment"`
+	Digest  string `json:"digest,omitempty"` // "" if the path was deleted
+	Size    int64  `json:"size,omitempty"`
+}
+
+// A Version is a version of an indexed file: the contents a segment
+// gave a path, or the path's deletion.
+type Version struct {
+	Repo    string
+	Name    string
+	Time    time.Time // when the segment was committed
+	Segment string    // segment that made the change
+	Digest  string    // SHA-256 of the contents, in hex, or "" if deleted
+	Size    int64     // size of the contents in bytes
+
+	// Indexed reports whether the contents are still in the index, to
+	// be read with Hit. Compaction retires replaced versions unless
+	// the writer keeps them with WriterOptions.History.
+	Indexed bool
+	Hit     Hit
+}
+
+// historyKey returns the key of the change to the path name made at
+// time t.
+func (ns namespace) historyKey(name string, t time.Time) []byte {
+	return ns.makeKey(historyPrefix, fmt.Sprintf("%s:%016x", hashString(name), t.UnixNano()))
+}
+
+// parseHistoryKey splits a key made by historyKey into the hash of its
+// path and its time.
+func (ns namespace) parseHistoryKey(key []byte) (namehash string, t time.Time, err error) {
+	rest := bytes.TrimPrefix(key, ns.makeKey(historyPrefix, ""))
+	i := bytes.IndexByte(rest, ':')
+	if i < 0 {
+		return "", time.Time{}, fmt.Errorf("bad history key %q", key)
+	}
+	nsec, err := strconv.ParseInt(string(rest[i+1:]), 16, 64)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("bad history key %q: %v", key, err)
+	}
+	return string(rest[:i]), time.Unix(0, nsec), nil
+}
+
+// record adds to batch the change that segmentID, committed at t, made
+// to the path name: giving it the contents described by ps, or, if ps
+// is nil, deleting it.
+func (ns namespace) record(batch *pebble.Batch, name, segmentID string, t time.Time, ps *pathState) error {
+	e := historyEntry{Name: name, Segment: segmentID}
+	if ps != nil {
+		e.Digest, e.Size = ps.Digest, ps.Size
+	}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return batch.Set(ns.historyKey(name, t), buf, nil)
+}
+
+// scanHistory calls fn for every change recorded in the namespace:
+// grouped by path, oldest first within each.
+func (ns namespace) scanHistory(db pebble.Reader, prefix string, fn func(key []byte, namehash string, t time.Time, e *historyEntry) error) error {
+	return ns.scan(db, historyPrefix+prefix, func(key, val []byte) error {
+		namehash, t, err := ns.parseHistoryKey(key)
+		if err != nil {
+			return err
+		}
+		var e historyEntry
+		if err := json.Unmarshal(val, &e); err != nil {
+			return fmt.Errorf("bad history entry %q: %v", key, err)
+		}
+		return fn(key, namehash, t, &e)
+	})
+}
+
+// History returns the versions of the file with the given name in each
+// of ix's repositories, oldest first within each. A change that leaves
+// the contents of a file as they were is not recorded.
+func (ix *Index) History(name string) ([]Version, error) {
+	var versions []Version
+	for _, repo := range ix.repos {
+		ns := namespace(repo)
+		err := ns.scanHistory(ix.db, hashString(name)+":", func(key []byte, namehash string, t time.Time, e *historyEntry) error {
+			v := Version{Repo: repo, Name: e.Name, Time: t, Segment: e.Segment, Digest: e.Digest, Size: e.Size}
+			if e.Digest != "" {
+				id, ok, err := ns.lookupDoc(ix.db, e.Digest)
+				if err != nil {
+					return err
+				}
+				if ok {
+					v.Indexed, v.Hit = true, Hit{Repo: repo, FileID: id}
+				}
+			}
+			versions = append(versions, v)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return versions, nil
+}
+
+// pathsAt returns the paths of the namespace as they were at time t,
+// by the digest of their contents then. A path changed more than once
+// by the segment committed at t has its last contents.
+func (ns namespace) pathsAt(db pebble.Reader, t time.Time) (map[string][]string, error) {
+	current := make(map[string]*historyEntry) // by hash of path
+	err := ns.scanHistory(db, "", func(key []byte, namehash string, at time.Time, e *historyEntry) error {
+		if !at.After(t) {
+			current[namehash] = e
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[string][]string)
+	for _, e := range current {
+		if e.Digest != "" {
+			paths[e.Digest] = append(paths[e.Digest], e.Name)
+		}
+	}
+	for _, names := range paths {
+		sort.Strings(names)
+	}
+	return paths, nil
+}
+
+// segmentTime returns the time the segment with the given ID was
+// committed, or false if ns has no such segment or it predates the
+// recording of commit times.
+func (ns namespace) segmentTime(db pebble.Reader, segmentID string) (time.Time, bool, error) {
+	buf, err := getValue(db, ns.segmentKey(segmentID))
+	if err == pebble.ErrNotFound {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	si, err := decodeSegmentInfo(buf)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("bad segment %q: %v", segmentID, err)
+	}
+	if si.Committed == 0 {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(0, si.Committed), true, nil
+}
+
+// keptHistory returns the digests of the versions that compaction
+// keeps, and the keys of the changes it forgets. The current version
+// of every path is kept, and so is every version replaced or deleted
+// at or after horizon; the deletion of a path is forgotten once it is
+// older than horizon.
+func (ns namespace) keptHistory(db pebble.Reader, horizon time.Time) (map[string]bool, [][]byte, error) {
+	keep := make(map[string]bool)
+	var forget [][]byte
+	var (
+		lastHash string
+		lastKey  []byte
+		last     *historyEntry
+		lastTime time.Time
+	)
+	// settle decides the fate of the previous change, now that the
+	// time it was replaced is known: the zero time if it was not.
+	settle := func(replaced time.Time) {
+		if last == nil {
+			return
+		}
+		switch {
+		case last.Digest == "" && replaced.IsZero() && lastTime.Before(horizon):
+			forget = append(forget, lastKey)
+		case replaced.IsZero() || !replaced.Before(horizon):
+			if last.Digest != "" {
+				keep[last.Digest] = true
+			}
+		default:
+			forget = append(forget, lastKey)
+		}
+	}
+	err := ns.scanHistory(db, "", func(key []byte, namehash string, t time.Time, e *historyEntry) error {
+		if namehash == lastHash {
+			settle(t)
+		} else {
+			settle(time.Time{})
+		}
+		lastHash, lastKey, last, lastTime = namehash, append([]byte(nil), key...), e, t
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	settle(time.Time{})
+	return keep, forget, nil
+}
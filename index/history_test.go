@@ -0,0 +1,188 @@
+package index
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/google/codesearch/query"
+)
+
+func TestHistory(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Each commit is an hour after the one before.
+	start := time.Unix(1000, 0)
+	clock := start
+	hour := func(n int) time.Time { return start.Add(time.Duration(n) * time.Hour) }
+	writer := func(opts *WriterOptions) *IndexWriter {
+		iw, err := Create(db, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		iw.now = func() time.Time { return clock }
+		return iw
+	}
+	keep := &WriterOptions{CompactThreshold: -1, History: 2 * time.Hour}
+	commit := func(files map[string]string, deletes ...string) {
+		iw := writer(keep)
+		names := make([]string, 0, len(files))
+		for name := range files {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if err := iw.Add(name, strings.NewReader(files[name])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, name := range deletes {
+			if err := iw.Delete(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := iw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		clock = clock.Add(time.Hour)
+	}
+	commit(map[string]string{"a": "version one\n", "b": "bravo\n"})
+	commit(map[string]string{"a": "version two\n", "b": "bravo\n"})
+	commit(nil, "b")
+	commit(map[string]string{"a": "version three\n"})
+
+	searchAt := func(opts *ReaderOptions, re string) []string {
+		t.Helper()
+		ix, err := Open(db, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits, err := ix.PostingQuery(query.RegexpQuery(mustParse(t, re)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, h := range hits {
+			name, err := ix.Name(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, name)
+		}
+		return names
+	}
+	type search struct {
+		at   time.Time
+		re   string
+		want []string
+	}
+	check := func(when string, searches []search) {
+		t.Helper()
+		for _, s := range searches {
+			if got := searchAt(&ReaderOptions{At: s.at}, s.re); !reflect.DeepEqual(got, s.want) {
+				t.Errorf("%s: search for %q at %v = %q, want %q", when, s.re, s.at, got, s.want)
+			}
+		}
+	}
+	check("before compaction", []search{
+		{hour(0), "version one", []string{"a"}},
+		{hour(0), "version two", nil},
+		{hour(0), "bravo", []string{"b"}},
+		{hour(1).Add(time.Minute), "version", []string{"a"}},
+		{hour(1).Add(time.Minute), "version two", []string{"a"}},
+		{hour(2), "bravo", nil},
+		{time.Time{}, "version", []string{"a"}},
+		{time.Time{}, "version three", []string{"a"}},
+	})
+
+	history := func(name string) []Version {
+		t.Helper()
+		ix, err := Open(db, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions, err := ix.History(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return versions
+	}
+	times := func(versions []Version) []time.Time {
+		var ts []time.Time
+		for _, v := range versions {
+			ts = append(ts, v.Time)
+		}
+		return ts
+	}
+	a := history("a")
+	if got, want := times(a), []time.Time{hour(0), hour(1), hour(3)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("History(a) at %v, want %v", got, want)
+	}
+	for _, v := range a {
+		if !v.Indexed || v.Segment == "" || v.Size == 0 {
+			t.Errorf("History(a) has %+v, want indexed contents from a segment", v)
+		}
+	}
+	b := history("b")
+	if len(b) != 2 || b[1].Digest != "" || b[1].Indexed || b[1].Time != hour(2) {
+		t.Errorf("History(b) = %+v, want its contents and then its deletion at %v", b, hour(2))
+	}
+	if got := searchAt(&ReaderOptions{AtSegment: a[1].Segment}, "version"); !reflect.DeepEqual(got, []string{"a"}) {
+		t.Errorf("search at segment %s = %q, want [a]", a[1].Segment, got)
+	}
+	if _, err := Open(db, &ReaderOptions{AtSegment: "none"}); err == nil {
+		t.Error("Open at unknown segment succeeded")
+	}
+
+	// Compaction at hour 4 keeps what was replaced from hour 2 on:
+	// the second version of a and b, which was deleted then.
+	if _, err := writer(keep).GC(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := times(history("a")), []time.Time{hour(1), hour(3)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("History(a) after GC at %v, want %v", got, want)
+	}
+	if n := len(history("b")); n != 2 {
+		t.Errorf("History(b) after GC has %d versions, want 2", n)
+	}
+	check("after GC", []search{
+		{hour(0), "version", nil},
+		{hour(0), "bravo", []string{"b"}},
+		{hour(1), "version two", []string{"a"}},
+		{time.Time{}, "version", []string{"a"}},
+	})
+	problems, err := Check(db, &CheckOptions{Sample: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("after GC: %v", p)
+	}
+
+	// A writer that keeps no history forgets all but the current
+	// versions.
+	if err := writer(&WriterOptions{CompactThreshold: -1}).Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := times(history("a")), []time.Time{hour(3)}; !reflect.DeepEqual(got, want) {
+		t.Errorf("History(a) after Compact at %v, want %v", got, want)
+	}
+	if b := history("b"); len(b) != 0 {
+		t.Errorf("History(b) after Compact = %+v, want none", b)
+	}
+	check("without history", []search{
+		{hour(1), "version two", nil},
+		{hour(1), "version", nil},
+	})
+}
@@ -0,0 +1,115 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"path"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Limits are the heuristics that decide whether a file is text worth
+// indexing. A file is skipped if it contains invalid UTF-8, if it is
+// longer than MaxFileLen bytes, if it contains a line longer than
+// MaxLineLen bytes, or if it contains more than MaxTextTrigrams
+// distinct trigrams. A zero field means the default.
+type Limits struct {
+	MaxFileLen      int64
+	MaxLineLen      int
+	MaxTextTrigrams int
+}
+
+// DefaultLimits are the limits used for fields left zero.
+var DefaultLimits = Limits{
+	MaxFileLen:      1 << 30,
+	MaxLineLen:      2000,
+	MaxTextTrigrams: 20000,
+}
+
+// A LimitRule sets the limits for the files whose names match Pattern.
+// The pattern is matched, as by path.Match, against the file's base
+// name and against its whole name.
+type LimitRule struct {
+	Pattern string
+	Limits  Limits // zero fields inherit from WriterOptions.Limits
+}
+
+// or returns l with its zero fields taken from d.
+func (l Limits) or(d Limits) Limits {
+	if l.MaxFileLen == 0 {
+		l.MaxFileLen = d.MaxFileLen
+	}
+	if l.MaxLineLen == 0 {
+		l.MaxLineLen = d.MaxLineLen
+	}
+	if l.MaxTextTrigrams == 0 {
+		l.MaxTextTrigrams = d.MaxTextTrigrams
+	}
+	return l
+}
+
+// limitsFor returns the limits for the file name. The last matching
+// rule wins.
+func (iw *IndexWriter) limitsFor(name string) Limits {
+	for i := len(iw.limitRules) - 1; i >= 0; i-- {
+		r := iw.limitRules[i]
+		if ok, _ := path.Match(r.Pattern, path.Base(name)); ok {
+			return r.Limits.or(iw.limits)
+		}
+		if ok, _ := path.Match(r.Pattern, name); ok {
+			return r.Limits.or(iw.limits)
+		}
+	}
+	return iw.limits
+}
+
+// A SkipReason says why a file was not indexed.
+type SkipReason string
+
+const (
+	SkipUnreadable      SkipReason = "unreadable"
+	SkipInvalidUTF8     SkipReason = "invalid UTF-8"
+	SkipTooLong         SkipReason = "too long"
+	SkipLongLines       SkipReason = "long lines"
+	SkipTooManyTrigrams SkipReason = "too many trigrams"
+)
+
+// A SkippedFile is a file that was not indexed.
+type SkippedFile struct {
+	Repo   string     `json:"-"`
+	Name   string     `json:"-"`
+	Reason SkipReason `json:"reason"`
+	Size   int64      `json:"size"`
+}
+
+func (ns namespace) skipKey(name string) []byte {
+	return ns.makeKey(skipPrefix, name)
+}
+
+// Skipped returns the files in ix's repositories that were skipped
+// the last time they were added, in repository and then name order.
+func (ix *Index) Skipped() ([]SkippedFile, error) {
+	var skipped []SkippedFile
+	for _, repo := range ix.repos {
+		ns := namespace(repo)
+		iter := ix.db.NewIter(&pebble.IterOptions{
+			LowerBound: ns.skipKey(""),
+			UpperBound: prefixEnd(ns.skipKey("")),
+		})
+		for iter.First(); iter.Valid(); iter.Next() {
+			sk := SkippedFile{
+				Repo: repo,
+				Name: string(bytes.TrimPrefix(iter.Key(), ns.skipKey(""))),
+			}
+			if err := json.Unmarshal(iter.Value(), &sk); err != nil {
+				iter.Close()
+				return nil, err
+			}
+			skipped = append(skipped, sk)
+		}
+		if err := iter.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return skipped, nil
+}
@@ -0,0 +1,77 @@
+package index
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+)
+
+func TestLimits(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	long := strings.Repeat("x", 3000) + "\n"
+	opts := &WriterOptions{
+		Limits:     Limits{MaxFileLen: 5000},
+		LimitRules: []LimitRule{{Pattern: "*.min.js", Limits: Limits{MaxLineLen: 4000}}},
+	}
+	addFiles(t, db, opts, map[string]string{
+		"app.js":     long,
+		"app.min.js": long,
+		"big.sql":    strings.Repeat("insert;\n", 1000),
+		"bin":        "\x00\xff",
+		"ok.go":      "package ok\n",
+	})
+
+	ix, err := Open(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skipped, err := ix.Skipped()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SkippedFile{
+		{Name: "app.js", Reason: SkipLongLines, Size: 3001},
+		{Name: "big.sql", Reason: SkipTooLong, Size: 8000},
+		{Name: "bin", Reason: SkipInvalidUTF8, Size: 2},
+	}
+	if !reflect.DeepEqual(skipped, want) {
+		t.Errorf("Skipped() = %+v, want %+v", skipped, want)
+	}
+
+	// A file that stops being text leaves the index,
+	// and one that becomes text again is no longer listed as skipped.
+	addFiles(t, db, opts, map[string]string{"ok.go": "\xff", "bin": "package bin\n"})
+	skipped, err = ix.Skipped()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, sk := range skipped {
+		names = append(names, sk.Name)
+	}
+	if want := []string{"app.js", "big.sql", "ok.go"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Skipped() = %v, want %v", names, want)
+	}
+	it := ix.Paths()
+	names = nil
+	for it.Next() {
+		names = append(names, it.Path().Name)
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"app.min.js", "bin"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("Paths() = %v, want %v", names, want)
+	}
+}
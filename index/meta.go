@@ -0,0 +1,486 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/cockroachdb/pebble"
+	"github.com/google/codesearch/query"
+)
+
+// Meta describes an indexed doc. It is computed from the name and
+// contents of the file that first added the doc, and widened by the
+// later files with the same contents: Generated and Vendored hold
+// only while they hold for every such file, and ModTime is the latest
+// of theirs.
+type Meta struct {
+	Language  string    `json:"lang,omitempty"` // "" if not recognized
+	Size      int64     `json:"size"`
+	Lines     int64     `json:"lines"`
+	ModTime   time.Time `json:"mtime"` // zero unless added by AddFile
+	Generated bool      `json:"generated,omitempty"`
+	Vendored  bool      `json:"vendored,omitempty"`
+}
+
+// A Filter restricts a query to docs whose Meta matches, and whose
+// paths may match Path. The zero Filter matches every doc. NewerThan
+// and ExcludeGenerated depend on the path as well as the contents:
+// FilteredNames leaves out the paths of a doc that do not match them.
+type Filter struct {
+	Languages        []string  // if set, only docs in one of these languages
+	MinSize, MaxSize int64     // size bounds in bytes, inclusive; MaxSize 0 means none
+	NewerThan        time.Time // if set, only files modified after this time
+	ExcludeGenerated bool      // leave out generated and vendored files
+
+	// Path, if set, is the query.RegexpQuery of a regexp for the
+	// paths of the docs. The docs are narrowed down to those with a
+	// path that may match it, using the trigrams of their paths; the
+	// caller must still match the regexp against their names.
+	Path *query.Query
+}
+
+func (f *Filter) empty() bool {
+	return f == nil || len(f.Languages) == 0 && f.MinSize <= 0 && f.MaxSize <= 0 &&
+		f.NewerThan.IsZero() && !f.ExcludeGenerated && (f.Path == nil || f.Path.Op == query.QAll)
+}
+
+// Attribute keys index docs by their Meta, so that a Filter can find
+// the docs it matches with a range scan. Each is named by the
+// attribute, its value and the doc ID, with numbers in fixed-width
+// hex so that keys sort by value.
+const (
+	attrLanguage  = "lang"
+	attrSize      = "size"
+	attrModTime   = "mtime"
+	attrGenerated = "gen" // generated or vendored
+)
+
+// metaKey returns the key holding the Meta of doc id.
+func (ns namespace) metaKey(id uint32) []byte {
+	return ns.makeKey(metaPrefix, fmt.Sprintf("%08x", id))
+}
+
+// attrKey returns the key recording that doc id has value for attr.
+func (ns namespace) attrKey(attr, value string, id uint32) []byte {
+	return ns.makeKey(attrPrefix, fmt.Sprintf("%s=%s:%08x", attr, value, id))
+}
+
+// attrValue returns the start of the keys made by attrKey for attr
+// and value.
+func (ns namespace) attrValue(attr, value string) []byte {
+	return ns.makeKey(attrPrefix, attr+"="+value+":")
+}
+
+func hex64(x int64) string {
+	if x < 0 {
+		x = 0
+	}
+	return fmt.Sprintf("%016x", x)
+}
+
+// attrKeys returns the attribute keys of doc id, whose Meta is m.
+func (ns namespace) attrKeys(m *Meta, id uint32) [][]byte {
+	keys := [][]byte{ns.attrKey(attrSize, hex64(m.Size), id)}
+	if m.Language != "" {
+		keys = append(keys, ns.attrKey(attrLanguage, m.Language, id))
+	}
+	if !m.ModTime.IsZero() {
+		keys = append(keys, ns.attrKey(attrModTime, hex64(m.ModTime.UnixNano()), id))
+	}
+	if m.Generated || m.Vendored {
+		keys = append(keys, ns.attrKey(attrGenerated, "", id))
+	}
+	return keys
+}
+
+// setMeta adds the Meta of doc id and its attribute keys to batch.
+func (ns namespace) setMeta(batch *pebble.Batch, id uint32, m *Meta) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := batch.Set(ns.metaKey(id), buf, nil); err != nil {
+		return err
+	}
+	for _, key := range ns.attrKeys(m, id) {
+		if err := batch.Set(key, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteMeta adds the deletion of the Meta of doc id, as read from db,
+// and its attribute keys to batch. It returns the bytes deleted.
+func (ns namespace) deleteMeta(batch *pebble.Batch, db pebble.Reader, id uint32) (int64, error) {
+	buf, err := getValue(db, ns.metaKey(id))
+	if err == pebble.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	key := ns.metaKey(id)
+	deleted := int64(len(key) + len(buf))
+	if err := batch.Delete(key, nil); err != nil {
+		return 0, err
+	}
+	m := &Meta{}
+	if err := json.Unmarshal(buf, m); err != nil {
+		return deleted, fmt.Errorf("bad metadata for doc %d: %v", id, err)
+	}
+	for _, key := range ns.attrKeys(m, id) {
+		if err := batch.Delete(key, nil); err != nil {
+			return 0, err
+		}
+		deleted += int64(len(key))
+	}
+	return deleted, nil
+}
+
+// widen widens m, the Meta of a doc, to cover a path with the doc's
+// contents whose state is ps. It reports whether m changed.
+func (m *Meta) widen(ps *pathState) bool {
+	changed := false
+	if m.Generated && !ps.Generated {
+		m.Generated, changed = false, true
+	}
+	if m.Vendored && !ps.Vendored {
+		m.Vendored, changed = false, true
+	}
+	if ps.ModTime != 0 && (m.ModTime.IsZero() || ps.ModTime > m.ModTime.UnixNano()) {
+		m.ModTime, changed = time.Unix(0, ps.ModTime), true
+	}
+	return changed
+}
+
+// matchPath reports whether a path whose state is ps matches the parts
+// of f that depend on the path.
+func (f *Filter) matchPath(ps *pathState) bool {
+	if f.ExcludeGenerated && (ps.Generated || ps.Vendored) {
+		return false
+	}
+	if !f.NewerThan.IsZero() && (ps.ModTime == 0 || ps.ModTime <= f.NewerThan.UnixNano()) {
+		return false
+	}
+	return true
+}
+
+// Meta returns the Meta of the doc identified by h.
+func (ix *Index) Meta(h Hit) (*Meta, error) {
+	buf, err := getValue(ix.db, namespace(h.Repo).metaKey(h.FileID))
+	if err != nil {
+		return nil, fmt.Errorf("File (metadata) %d not found in index: %v", h.FileID, err)
+	}
+	m := &Meta{}
+	if err := json.Unmarshal(buf, m); err != nil {
+		return nil, fmt.Errorf("bad metadata for doc %d: %v", h.FileID, err)
+	}
+	return m, nil
+}
+
+// FilteredQuery is like PostingQuery, but returns only the docs that
+// match f. The docs are found from their attribute keys before any
+// posting list is read.
+func (ix *Index) FilteredQuery(q *query.Query, f *Filter) ([]Hit, error) {
+	var hits []Hit
+	for _, repo := range ix.repos {
+		pl, err := ix.filteredQuery(repo, q, f)
+		if err != nil {
+			return nil, err
+		}
+		for _, fileid := range pl {
+			hits = append(hits, Hit{Repo: repo, FileID: fileid})
+		}
+	}
+	return hits, nil
+}
+
+// filteredQuery returns the docs in repo that match q and f, reading
+// every posting list through one view.
+func (ix *Index) filteredQuery(repo string, q *query.Query, f *Filter) ([]uint32, error) {
+	v, err := ix.newView(repo)
+	if err != nil {
+		return nil, err
+	}
+	defer v.Close()
+	var restrict *roaring.Bitmap
+	if !f.empty() {
+		if restrict, err = ix.filter(v, f); err != nil {
+			return nil, err
+		}
+		if restrict.IsEmpty() {
+			return nil, nil
+		}
+	}
+	bm, err := ix.postingQuery(v, q, 0, restrict)
+	if err != nil {
+		return nil, err
+	}
+	return ix.merge(repo, bm.ToArray())
+}
+
+// filter returns the docs in view v that match f, which is not empty.
+func (ix *Index) filter(v *view, f *Filter) (*roaring.Bitmap, error) {
+	ns := v.ns
+	var docs *roaring.Bitmap
+	and := func(bm *roaring.Bitmap) {
+		if docs == nil {
+			docs = bm
+		} else {
+			docs.And(bm)
+		}
+	}
+	if len(f.Languages) > 0 {
+		bm := roaring.New()
+		for _, lang := range f.Languages {
+			lower := ns.attrValue(attrLanguage, strings.ToLower(lang))
+			if err := ns.scanAttr(ix.db, bm, lower, prefixEnd(lower)); err != nil {
+				return nil, err
+			}
+		}
+		and(bm)
+	}
+	if f.MinSize > 0 || f.MaxSize > 0 {
+		upper := prefixEnd(ns.makeKey(attrPrefix, attrSize+"="))
+		if f.MaxSize > 0 {
+			upper = prefixEnd(ns.attrValue(attrSize, hex64(f.MaxSize)))
+		}
+		bm := roaring.New()
+		if err := ns.scanAttr(ix.db, bm, ns.attrValue(attrSize, hex64(f.MinSize)), upper); err != nil {
+			return nil, err
+		}
+		and(bm)
+	}
+	if !f.NewerThan.IsZero() {
+		lower := ns.attrValue(attrModTime, hex64(f.NewerThan.UnixNano()+1))
+		bm := roaring.New()
+		if err := ns.scanAttr(ix.db, bm, lower, prefixEnd(ns.makeKey(attrPrefix, attrModTime+"="))); err != nil {
+			return nil, err
+		}
+		and(bm)
+	}
+	if f.ExcludeGenerated {
+		gen := roaring.New()
+		lower := ns.attrValue(attrGenerated, "")
+		if err := ns.scanAttr(ix.db, gen, lower, prefixEnd(lower)); err != nil {
+			return nil, err
+		}
+		if docs == nil {
+			all, err := ix.allIndexedFiles(v.repo)
+			if err != nil {
+				return nil, err
+			}
+			docs = all
+		}
+		docs.AndNot(gen)
+	}
+	if f.Path != nil && f.Path.Op != query.QAll {
+		// Last, so that the path lists are read only for the docs
+		// the other attributes leave.
+		bm, err := ix.postingQuery(v, f.Path, pathTrigram, docs)
+		if err != nil {
+			return nil, err
+		}
+		docs = bm
+	}
+	return docs, nil
+}
+
+// scanAttr adds to bm the docs named by the attribute keys in
+// [lower, upper).
+func (ns namespace) scanAttr(db pebble.Reader, bm *roaring.Bitmap, lower, upper []byte) error {
+	iter := db.NewIter(&pebble.IterOptions{
+		LowerBound: lower,
+		UpperBound: upper,
+	})
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		i := bytes.LastIndexByte(key, ':')
+		if i < 0 {
+			return fmt.Errorf("bad attribute key %q", key)
+		}
+		id, err := strconv.ParseUint(string(key[i+1:]), 16, 32)
+		if err != nil {
+			return fmt.Errorf("bad attribute key %q: %v", key, err)
+		}
+		bm.Add(uint32(id))
+	}
+	return iter.Error()
+}
+
+// newMeta returns the Meta of a doc first added as file name, with the
+// given contents and modification time in nanoseconds (0 if unknown).
+func newMeta(name string, data []byte, modTime int64) *Meta {
+	m := &Meta{
+		Language:  detectLanguage(name, data),
+		Size:      int64(len(data)),
+		Lines:     int64(bytes.Count(data, []byte("\n"))),
+		Generated: isGenerated(name, data),
+		Vendored:  isVendored(name),
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		m.Lines++
+	}
+	if modTime != 0 {
+		m.ModTime = time.Unix(0, modTime)
+	}
+	return m
+}
+
+// languages maps file extensions to language names.
+var languages = map[string]string{
+	".bash":  "shell",
+	".bzl":   "starlark",
+	".c":     "c",
+	".cc":    "c++",
+	".cpp":   "c++",
+	".cs":    "c#",
+	".css":   "css",
+	".cxx":   "c++",
+	".go":    "go",
+	".h":     "c",
+	".hh":    "c++",
+	".hpp":   "c++",
+	".htm":   "html",
+	".html":  "html",
+	".java":  "java",
+	".js":    "javascript",
+	".json":  "json",
+	".jsx":   "javascript",
+	".kt":    "kotlin",
+	".lua":   "lua",
+	".m":     "objective-c",
+	".md":    "markdown",
+	".mjs":   "javascript",
+	".php":   "php",
+	".pl":    "perl",
+	".proto": "protobuf",
+	".py":    "python",
+	".rb":    "ruby",
+	".rs":    "rust",
+	".s":     "assembly",
+	".scala": "scala",
+	".sh":    "shell",
+	".sql":   "sql",
+	".swift": "swift",
+	".tex":   "tex",
+	".toml":  "toml",
+	".ts":    "typescript",
+	".tsx":   "typescript",
+	".txt":   "text",
+	".xml":   "xml",
+	".yaml":  "yaml",
+	".yml":   "yaml",
+	".zsh":   "shell",
+}
+
+// baseLanguages maps file names that have no telling extension to
+// language names.
+var baseLanguages = map[string]string{
+	"BUILD":       "starlark",
+	"BUILD.bazel": "starlark",
+	"Dockerfile":  "dockerfile",
+	"GNUmakefile": "make",
+	"Makefile":    "make",
+	"WORKSPACE":   "starlark",
+	"makefile":    "make",
+}
+
+// interpreters maps the interpreters named in #! lines, without any
+// version suffix, to language names.
+var interpreters = map[string]string{
+	"bash":   "shell",
+	"dash":   "shell",
+	"ksh":    "shell",
+	"node":   "javascript",
+	"nodejs": "javascript",
+	"perl":   "perl",
+	"php":    "php",
+	"python": "python",
+	"ruby":   "ruby",
+	"sh":     "shell",
+	"zsh":    "shell",
+}
+
+// detectLanguage returns the language of a file from its name or,
+// failing that, the interpreter named by its #! line.
+func detectLanguage(name string, data []byte) string {
+	base := filepath.Base(name)
+	if lang, ok := baseLanguages[base]; ok {
+		return lang
+	}
+	if lang, ok := languages[strings.ToLower(filepath.Ext(base))]; ok {
+		return lang
+	}
+	if !bytes.HasPrefix(data, []byte("#!")) {
+		return ""
+	}
+	line := data[2:]
+	if i := bytes.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	args := strings.Fields(string(line))
+	if len(args) == 0 {
+		return ""
+	}
+	interp := path.Base(args[0])
+	if interp == "env" {
+		interp = ""
+		for _, arg := range args[1:] {
+			if !strings.HasPrefix(arg, "-") && !strings.Contains(arg, "=") {
+				interp = arg
+				break
+			}
+		}
+	}
+	return interpreters[strings.TrimRight(interp, "0123456789.")]
+}
+
+// generatedSuffixes are the name suffixes of files that are always
+// generated.
+var generatedSuffixes = []string{".pb.go", "_pb2.py", ".min.css", ".min.js"}
+
+// generatedHead is how far into a file isGenerated looks.
+const generatedHead = 4096
+
+// isGenerated reports whether a file was generated by a tool: its name
+// says so, or a comment near the top of it does, in the form that Go
+// ("Code generated ... DO NOT EDIT.") or Phabricator ("@generated") use.
+func isGenerated(name string, data []byte) bool {
+	for _, suffix := range generatedSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	if len(data) > generatedHead {
+		data = data[:generatedHead]
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if bytes.Contains(line, []byte("@generated")) ||
+			bytes.Contains(line, []byte("Code generated ")) && bytes.Contains(line, []byte("DO NOT EDIT")) {
+			return true
+		}
+	}
+	return false
+}
+
+// isVendored reports whether a file is a copy of third-party code,
+// which is kept in a directory of one of the conventional names.
+func isVendored(name string) bool {
+	for _, elem := range strings.Split(filepath.ToSlash(name), "/") {
+		switch elem {
+		case "vendor", "third_party", "third-party", "node_modules":
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,275 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/google/codesearch/query"
+)
+
+func TestNewMeta(t *testing.T) {
+	for _, tt := range []struct {
+		name, data string
+		want       Meta
+	}{
+		{"a.go", "package a\n", Meta{Language: "go", Size: 10, Lines: 1}},
+		{"x/Makefile", "all:\n\ttrue", Meta{Language: "make", Size: 10, Lines: 2}},
+		{"README", "", Meta{}},
+		{"run", "#!/usr/bin/env python3\nprint()\n", Meta{Language: "python", Size: 31, Lines: 2}},
+		{"run.sh", "#!/usr/bin/python\n", Meta{Language: "shell", Size: 18, Lines: 1}},
+		{"tool", "#!/bin/bash -e\n", Meta{Language: "shell", Size: 15, Lines: 1}},
+		{"tool", "#!/usr/bin/env -S FOO=1 node\n", Meta{Language: "javascript", Size: 29, Lines: 1}},
+		{"a.pb.go", "package a\n", Meta{Language: "go", Size: 10, Lines: 1, Generated: true}},
+		{"a.go", "// Code generated by stringer. DO NOT EDIT.\n", Meta{Language: "go", Size: 44, Lines: 1, Generated: true}},
+		{"A.java", "/* @generated */\n", Meta{Language: "java", Size: 17, Lines: 1, Generated: true}},
+		{"src/vendor/b/b.go", "package b\n", Meta{Language: "go", Size: 10, Lines: 1, Vendored: true}},
+		{"src/vendored/b.go", "package b\n", Meta{Language: "go", Size: 10, Lines: 1}},
+	} {
+		if got := newMeta(tt.name, []byte(tt.data), 0); !reflect.DeepEqual(*got, tt.want) {
+			t.Errorf("newMeta(%q, %q) = %+v, want %+v", tt.name, tt.data, *got, tt.want)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+	src := filepath.Join(d, "src")
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cutoff := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	files := []struct {
+		name, data string
+		mtime      time.Time
+	}{
+		{"old.go", "package old\n", old},
+		{"new.go", "package new // " + strings.Repeat("x", 100) + "\n", time.Now()},
+		{"tool", "#!/bin/sh\necho package\n", time.Now()},
+		{"api.pb.go", "package api\n", time.Now()},
+		{"vendor/dep/dep.go", "package dep\n", old},
+	}
+	for _, f := range files {
+		path := filepath.Join(src, f.name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, f.mtime, f.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := pebble.Open(filepath.Join(d, "index"), &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	iw, err := Create(db, &WriterOptions{Workers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if err := iw.AddFile(filepath.Join(src, f.name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := iw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	ix, err := Open(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits, err := ix.PostingQuery(&query.Query{Op: query.QAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ix.Meta(hits[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Language != "go" || m.Size != 12 || m.Lines != 1 || !m.ModTime.Equal(old) || m.Generated || m.Vendored {
+		t.Errorf("Meta of old.go = %+v", m)
+	}
+
+	for _, tt := range []struct {
+		re     string
+		filter *Filter
+		want   []string
+	}{
+		{"package", nil, []string{"api.pb.go", "dep.go", "new.go", "old.go", "tool"}},
+		{"package", &Filter{Languages: []string{"Go"}}, []string{"api.pb.go", "dep.go", "new.go", "old.go"}},
+		{"package", &Filter{Languages: []string{"shell", "c"}}, []string{"tool"}},
+		{"package", &Filter{Languages: []string{"rust"}}, nil},
+		{"package", &Filter{MinSize: 50}, []string{"new.go"}},
+		{"package", &Filter{MaxSize: 12}, []string{"api.pb.go", "dep.go", "old.go"}},
+		{"package", &Filter{MinSize: 12, MaxSize: 12}, []string{"api.pb.go", "dep.go", "old.go"}},
+		{"package", &Filter{MinSize: 13, MaxSize: 20}, nil},
+		{"package", &Filter{NewerThan: cutoff}, []string{"api.pb.go", "new.go", "tool"}},
+		{"package", &Filter{ExcludeGenerated: true}, []string{"new.go", "old.go", "tool"}},
+		{"package", &Filter{Languages: []string{"go"}, NewerThan: cutoff, ExcludeGenerated: true}, []string{"new.go"}},
+		{"echo", &Filter{Languages: []string{"go"}}, nil},
+	} {
+		hits, err := ix.FilteredQuery(query.RegexpQuery(mustParse(t, tt.re)), tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, h := range hits {
+			name, err := ix.Name(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, filepath.Base(name))
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s with filter %+v matches %v, want %v", tt.re, tt.filter, got, tt.want)
+		}
+	}
+
+	// Once a doc is retired, so is its metadata.
+	if err := os.WriteFile(filepath.Join(src, "old.go"), []byte("package old2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	iw, err = Create(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.AddFile(filepath.Join(src, "old.go")); err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := iw.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countKeys(t, db, metaPrefix); n != len(files) {
+		t.Errorf("%d metadata entries after GC, want %d", n, len(files))
+	}
+	problems, err := Check(db, &CheckOptions{Sample: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("after GC: %v", p)
+	}
+}
+
+func TestFilterCopies(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+	src := filepath.Join(d, "src")
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cutoff := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Each pair of files has the same contents, but only the first of
+	// each is neither generated nor vendored, and only it is new.
+	files := []struct {
+		name, data string
+		mtime      time.Time
+	}{
+		{"lib/lib.go", "package lib\n", time.Now()},
+		{"vendor/lib/lib.go", "package lib\n", old},
+		{"api/api.go", "package api\n", time.Now()},
+		{"api/api.pb.go", "package api\n", old},
+	}
+	for _, f := range files {
+		path := filepath.Join(src, f.name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(f.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, f.mtime, f.mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Whichever copy is indexed first, and whether or not the other is
+	// indexed by the same segment, the filter judges each by its own
+	// path.
+	for _, tt := range []struct {
+		order   []int
+		segment bool // index each file in a segment of its own
+	}{
+		{[]int{0, 1, 2, 3}, false},
+		{[]int{1, 0, 3, 2}, false},
+		{[]int{0, 1, 2, 3}, true},
+		{[]int{1, 0, 3, 2}, true},
+	} {
+		db, err := pebble.Open(filepath.Join(d, "index"), &pebble.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		iw, err := Create(db, &WriterOptions{Workers: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range tt.order {
+			if err := iw.AddFile(filepath.Join(src, files[i].name)); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.segment {
+				continue
+			}
+			if err := iw.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if iw, err = Create(db, &WriterOptions{Workers: 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := iw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		ix, err := Open(db, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range []*Filter{
+			{ExcludeGenerated: true},
+			{NewerThan: cutoff},
+		} {
+			hits, err := ix.FilteredQuery(query.RegexpQuery(mustParse(t, "package")), f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, h := range hits {
+				names, err := ix.FilteredNames(h, f)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, name := range names {
+					got = append(got, strings.TrimPrefix(filepath.ToSlash(name), filepath.ToSlash(src)+"/"))
+				}
+			}
+			sort.Strings(got)
+			if want := []string{"api/api.go", "lib/lib.go"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("order %v, segments %v: filter %+v matches %v, want %v", tt.order, tt.segment, f, got, want)
+			}
+		}
+		problems, err := Check(db, &CheckOptions{Sample: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range problems {
+			t.Errorf("order %v, segments %v: %v", tt.order, tt.segment, p)
+		}
+		db.Close()
+		if err := os.RemoveAll(filepath.Join(d, "index")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package index
+
+import (
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/cockroachdb/pebble"
+)
+
+// pathTrigram marks a trigram as one of a path rather than of contents.
+// Path lists may hold stale docs, so they only narrow the candidates.
+const pathTrigram = 1 << 25
+
+// pathListKey returns the key of the posting list of a path trigram
+// in a segment.
+func (ns namespace) pathListKey(trigram, segmentID string) []byte {
+	return ns.makeKey(pathListPrefix, trigram+":"+segmentID)
+}
+
+// pathPosts returns the docs of the paths given contents by iw's
+// segment, by the trigrams of the paths.
+func (iw *IndexWriter) pathPosts() (map[uint32][]uint32, error) {
+	posts := make(map[uint32][]uint32)
+	for name, pf := range iw.pending {
+		if pf.State == nil {
+			continue
+		}
+		id, ok := iw.pendingDocs[pf.State.Digest]
+		if !ok {
+			var err error
+			if id, ok, err = iw.ns.lookupDoc(iw.db, pf.State.Digest); err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		for _, t := range fileTrigrams([]byte(name)) {
+			posts[t] = append(posts[t], id)
+		}
+	}
+	return posts, nil
+}
+
+// readPathList implements readPostingList for a path trigram. A
+// case-folded trigram has the docs of the lists of all its case
+// variants, since path lists are never case-folded.
+func readPathList(snap *pebble.Snapshot, ns namespace, segs map[string]*segmentInfo, trigram uint32) (*roaring.Bitmap, error) {
+	var lists []*roaring.Bitmap
+	for _, v := range pathVariants(trigram) {
+		var err error
+		lists, err = readLists(snap, segs, ns.pathListKey(trigramToString(v), ""), lists, func(si *segmentInfo) bool {
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return union(lists), nil
+}
+
+// countPathList implements countPostingList for a path trigram.
+func countPathList(snap *pebble.Snapshot, ns namespace, segs map[string]*segmentInfo, trigram uint32) (uint64, error) {
+	n := uint64(0)
+	for _, v := range pathVariants(trigram) {
+		m, err := sumCounts(snap, segs, ns.countKey(pathListPrefix, trigramToString(v), ""), func(si *segmentInfo) bool {
+			return true
+		})
+		if err != nil {
+			return 0, err
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// pathVariants returns the path trigrams whose lists hold the docs of
+// trigram, which is marked with pathTrigram.
+func pathVariants(trigram uint32) []uint32 {
+	trigram &^= pathTrigram
+	if trigram&foldedTrigram == 0 {
+		return []uint32{trigram}
+	}
+	return caseVariants(trigram &^ foldedTrigram)
+}
+
+// sortedTrigrams returns the keys of posts in increasing order.
+func sortedTrigrams(posts map[uint32][]uint32) []uint32 {
+	tris := make([]uint32, 0, len(posts))
+	for t := range posts {
+		tris = append(tris, t)
+	}
+	sort.Slice(tris, func(i, j int) bool { return tris[i] < tris[j] })
+	return tris
+}
@@ -0,0 +1,86 @@
+package index
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/google/codesearch/query"
+)
+
+func TestPathLists(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	noCompact := &WriterOptions{CompactThreshold: -1}
+	addFiles(t, db, noCompact, map[string]string{
+		"src/a.go":      "package a // alpha\n",
+		"src/a_test.go": "package a // alpha test\n",
+		"doc/alpha.txt": "alpha\n",
+	})
+	// A later segment links the contents of doc/alpha.txt to a test.
+	iw := addFiles(t, db, noCompact, map[string]string{"src/copy_test.go": "alpha\n"})
+
+	// candidates returns the names of the docs matching re whose
+	// paths may match path, as narrowed down by the path lists alone.
+	candidates := func(re, path string) []string {
+		t.Helper()
+		ix, err := Open(db, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits, err := ix.FilteredQuery(query.RegexpQuery(mustParse(t, re)), &Filter{Path: query.RegexpQuery(mustParse(t, path))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, h := range hits {
+			names, err := ix.Names(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, names...)
+		}
+		sort.Strings(got)
+		return got
+	}
+	check := func(when string) {
+		t.Helper()
+		for _, tt := range []struct {
+			re, path string
+			want     []string
+		}{
+			{"alpha", `_test\.go$`, []string{"doc/alpha.txt", "src/a_test.go", "src/copy_test.go"}},
+			{"alpha test", `_test\.go$`, []string{"src/a_test.go"}},
+			{"alpha", `^src/a\.go$`, []string{"src/a.go"}},
+			{"alpha", `(?i)DOC/`, []string{"doc/alpha.txt", "src/copy_test.go"}},
+			{"alpha", `\.java$`, nil},
+			{"alpha", `.`, []string{"doc/alpha.txt", "src/a.go", "src/a_test.go", "src/copy_test.go"}},
+		} {
+			if got := candidates(tt.re, tt.path); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s: %q in paths matching %q = %q, want %q", when, tt.re, tt.path, got, tt.want)
+			}
+		}
+	}
+	check("committed")
+
+	if err := iw.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("after Compact")
+	problems, err := Check(db, &CheckOptions{Sample: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("after Compact: %v", p)
+	}
+}
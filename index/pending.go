@@ -0,0 +1,314 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// A pendingFile is a change to a path staged by the segment being
+// written: State indexes it, Skip skips it, and neither deletes it.
+type pendingFile struct {
+	Name    string       `json:"name"`
+	Doc     *uint32      `json:"doc,omitempty"` // set if this segment first indexed the contents
+	State   *pathState   `json:"state,omitempty"`
+	Skip    *SkippedFile `json:"skip,omitempty"`
+	Meta    *Meta        `json:"meta,omitempty"`
+	Symbols []Symbol     `json:"symbols,omitempty"`
+}
+
+// pendingKey returns the key of the n'th change made by a segment.
+// Keys sort in the order the changes were made.
+func (ns namespace) pendingKey(segmentID string, n int) []byte {
+	return ns.makeKey(pendingPrefix, fmt.Sprintf("%s:%08x", segmentID, n))
+}
+
+// pendingRange returns the bounds of the keys of a segment's changes.
+func (ns namespace) pendingRange(segmentID string) (lower, upper []byte) {
+	lower = ns.makeKey(pendingPrefix, segmentID+":")
+	return lower, prefixEnd(lower)
+}
+
+// stage records a change made by iw's segment. The caller holds iw.mu.
+func (iw *IndexWriter) stage(pf *pendingFile) error {
+	buf, err := json.Marshal(pf)
+	if err != nil {
+		return err
+	}
+	if err := iw.db.Set(iw.ns.pendingKey(iw.segmentID, iw.npending), buf, pebble.NoSync); err != nil {
+		return err
+	}
+	iw.npending++
+	iw.note(pf)
+	return nil
+}
+
+// note updates iw's view of the paths its segment has changed.
+func (iw *IndexWriter) note(pf *pendingFile) {
+	iw.pending[pf.Name] = pf
+	if pf.Doc != nil {
+		iw.pendingDocs[pf.State.Digest] = *pf.Doc
+	}
+}
+
+// apply adds the changes pf makes to batch, but for the Meta of its
+// doc. The path had the contents with digest prev, if any, before the
+// change.
+func (ns namespace) apply(batch *pebble.Batch, pf *pendingFile, prev string) error {
+	name := pf.Name
+	if prev != "" && (pf.State == nil || pf.State.Digest != prev) {
+		if err := batch.Delete(ns.linkKey(prev, name), nil); err != nil {
+			return err
+		}
+	}
+	if pf.Doc != nil {
+		digest := pf.State.Digest
+		if err := batch.Set(ns.filenameKey(digest), []byte(name), nil); err != nil {
+			return err
+		}
+		if err := batch.Set(ns.docKey(*pf.Doc), []byte(digest), nil); err != nil {
+			return err
+		}
+		if err := batch.Set(ns.digestKey(digest), uint32ToBytes(*pf.Doc), nil); err != nil {
+			return err
+		}
+		if err := ns.setSymbols(batch, digest, pf.Symbols); err != nil {
+			return err
+		}
+	}
+	if pf.State != nil {
+		buf, err := json.Marshal(pf.State)
+		if err != nil {
+			return err
+		}
+		if err := batch.Set(ns.namehashKey(hashString(name)), []byte(pf.State.Digest), nil); err != nil {
+			return err
+		}
+		if err := batch.Set(ns.linkKey(pf.State.Digest, name), nil, nil); err != nil {
+			return err
+		}
+		if err := batch.Set(ns.pathKey(name), buf, nil); err != nil {
+			return err
+		}
+		return batch.Delete(ns.skipKey(name), nil)
+	}
+	if err := batch.Delete(ns.namehashKey(hashString(name)), nil); err != nil {
+		return err
+	}
+	if err := batch.Delete(ns.pathKey(name), nil); err != nil {
+		return err
+	}
+	if pf.Skip == nil {
+		return batch.Delete(ns.skipKey(name), nil)
+	}
+	buf, err := json.Marshal(pf.Skip)
+	if err != nil {
+		return err
+	}
+	return batch.Set(ns.skipKey(name), buf, nil)
+}
+
+// applyPending adds the changes made by iw's segment to batch,
+// along with the deletion of their records. Those that change the
+// contents of a path are recorded in its history, as made now. The
+// Meta of each doc given to a path is widened to cover the path.
+func (iw *IndexWriter) applyPending(batch *pebble.Batch, now time.Time) error {
+	lower, upper := iw.ns.pendingRange(iw.segmentID)
+	metas := newMetaUpdates(iw.ns, iw.db)
+	digests := make(map[string]string) // of the paths changed so far
+	err := iw.ns.scan(iw.db, pendingPrefix+iw.segmentID+":", func(key, val []byte) error {
+		var pf pendingFile
+		if err := json.Unmarshal(val, &pf); err != nil {
+			return fmt.Errorf("bad pending change %q: %v", key, err)
+		}
+		prev, ok := digests[pf.Name]
+		if !ok {
+			buf, err := getValue(iw.db, iw.ns.namehashKey(hashString(pf.Name)))
+			if err != nil && err != pebble.ErrNotFound {
+				return err
+			}
+			prev = string(buf)
+		}
+		digests[pf.Name] = ""
+		if pf.State != nil {
+			digests[pf.Name] = pf.State.Digest
+		}
+		if digests[pf.Name] != prev {
+			if err := iw.ns.record(batch, pf.Name, iw.segmentID, now, pf.State); err != nil {
+				return err
+			}
+		}
+		if err := metas.add(&pf); err != nil {
+			return err
+		}
+		return iw.ns.apply(batch, &pf, prev)
+	})
+	if err != nil {
+		return err
+	}
+	if err := metas.write(batch); err != nil {
+		return err
+	}
+	return batch.DeleteRange(lower, upper, nil)
+}
+
+// metaUpdates collects the Metas of the docs that a batch of changes
+// adds or widens.
+type metaUpdates struct {
+	ns    namespace
+	db    pebble.Reader
+	metas map[uint32]*Meta
+	added map[uint32]bool   // docs the changes add
+	ids   map[string]uint32 // docs by digest, as found so far
+	dirty map[uint32]bool   // docs whose Meta is to be written
+}
+
+func newMetaUpdates(ns namespace, db pebble.Reader) *metaUpdates {
+	return &metaUpdates{
+		ns:    ns,
+		db:    db,
+		metas: make(map[uint32]*Meta),
+		added: make(map[uint32]bool),
+		ids:   make(map[string]uint32),
+		dirty: make(map[uint32]bool),
+	}
+}
+
+// add notes the Meta of the doc pf adds, if any, and widens the Meta
+// of the doc it gives the path to cover the path.
+func (u *metaUpdates) add(pf *pendingFile) error {
+	if pf.State == nil {
+		return nil
+	}
+	digest := pf.State.Digest
+	if pf.Doc != nil {
+		if pf.Meta == nil {
+			return nil
+		}
+		m := *pf.Meta
+		u.metas[*pf.Doc], u.added[*pf.Doc], u.dirty[*pf.Doc] = &m, true, true
+		u.ids[digest] = *pf.Doc
+		return nil
+	}
+	id, ok := u.ids[digest]
+	if !ok {
+		var err error
+		if id, ok, err = u.ns.lookupDoc(u.db, digest); err != nil || !ok {
+			return err
+		}
+		u.ids[digest] = id
+	}
+	m, ok := u.metas[id]
+	if !ok {
+		buf, err := getValue(u.db, u.ns.metaKey(id))
+		if err == pebble.ErrNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		m = &Meta{}
+		if err := json.Unmarshal(buf, m); err != nil {
+			return fmt.Errorf("bad metadata for doc %d: %v", id, err)
+		}
+		u.metas[id] = m
+	}
+	if m.widen(pf.State) {
+		u.dirty[id] = true
+	}
+	return nil
+}
+
+// write adds the Metas that changed to batch, replacing those in u.db.
+func (u *metaUpdates) write(batch *pebble.Batch) error {
+	for id := range u.dirty {
+		if !u.added[id] {
+			if _, err := u.ns.deleteMeta(batch, u.db, id); err != nil {
+				return err
+			}
+		}
+		if err := u.ns.setMeta(batch, id, u.metas[id]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pendingSegments returns the IDs of the segments in the namespace
+// that have recorded changes but were never committed, oldest first.
+func (ns namespace) pendingSegments(db pebble.Reader) ([]string, error) {
+	prefix := ns.makeKey(pendingPrefix, "")
+	iter := db.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixEnd(prefix),
+	})
+	defer iter.Close()
+
+	var ids []string
+	for valid := iter.First(); valid; {
+		rest := iter.Key()[len(prefix):]
+		i := bytes.IndexByte(rest, ':')
+		if i < 0 {
+			return nil, fmt.Errorf("bad pending change key %q", iter.Key())
+		}
+		id := string(rest[:i])
+		ids = append(ids, id)
+		_, upper := ns.pendingRange(id)
+		valid = iter.SeekGE(upper)
+	}
+	return ids, iter.Error()
+}
+
+// resume makes segmentID, which was interrupted, iw's segment, replaying
+// its changes so that Flush commits them along with iw's own. The
+// posting entries of the docs it added are derived again from their
+// stored contents, which are written before the change that adds them.
+func (iw *IndexWriter) resume(segmentID string) error {
+	iw.segmentID = segmentID
+	err := iw.ns.scan(iw.db, pendingPrefix+segmentID+":", func(key, val []byte) error {
+		pf := &pendingFile{}
+		if err := json.Unmarshal(val, pf); err != nil {
+			return fmt.Errorf("bad pending change %q: %v", key, err)
+		}
+		iw.npending++
+		iw.note(pf)
+		if pf.Doc == nil {
+			return nil
+		}
+		stored, err := getValue(iw.db, iw.ns.dataKey(pf.State.Digest))
+		if err != nil {
+			return fmt.Errorf("resuming %s: contents of %s: %v", segmentID, pf.Name, err)
+		}
+		data, err := decodeContents(stored)
+		if err != nil {
+			return fmt.Errorf("resuming %s: contents of %s: %v", segmentID, pf.Name, err)
+		}
+		if err := iw.addPost(fileTrigrams(data), *pf.Doc); err != nil {
+			return err
+		}
+		if *pf.Doc >= iw.nextDoc {
+			iw.nextDoc = *pf.Doc + 1
+		}
+		iw.filesProcessed++
+		iw.contentBytes += pf.State.Size
+		iw.storedBytes += int64(len(stored))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("resuming segment %s: %d changes, %d docs", segmentID, iw.npending, iw.nextDoc-iw.firstDoc)
+	return nil
+}
+
+// discard deletes the recorded changes of a segment that was
+// interrupted. The contents and posting lists it wrote are left for GC.
+func (ns namespace) discard(db *pebble.DB, segmentID string) error {
+	lower, upper := ns.pendingRange(segmentID)
+	log.Printf("discarding interrupted segment %s", segmentID)
+	return db.DeleteRange(lower, upper, pebble.Sync)
+}
@@ -0,0 +1,260 @@
+package index
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/cockroachdb/pebble"
+	"github.com/google/codesearch/query"
+)
+
+// search returns the names of the files in db whose contents match
+// the regexp re.
+func search(t *testing.T, db *pebble.DB, re string) []string {
+	ix, err := Open(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits, err := ix.PostingQuery(query.RegexpQuery(mustParse(t, re)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, h := range hits {
+		name, err := ix.Name(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// interrupt adds files to a new writer that is abandoned before Flush,
+// as if the process had been killed.
+func interrupt(t *testing.T, db *pebble.DB, files map[string]string) *IndexWriter {
+	iw, err := Create(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := iw.Add(name, strings.NewReader(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Write a posting list, as a mergePost interrupted part way
+	// through would.
+	buf := new(bytes.Buffer)
+	if _, err := roaring.BitmapOf(iw.firstDoc).WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Set(iw.ns.postingKey("bet", iw.segmentID), buf.Bytes(), pebble.Sync); err != nil {
+		t.Fatal(err)
+	}
+	return iw
+}
+
+func TestUncommittedInvisible(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	addFiles(t, db, nil, map[string]string{"a.go": "func alpha() {}\n"})
+	iw := interrupt(t, db, map[string]string{"a.go": "func beta() {}\n", "b.go": "func alpha2() {}\n"})
+	if err := iw.Delete("a.go"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := search(t, db, "alpha"), []string{"a.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("before Flush, alpha matches %v, want %v", got, want)
+	}
+	if got := search(t, db, "beta"); len(got) != 0 {
+		t.Errorf("before Flush, beta matches %v, want none", got)
+	}
+	for _, prefix := range []string{"fil:", "doc:", "nam:", "pth:"} {
+		if n := countKeys(t, db, prefix); n != 1 {
+			t.Errorf("before Flush, %d %s keys, want 1", n, prefix)
+		}
+	}
+
+	if err := iw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := search(t, db, "alpha"), []string{"b.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after Flush, alpha matches %v, want %v", got, want)
+	}
+	if n := countKeys(t, db, "pnd:"); n != 0 {
+		t.Errorf("after Flush, %d pending changes, want 0", n)
+	}
+}
+
+func TestResume(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	addFiles(t, db, nil, map[string]string{"a.go": "func alpha() {}\n"})
+	old := interrupt(t, db, map[string]string{"b.go": "func beta() {}\n", "c.go": "func alpha3() {}\n"})
+
+	iw := addFiles(t, db, &WriterOptions{Resume: true}, map[string]string{"d.go": "func delta() {}\n"})
+	if _, err := getValue(db, iw.ns.segmentKey(old.segmentID)); err != nil {
+		t.Errorf("resumed segment %s not committed: %v", old.segmentID, err)
+	}
+	if st := iw.Stats(); st.FilesIndexed != 3 {
+		t.Errorf("stats %+v, want 3 files indexed", st)
+	}
+	for re, want := range map[string][]string{
+		"alpha": {"a.go", "c.go"},
+		"beta":  {"b.go"},
+		"delta": {"d.go"},
+	} {
+		if got := search(t, db, re); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s matches %v, want %v", re, got, want)
+		}
+	}
+	problems, err := Check(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("after resume: %v", p)
+	}
+}
+
+func TestDiscard(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	interrupt(t, db, map[string]string{"b.go": "func beta() {}\n"})
+	iw := addFiles(t, db, nil, map[string]string{"d.go": "func delta() {}\n"})
+	if got := search(t, db, "beta"); len(got) != 0 {
+		t.Errorf("beta matches %v after discarding its segment, want none", got)
+	}
+	if got, want := search(t, db, "delta"), []string{"d.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("delta matches %v, want %v", got, want)
+	}
+	if _, err := iw.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countKeys(t, db, "dat:"); n != 1 {
+		t.Errorf("%d dat: keys after GC, want 1", n)
+	}
+	problems, err := Check(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("after GC: %v", p)
+	}
+}
+
+func TestPostFilesRemoved(t *testing.T) {
+	tmp, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(tmp)
+	t.Setenv("TMPDIR", tmp)
+	d, _ := os.MkdirTemp("", "test")
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	iw, err := Create(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.go", "b.go"} {
+		if err := iw.Add(name, strings.NewReader("package "+name[:1]+"\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := iw.flushPost(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if entries, _ := os.ReadDir(tmp); len(entries) != 1 {
+		t.Errorf("%d files in temporary directory during indexing, want only the index", len(entries))
+	}
+	if err := iw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(iw.postFile) != 0 {
+		t.Errorf("%d post files open after Flush, want 0", len(iw.postFile))
+	}
+	if got, want := search(t, db, "package"), []string{"a.go", "b.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("package matches %v, want %v", got, want)
+	}
+}
+
+func TestFlushTwice(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Each Flush of the same writer commits a segment of its own.
+	iw, err := Create(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, batch := range []map[string]string{
+		{"a.go": "func alpha() {}\n", "b.go": "func beta() {}\n"},
+		{"c.go": "func alpha2() {}\n", "d.go": "func delta() {}\n"},
+	} {
+		for _, name := range []string{"a.go", "b.go", "c.go", "d.go"} {
+			if text, ok := batch[name]; ok {
+				if err := iw.Add(name, strings.NewReader(text)); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if err := iw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := countKeys(t, db, segmentPrefix); n != 2 {
+		t.Errorf("%d segments after two Flushes, want 2", n)
+	}
+	for re, want := range map[string][]string{
+		"alpha": {"a.go", "c.go"},
+		"beta":  {"b.go"},
+		"delta": {"d.go"},
+	} {
+		if got := search(t, db, re); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s matches %v, want %v", re, got, want)
+		}
+	}
+	problems, err := Check(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("after two Flushes: %v", p)
+	}
+}
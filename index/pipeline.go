@@ -0,0 +1,161 @@
+package index
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+// errClosed is the error from a writer used after Close.
+var errClosed = errors.New("index writer closed")
+
+// A pipeline scans the files queued by AddFile on a pool of workers,
+// each with its own scanner, and commits them on a single goroutine in
+// the order they were queued. Doc IDs and posting lists therefore do
+// not depend on the number of workers.
+type pipeline struct {
+	jobs    chan *scanJob // jobs waiting for a worker
+	results chan *scanJob // all jobs, in queue order
+	workers sync.WaitGroup
+	done    chan struct{} // closed when the committer exits
+
+	mu  sync.Mutex
+	err error // first error scanning or committing a file
+}
+
+// A scanJob is a file queued by AddFile.
+type scanJob struct {
+	name string
+	sf   *scannedFile
+	err  error
+	done chan struct{} // closed when sf or err is set
+}
+
+// queue queues the file name to be scanned and committed,
+// starting the pipeline if it is not running.
+func (iw *IndexWriter) queue(name string) error {
+	iw.pipeMu.Lock()
+	defer iw.pipeMu.Unlock()
+	if iw.closed {
+		return errClosed
+	}
+	if iw.pipe == nil {
+		iw.pipe = iw.startPipeline()
+	}
+	p := iw.pipe
+	if err := p.error(); err != nil {
+		return err
+	}
+	job := &scanJob{name: name, done: make(chan struct{})}
+	p.results <- job
+	p.jobs <- job
+	return nil
+}
+
+// drain waits for the queued files to be committed and stops the
+// pipeline. It returns the first error from a queued file, or
+// errClosed if iw has been closed.
+func (iw *IndexWriter) drain() error {
+	iw.pipeMu.Lock()
+	defer iw.pipeMu.Unlock()
+	if iw.closed {
+		return errClosed
+	}
+	p := iw.pipe
+	if p == nil {
+		return nil
+	}
+	iw.pipe = nil
+	p.stop()
+	return p.error()
+}
+
+// abort stops the pipeline, if it is running, without scanning or
+// committing the files still queued. The caller holds iw.pipeMu.
+func (iw *IndexWriter) abort() {
+	p := iw.pipe
+	if p == nil {
+		return
+	}
+	iw.pipe = nil
+	p.fail(errClosed)
+	p.stop()
+}
+
+// stop waits for the workers and the committer to finish the queued
+// jobs and exit.
+func (p *pipeline) stop() {
+	close(p.jobs)
+	close(p.results)
+	p.workers.Wait()
+	<-p.done
+}
+
+func (iw *IndexWriter) startPipeline() *pipeline {
+	p := &pipeline{
+		jobs:    make(chan *scanJob, iw.workers),
+		results: make(chan *scanJob, 4*iw.workers),
+		done:    make(chan struct{}),
+	}
+	for len(iw.scanners) < iw.workers {
+		iw.scanners = append(iw.scanners, newScanner())
+	}
+	for i := 0; i < iw.workers; i++ {
+		p.workers.Add(1)
+		go func(sc *scanner) {
+			defer p.workers.Done()
+			for job := range p.jobs {
+				if p.error() == nil {
+					job.sf, job.err = iw.scanFile(sc, job.name)
+				}
+				close(job.done)
+			}
+		}(&iw.scanners[i])
+	}
+	go func() {
+		defer close(p.done)
+		for job := range p.results {
+			<-job.done
+			if p.error() != nil {
+				continue
+			}
+			err := job.err
+			if err == nil {
+				err = iw.commit(job.sf)
+			}
+			if err != nil {
+				p.fail(err)
+			}
+		}
+	}()
+	return p
+}
+
+// fail records err as the pipeline's error, unless it already has one.
+func (p *pipeline) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+func (p *pipeline) error() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// scanFile opens and scans the file name.
+func (iw *IndexWriter) scanFile(sc *scanner, name string) (*scannedFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return iw.scan(sc, name, f, info)
+}
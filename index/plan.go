@@ -0,0 +1,114 @@
+package index
+
+import (
+	"log"
+	"sort"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/google/codesearch/query"
+)
+
+// An AND query leaves out a trigram that is in at least
+// universalFraction of the docs once its rarer trigrams have narrowed
+// the candidates to at most selectiveFraction of them: reading the
+// trigram's long posting list would cost more than searching the few
+// candidates it could rule out.
+const (
+	universalFraction = 0.9
+	selectiveFraction = 0.1
+)
+
+// A plannedTrigram is a trigram of an AND query, with the number of
+// docs its posting lists hold.
+type plannedTrigram struct {
+	trigram uint32 // possibly marked with foldedTrigram or pathTrigram
+	count   uint64
+}
+
+// planAnd returns the trigrams of q, a QAnd query, marked with mark,
+// in the order to intersect their posting lists: rarest first, so that
+// the candidates shrink as fast as they can. It also returns the
+// number of docs in the committed segments of v. Only the counts of
+// the lists are read.
+func (ix *Index) planAnd(v *view, q *query.Query, mark uint32) ([]plannedTrigram, uint64, error) {
+	total := uint64(0)
+	for _, si := range v.segs {
+		total += uint64(si.NumDocs)
+	}
+	plan := make([]plannedTrigram, len(q.Trigram))
+	for i, t := range q.Trigram {
+		tri := queryTrigram(q, t, mark)
+		n, err := countPostingList(v.snap, v.ns, v.segs, tri)
+		if err != nil {
+			return nil, 0, err
+		}
+		plan[i] = plannedTrigram{tri, n}
+	}
+	sort.SliceStable(plan, func(i, j int) bool { return plan[i].count < plan[j].count })
+	if ix.Verbose {
+		for _, p := range plan {
+			log.Printf("plan: %q in %d of %d docs", trigramToString(p.trigram&^(foldedTrigram|pathTrigram)), p.count, total)
+		}
+	}
+	return plan, total, nil
+}
+
+// skipTrigram reports whether an AND query can leave out a trigram in
+// count of the total docs, once the trigrams before it have narrowed
+// the candidates to n.
+func skipTrigram(count, total uint64, n int) bool {
+	return float64(count) >= universalFraction*float64(total) && float64(n) <= selectiveFraction*float64(total)
+}
+
+// countPostingList returns the number of docs in the posting lists of
+// segs that postingListBM would merge for trigram. For a case-folded
+// trigram read from the lists of its case variants, this counts a doc
+// once for each variant it contains.
+func countPostingList(snap *pebble.Snapshot, ns namespace, segs map[string]*segmentInfo, trigram uint32) (uint64, error) {
+	if trigram&pathTrigram != 0 {
+		return countPathList(snap, ns, segs, trigram)
+	}
+	if trigram&foldedTrigram == 0 {
+		return sumCounts(snap, segs, ns.countKey(trigramPrefix, trigramToString(trigram), ""), func(si *segmentInfo) bool {
+			return true
+		})
+	}
+	trigram &^= foldedTrigram
+	n, err := sumCounts(snap, segs, ns.countKey(foldedPrefix, trigramToString(trigram), ""), func(si *segmentInfo) bool {
+		return si.Folded
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, v := range caseVariants(trigram) {
+		m, err := sumCounts(snap, segs, ns.countKey(trigramPrefix, trigramToString(v), ""), func(si *segmentInfo) bool {
+			return !si.Folded
+		})
+		if err != nil {
+			return 0, err
+		}
+		n += m
+	}
+	return n, nil
+}
+
+// sumCounts returns the sum of the counts whose keys start with prefix,
+// the key of a count less its segment ID, and that belong to segments
+// in segs for which use returns true.
+func sumCounts(snap *pebble.Snapshot, segs map[string]*segmentInfo, prefix []byte, use func(si *segmentInfo) bool) (uint64, error) {
+	iter := snap.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixEnd(prefix),
+	})
+	defer iter.Close()
+
+	n := uint64(0)
+	for iter.First(); iter.Valid(); iter.Next() {
+		si := segs[string(iter.Key()[len(prefix):])]
+		if si == nil || !use(si) || len(iter.Value()) != 4 {
+			continue
+		}
+		n += uint64(bytesToUint32(iter.Value()))
+	}
+	return n, iter.Error()
+}
@@ -0,0 +1,113 @@
+package index
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+	"github.com/google/codesearch/query"
+)
+
+func TestPlanAnd(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Every file but the last has "the"; only two have "zyx".
+	files := make(map[string]string)
+	for i := 0; i < 19; i++ {
+		files[fmt.Sprintf("f%02d", i)] = fmt.Sprintf("the file %d\n", i)
+	}
+	files["f05"] = "the zyx file\n"
+	files["f19"] = "a zyx file\n"
+	iw := addFiles(t, db, &WriterOptions{CompactThreshold: -1}, map[string]string{"f00": "old contents\n"})
+	addFiles(t, db, &WriterOptions{CompactThreshold: -1}, files)
+
+	ix, err := Open(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	and := func(trigrams ...string) *query.Query {
+		return &query.Query{Op: query.QAnd, Trigram: trigrams}
+	}
+	v, err := ix.newView("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	plan, total, err := ix.planAnd(v, and("the", "fil", "zyx", "qqq"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []plannedTrigram{
+		{tri('q', 'q', 'q'), 0},
+		{tri('z', 'y', 'x'), 2},
+		{tri('t', 'h', 'e'), 19},
+		{tri('f', 'i', 'l'), 20},
+	}
+	if !reflect.DeepEqual(plan, want) || total != 21 {
+		t.Errorf("planAnd = %v, %d, want %v, 21", plan, total, want)
+	}
+
+	names := func(q *query.Query) []string {
+		hits, err := ix.PostingQuery(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, h := range hits {
+			name, err := ix.Name(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, name)
+		}
+		return got
+	}
+	for _, tt := range []struct {
+		q    *query.Query
+		want []string
+	}{
+		{and("the", "fil"), []string{"f00", "f01", "f02", "f03", "f04", "f05", "f06", "f07", "f08", "f09", "f10", "f11", "f12", "f13", "f14", "f15", "f16", "f17", "f18"}},
+		{and("the", "zyx", "qqq"), nil},
+		// "the" and "fil" are left out once "zyx" leaves two
+		// candidates, so f19 is one despite not having "the".
+		{and("the", "fil", "zyx"), []string{"f05", "f19"}},
+		{and("the", "zyx", "a z"), []string{"f19"}},
+	} {
+		if got := names(tt.q); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("PostingQuery(%v) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+
+	// Compaction drops the replaced contents of f00 from the counts.
+	if err := iw.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	// A view taken before it reads the lists that it counted.
+	bm, err := ix.postingListBM(v, tri('o', 'l', 'd'), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := bm.GetCardinality(); n != 1 {
+		t.Errorf("old in %d docs of view before Compact, want 1", n)
+	}
+	if v, err = ix.newView(""); err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+	if plan, _, err = ix.planAnd(v, and("fil", "old"), 0); err != nil {
+		t.Fatal(err)
+	}
+	want = []plannedTrigram{{tri('o', 'l', 'd'), 0}, {tri('f', 'i', 'l'), 20}}
+	if !reflect.DeepEqual(plan, want) {
+		t.Errorf("planAnd after Compact = %v, want %v", plan, want)
+	}
+}
@@ -2,9 +2,11 @@ package index
 
 import (
 	"bytes"
-	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"log"
 	"sort"
+	"time"
 
 	"github.com/RoaringBitmap/roaring"
 	"github.com/cockroachdb/pebble"
@@ -14,15 +16,121 @@ import (
 // An Index implements read-only access to a trigram index.
 type Index struct {
 	db      *pebble.DB
+	repos   []string
+	cache   *PostingCache
 	Verbose bool
+
+	// at is the time the Index reads the files as of, if not zero,
+	// and pathsAt the paths of each repository then, by digest.
+	at      time.Time
+	pathsAt map[string]map[string][]string
+}
+
+// ReaderOptions configures an Index.
+type ReaderOptions struct {
+	// Repositories restricts reads to the named repositories.
+	// If empty, every repository in the index is read.
+	Repositories []string
+
+	// Cache holds the posting lists the Index reads, and may be
+	// shared with other Indexes on the same DB. If nil, the Index
+	// caches them itself, in CacheSize bytes: DefaultCacheSize if
+	// zero, and none at all if negative.
+	Cache     *PostingCache
+	CacheSize int64
+
+	// At, if not zero, makes the Index read the files as they were at
+	// that time: searches find the versions of files current then,
+	// if they are still in the index. AtSegment sets At to the time
+	// the committed segment with the given ID was committed instead.
+	At        time.Time
+	AtSegment string
+}
+
+// A Hit identifies a file in one of the repositories of an Index.
+type Hit struct {
+	Repo   string
+	FileID uint32
+}
+
+// A Path describes an indexed file.
+type Path struct {
+	Repo    string
+	Name    string
+	Digest  string    // SHA-256 of the contents, in hex
+	Size    int64     // size of the contents in bytes
+	ModTime time.Time // zero unless added by AddFile
+	Segment string    // segment holding the contents, or "" if uncommitted
 }
 
 // Open returns a new Index for reading.
-func Open(db *pebble.DB) *Index {
+// A nil opts is equivalent to the zero ReaderOptions.
+func Open(db *pebble.DB, opts *ReaderOptions) (*Index, error) {
 	//printDB(db)
-	return &Index{
-		db: db,
+	if opts == nil {
+		opts = &ReaderOptions{}
+	}
+	if err := checkVersion(db); err != nil {
+		return nil, err
+	}
+	repos := opts.Repositories
+	if len(repos) == 0 {
+		var err error
+		repos, err = listRepositories(db)
+		if err != nil {
+			return nil, err
+		}
+		if len(repos) == 0 {
+			// An empty index has only the default repository.
+			repos = []string{""}
+		}
 	}
+	for _, repo := range repos {
+		if err := validRepository(repo); err != nil {
+			return nil, err
+		}
+	}
+	cache := opts.Cache
+	if cache == nil && opts.CacheSize >= 0 {
+		size := opts.CacheSize
+		if size == 0 {
+			size = DefaultCacheSize
+		}
+		cache = NewPostingCache(size)
+	}
+	ix := &Index{
+		db:    db,
+		repos: repos,
+		cache: cache,
+		at:    opts.At,
+	}
+	if opts.AtSegment != "" {
+		ix.at = time.Time{}
+		for _, repo := range repos {
+			t, ok, err := namespace(repo).segmentTime(db, opts.AtSegment)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				ix.at = t
+				break
+			}
+		}
+		if ix.at.IsZero() {
+			return nil, fmt.Errorf("no commit time recorded for segment %q", opts.AtSegment)
+		}
+	}
+	if !ix.at.IsZero() {
+		ix.pathsAt = make(map[string]map[string][]string)
+		for _, repo := range repos {
+			paths, err := namespace(repo).pathsAt(db, ix.at)
+			if err != nil {
+				return nil, err
+			}
+			ix.pathsAt[repo] = paths
+		}
+	}
+	return ix, nil
 }
 
 func (i *Index) Close() error {
@@ -32,271 +140,600 @@ func (i *Index) Close() error {
 	return nil
 }
 
-// Name returns the name corresponding to the given fileid.
-func (ix *Index) Name(fileid uint32) (string, error) {
-	buf, err := ix.NameBytes(fileid)
+// Repositories returns the names of the repositories read by ix.
+func (ix *Index) Repositories() []string {
+	return ix.repos
+}
+
+// Name returns the name of the file identified by h: the path its
+// contents were first indexed under or, if that path now has other
+// contents, the first of the paths that still have them. An Index
+// reading files as of ReaderOptions.At names the first of the paths
+// that had them then.
+func (ix *Index) Name(h Hit) (string, error) {
+	buf, err := ix.NameBytes(h)
 	if err != nil {
 		return "", err
 	}
 	return string(buf), nil
 }
 
-// NameBytes returns the name corresponding to the given fileid.
-func (ix *Index) NameBytes(fileid uint32) ([]byte, error) {
-	iter := ix.db.NewIter(&pebble.IterOptions{
-		LowerBound: filenameKey(""),
-		UpperBound: filenameKey(string('\xff')),
-	})
-	defer iter.Close()
-
-	filePrefix := filenameKey(fmt.Sprintf("%x", string(uint32ToBytes(fileid))))
-	if !iter.SeekGE(filePrefix) || !bytes.HasPrefix(iter.Key(), filePrefix) {
-		return nil, fmt.Errorf("File (name) %d not found in index (prefix: %q)", fileid, filePrefix)
+// NameBytes returns the name of the file identified by h, as Name does.
+func (ix *Index) NameBytes(h Hit) ([]byte, error) {
+	ns := namespace(h.Repo)
+	digest, err := ix.digest(ns, h.FileID)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := getValue(ix.db, ns.filenameKey(digest))
+	if err != nil {
+		return nil, fmt.Errorf("File (name) %d not found in index (digest: %q): %v", h.FileID, digest, err)
+	}
+	if ix.pathsAt != nil {
+		if names := ix.pathsAt[h.Repo][digest]; len(names) > 0 {
+			return []byte(names[0]), nil
+		}
+		return buf, nil
+	}
+	_, closer, err := ix.db.Get(ns.linkKey(digest, string(buf)))
+	if err == nil {
+		closer.Close()
+		return buf, nil
+	}
+	if err != pebble.ErrNotFound {
+		return nil, err
+	}
+	names, err := ns.paths(ix.db, digest)
+	if err != nil || len(names) == 0 {
+		return buf, err
 	}
-	buf := make([]byte, len(iter.Value()))
-	copy(buf, iter.Value())
-	return buf, nil
+	return []byte(names[0]), nil
 }
 
-func (ix *Index) Contents(fileid uint32) ([]byte, error) {
-	iter := ix.db.NewIter(&pebble.IterOptions{
-		LowerBound: dataKey(""),
-		UpperBound: dataKey(string('\xff')),
-	})
-	defer iter.Close()
+// Names returns every path that has the contents of the file
+// identified by h, in increasing order: more than one if files with
+// the same contents were indexed. It returns none if the contents are
+// no longer current, or, for an Index reading files as of
+// ReaderOptions.At, were not then.
+func (ix *Index) Names(h Hit) ([]string, error) {
+	ns := namespace(h.Repo)
+	digest, err := ix.digest(ns, h.FileID)
+	if err != nil {
+		return nil, err
+	}
+	if ix.pathsAt != nil {
+		return ix.pathsAt[h.Repo][digest], nil
+	}
+	return ns.paths(ix.db, digest)
+}
 
-	filePrefix := dataKey(fmt.Sprintf("%x", string(uint32ToBytes(fileid))))
-	if !iter.SeekGE(filePrefix) || !bytes.HasPrefix(iter.Key(), filePrefix) {
-		return nil, fmt.Errorf("File (data) %d not found in index (prefix: %q)", fileid, filePrefix)
+// FilteredNames is like Names, but returns only the paths that match
+// the parts of f that depend on the path, which FilteredQuery checks
+// only for the doc as a whole. If no path has the contents, it
+// considers the name returned by Name instead.
+func (ix *Index) FilteredNames(h Hit, f *Filter) ([]string, error) {
+	names, err := ix.Names(h)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		name, err := ix.Name(h)
+		if err != nil {
+			return nil, err
+		}
+		names = []string{name}
+	}
+	if f == nil || f.NewerThan.IsZero() && !f.ExcludeGenerated {
+		return names, nil
+	}
+	ns := namespace(h.Repo)
+	digest, err := ix.digest(ns, h.FileID)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		m       *Meta
+		matched []string
+	)
+	for _, name := range names {
+		ps := &pathState{}
+		buf, err := getValue(ix.db, ns.pathKey(name))
+		switch {
+		case err == nil:
+			if err := json.Unmarshal(buf, ps); err != nil {
+				return nil, fmt.Errorf("bad path state for %q: %v", name, err)
+			}
+		case err != pebble.ErrNotFound:
+			return nil, err
+		}
+		if ps.Digest != digest {
+			// The path has other contents now, as when reading
+			// files as of ReaderOptions.At: judge it by its name
+			// and the doc's Meta.
+			if m == nil {
+				if m, err = ix.Meta(h); err != nil {
+					return nil, err
+				}
+			}
+			ps = &pathState{Digest: digest, Generated: m.Generated || isGenerated(name, nil), Vendored: isVendored(name)}
+			if !m.ModTime.IsZero() {
+				ps.ModTime = m.ModTime.UnixNano()
+			}
+		}
+		if f.matchPath(ps) {
+			matched = append(matched, name)
+		}
 	}
-	buf := make([]byte, len(iter.Value()))
-	copy(buf, iter.Value())
-	return buf, nil
+	return matched, nil
 }
 
-// Paths returns the list of indexed paths.
-func (ix *Index) Paths() ([]string, error) {
-	fileIDs, err := ix.allIndexedFiles()
+// Contents returns the contents of the file identified by h.
+func (ix *Index) Contents(h Hit) ([]byte, error) {
+	ns := namespace(h.Repo)
+	digest, err := ix.digest(ns, h.FileID)
 	if err != nil {
 		return nil, err
 	}
+	buf, err := getValue(ix.db, ns.dataKey(digest))
+	if err != nil {
+		return nil, fmt.Errorf("File (data) %d not found in index (digest: %q): %v", h.FileID, digest, err)
+	}
+	return decodeContents(buf)
+}
 
-	names := make([]string, 0, len(fileIDs))
+// digest returns the digest of the contents of doc fileid.
+func (ix *Index) digest(ns namespace, fileid uint32) (string, error) {
+	buf, err := getValue(ix.db, ns.docKey(fileid))
+	if err != nil {
+		return "", fmt.Errorf("File %d not found in index: %v", fileid, err)
+	}
+	return string(buf), nil
+}
 
-	for _, fileID := range fileIDs {
-		name, err := ix.Name(fileID)
+// Roots returns the roots recorded in each of ix's repositories.
+func (ix *Index) Roots() ([]Root, error) {
+	var roots []Root
+	for _, repo := range ix.repos {
+		rs, err := namespace(repo).roots(ix.db)
 		if err != nil {
 			return nil, err
 		}
-		names = append(names, name)
+		roots = append(roots, rs...)
 	}
-	return names, nil
+	return roots, nil
 }
 
-func (ix *Index) allIndexedFiles() ([]uint32, error) {
-	iter := ix.db.NewIter(&pebble.IterOptions{
-		LowerBound: filenameKey(""),
-		UpperBound: filenameKey(string('\xff')),
-	})
-	defer iter.Close()
+// Paths returns an iterator over the indexed paths in each of ix's
+// repositories, in repository and then path order. Only paths whose
+// contents are still in the index are returned.
+// The caller must Close the iterator.
+func (ix *Index) Paths() *PathIter {
+	return &PathIter{ix: ix, repos: ix.repos}
+}
 
-	found := make([]uint32, 0)
-	for iter.First(); iter.Valid(); iter.Next() {
-		digest := bytes.TrimPrefix(iter.Key(), filenameKey(""))
-		hashSum, err := hex.DecodeString(string(digest))
+// A PathIter iterates over indexed paths without loading
+// them all into memory.
+type PathIter struct {
+	ix    *Index
+	repos []string // repositories not yet finished, starting with the current one
+	ns    namespace
+	iter  *pebble.Iterator
+	segs  []segmentRange
+	path  Path
+	err   error
+}
+
+// A segmentRange is the run of doc IDs allocated to a segment.
+type segmentRange struct {
+	id       string
+	firstDoc uint32
+	endDoc   uint32
+}
+
+// Next advances the iterator to the next path,
+// and reports whether there is one.
+func (it *PathIter) Next() bool {
+	for it.err == nil {
+		if it.iter == nil {
+			if len(it.repos) == 0 {
+				return false
+			}
+			if !it.start(namespace(it.repos[0])) {
+				return false
+			}
+		} else {
+			it.iter.Next()
+		}
+		if !it.iter.Valid() {
+			it.err = it.iter.Close()
+			it.iter = nil
+			it.repos = it.repos[1:]
+			continue
+		}
+		var ps pathState
+		if err := json.Unmarshal(it.iter.Value(), &ps); err != nil {
+			it.err = fmt.Errorf("bad path state %q: %v", it.iter.Key(), err)
+			return false
+		}
+		id, ok, err := it.ns.lookupDoc(it.ix.db, ps.Digest)
 		if err != nil {
-			return nil, err
+			it.err = err
+			return false
+		}
+		if !ok {
+			continue
+		}
+		it.path = Path{
+			Repo:    string(it.ns),
+			Name:    string(bytes.TrimPrefix(it.iter.Key(), it.ns.pathKey(""))),
+			Digest:  ps.Digest,
+			Size:    ps.Size,
+			Segment: it.segment(id),
 		}
-		fileid := bytesToUint32(hashSum[:4])
-		found = append(found, fileid)
+		if ps.ModTime != 0 {
+			it.path.ModTime = time.Unix(0, ps.ModTime)
+		}
+		return true
 	}
-	return found, nil
+	return false
+}
+
+// start begins iterating over the paths of ns.
+func (it *PathIter) start(ns namespace) bool {
+	segs, err := ns.segments(it.ix.db)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.segs = it.segs[:0]
+	for id, si := range segs {
+		it.segs = append(it.segs, segmentRange{id, si.FirstDoc, si.FirstDoc + si.NumDocs})
+	}
+	sort.Slice(it.segs, func(i, j int) bool { return it.segs[i].firstDoc < it.segs[j].firstDoc })
+	it.ns = ns
+	it.iter = it.ix.db.NewIter(&pebble.IterOptions{
+		LowerBound: ns.pathKey(""),
+		UpperBound: prefixEnd(ns.pathKey("")),
+	})
+	it.iter.First()
+	return true
+}
+
+// segment returns the ID of the committed segment holding doc fileid.
+func (it *PathIter) segment(fileid uint32) string {
+	i := sort.Search(len(it.segs), func(i int) bool { return it.segs[i].endDoc > fileid })
+	if i < len(it.segs) && it.segs[i].firstDoc <= fileid {
+		return it.segs[i].id
+	}
+	return ""
+}
+
+// Path returns the current path.
+func (it *PathIter) Path() Path {
+	return it.path
+}
+
+// Err returns the first error encountered by the iterator.
+func (it *PathIter) Err() error {
+	return it.err
 }
 
-func (ix *Index) PostingList(trigram uint32) ([]uint32, error) {
-	return ix.postingList(trigram, nil)
+// Close releases the iterator's resources and returns Err.
+func (it *PathIter) Close() error {
+	if it.iter != nil {
+		if err := it.iter.Close(); err != nil && it.err == nil {
+			it.err = err
+		}
+		it.iter = nil
+	}
+	it.repos = nil
+	return it.err
 }
 
-func (ix *Index) postingListBM(trigram uint32, restrict *roaring.Bitmap) (*roaring.Bitmap, error) {
-	triString := trigramToString(trigram)
+func (ix *Index) allIndexedFiles(repo string) (*roaring.Bitmap, error) {
+	ns := namespace(repo)
 	iter := ix.db.NewIter(&pebble.IterOptions{
-		LowerBound: trigramKey(triString),
-		UpperBound: trigramKey(triString + string('\xff')),
+		LowerBound: ns.docKey(0),
+		UpperBound: prefixEnd(ns.makeKey(docPrefix, "")),
 	})
 	defer iter.Close()
 
-	resultSet := roaring.New()
-	postingList := roaring.New()
+	found := roaring.New()
 	for iter.First(); iter.Valid(); iter.Next() {
-		//log.Printf("query %q matched key %q", triString, iter.Key())
-		if _, err := postingList.ReadFrom(bytes.NewReader(iter.Value())); err != nil {
+		fileid, err := ns.parseDocKey(iter.Key())
+		if err != nil {
 			return nil, err
 		}
-		resultSet = roaring.Or(resultSet, postingList)
-		postingList.Clear()
+		found.Add(fileid)
 	}
-	if !restrict.IsEmpty() {
-		resultSet.And(restrict)
-	}
-	return resultSet, nil
+	return found, iter.Error()
 }
 
-func (ix *Index) postingList(trigram uint32, restrict []uint32) ([]uint32, error) {
-	bm, err := ix.postingListBM(trigram, roaring.BitmapOf(restrict...))
+func (ix *Index) PostingList(repo string, trigram uint32) ([]uint32, error) {
+	v, err := ix.newView(repo)
+	if err != nil {
+		return nil, err
+	}
+	defer v.Close()
+	bm, err := ix.postingListBM(v, trigram, nil)
 	if err != nil {
 		return nil, err
 	}
 	return bm.ToArray(), nil
 }
 
-func (ix *Index) PostingAnd(list []uint32, trigram uint32) ([]uint32, error) {
-	return ix.postingAnd(list, trigram, nil)
+// CacheStats reports the use of ix's posting list cache.
+func (ix *Index) CacheStats() CacheStats {
+	return ix.cache.Stats()
+}
+
+// A view reads the committed segments of a repository as of one
+// instant, so that a concurrent compaction cannot hide a segment or
+// its lists from the query that plans with and reads them.
+type view struct {
+	repo string
+	ns   namespace
+	snap *pebble.Snapshot
+	segs map[string]*segmentInfo
+	gen  string // generation(segs)
 }
 
-func (ix *Index) postingAnd(list []uint32, trigram uint32, restrict []uint32) ([]uint32, error) {
-	bm, err := ix.postingListBM(trigram, roaring.BitmapOf(restrict...))
+// newView returns a view of repo as of now. The caller must Close it.
+func (ix *Index) newView(repo string) (*view, error) {
+	ns := namespace(repo)
+	snap := ix.db.NewSnapshot()
+	segs, err := ns.segments(snap)
 	if err != nil {
+		snap.Close()
 		return nil, err
 	}
-	bm.And(roaring.BitmapOf(list...))
-	return bm.ToArray(), nil
+	return &view{repo: repo, ns: ns, snap: snap, segs: segs, gen: generation(segs)}, nil
 }
 
-func (ix *Index) PostingOr(list []uint32, trigram uint32) ([]uint32, error) {
-	return ix.postingOr(list, trigram, nil)
+// Close releases the snapshot of v.
+func (v *view) Close() error {
+	return v.snap.Close()
 }
 
-func (ix *Index) postingOr(list []uint32, trigram uint32, restrict []uint32) ([]uint32, error) {
-	bm, err := ix.postingListBM(trigram, roaring.BitmapOf(restrict...))
-	if err != nil {
-		return nil, err
+// postingListBM returns the docs in v, or in restrict if not nil,
+// whose contents contain trigram. The caller owns the result.
+func (ix *Index) postingListBM(v *view, trigram uint32, restrict *roaring.Bitmap) (*roaring.Bitmap, error) {
+	key := cacheKey{v.repo, trigram}
+	resultSet := ix.cache.get(key, v.gen)
+	if resultSet == nil {
+		var err error
+		if resultSet, err = readPostingList(v.snap, v.ns, v.segs, trigram); err != nil {
+			return nil, err
+		}
+		ix.cache.add(key, v.gen, resultSet)
 	}
-	bm.Or(roaring.BitmapOf(list...))
-	return bm.ToArray(), nil
+	switch {
+	case restrict != nil:
+		return roaring.And(resultSet, restrict), nil
+	case ix.cache != nil:
+		// The cache keeps its own copy.
+		return resultSet.Clone(), nil
+	}
+	return resultSet, nil
 }
 
-func (ix *Index) merge(fileids []uint32) ([]uint32, error) {
-	filenames := make(map[uint32][]byte)
-
-	fnameIter := ix.db.NewIter(&pebble.IterOptions{
-		LowerBound: filenameKey(""),
-		UpperBound: filenameKey(string('\xff')),
+// readPostingList implements postingListBM, reading the lists of segs
+// from snap and merging them all at once.
+func readPostingList(snap *pebble.Snapshot, ns namespace, segs map[string]*segmentInfo, trigram uint32) (*roaring.Bitmap, error) {
+	if trigram&pathTrigram != 0 {
+		return readPathList(snap, ns, segs, trigram)
+	}
+	if trigram&foldedTrigram == 0 {
+		lists, err := readLists(snap, segs, ns.postingKey(trigramToString(trigram), ""), nil, func(si *segmentInfo) bool {
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		return union(lists), nil
+	}
+	trigram &^= foldedTrigram
+	lists, err := readLists(snap, segs, ns.foldedKey(trigramToString(trigram), ""), nil, func(si *segmentInfo) bool {
+		return si.Folded
 	})
-	defer fnameIter.Close()
-	sort.Slice(fileids, func(i, j int) bool { return fileids[i] < fileids[j] })
-	for _, fileid := range fileids {
-		filePrefix := filenameKey(fmt.Sprintf("%x", string(uint32ToBytes(fileid))))
-		if !fnameIter.SeekGE(filePrefix) || !bytes.HasPrefix(fnameIter.Key(), filePrefix) {
-			return nil, fmt.Errorf("File %d not found in index (prefix: %q)", fileid, filePrefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range caseVariants(trigram) {
+		lists, err = readLists(snap, segs, ns.postingKey(trigramToString(v), ""), lists, func(si *segmentInfo) bool {
+			return !si.Folded
+		})
+		if err != nil {
+			return nil, err
 		}
-		buf := make([]byte, len(fnameIter.Value()))
-		copy(buf, fnameIter.Value())
-		filenames[fileid] = buf
 	}
+	return union(lists), nil
+}
+
+// union returns the union of lists, which it may modify.
+func union(lists []*roaring.Bitmap) *roaring.Bitmap {
+	if len(lists) == 1 {
+		return lists[0]
+	}
+	return roaring.FastOr(lists...)
+}
 
-	namehashIter := ix.db.NewIter(&pebble.IterOptions{
-		LowerBound: namehashKey(""),
-		UpperBound: namehashKey(string('\xff')),
+// readLists appends to lists the posting lists whose keys start with
+// prefix, the key of a list less its segment ID, and that belong to
+// segments in segs for which use returns true.
+func readLists(snap *pebble.Snapshot, segs map[string]*segmentInfo, prefix []byte, lists []*roaring.Bitmap, use func(si *segmentInfo) bool) ([]*roaring.Bitmap, error) {
+	iter := snap.NewIter(&pebble.IterOptions{
+		LowerBound: prefix,
+		UpperBound: prefixEnd(prefix),
 	})
-	defer namehashIter.Close()
-	for fileid, name := range filenames {
-		nameHash := namehashKey(hashString(string(name)))
-		if !namehashIter.SeekGE(nameHash) || !bytes.HasPrefix(namehashIter.Key(), nameHash) {
-			// log.Printf("File %d (%q) not found (deleted?)", fileid, name)
-			delete(filenames, fileid)
+	defer iter.Close()
+
+	for iter.First(); iter.Valid(); iter.Next() {
+		si := segs[string(iter.Key()[len(prefix):])]
+		if si == nil || !use(si) {
+			continue
 		}
-		filePrefix := []byte(fmt.Sprintf("%x", uint32ToBytes(fileid)))
-		if !bytes.HasPrefix(namehashIter.Value(), filePrefix) {
-			// log.Printf("File %d (%q) hash updated (%q != %q)", fileid, name, string(namehashIter.Value()), string(uint32ToBytes(fileid)))
-			delete(filenames, fileid)
+		bm := roaring.New()
+		if _, err := bm.ReadFrom(bytes.NewReader(iter.Value())); err != nil {
+			return nil, err
 		}
+		lists = append(lists, bm)
 	}
-	x := fileids
-	fileids = fileids[:0]
-	for _, fileid := range x {
-		if _, ok := filenames[fileid]; ok {
-			fileids = append(fileids, fileid)
-		}
+	return lists, iter.Error()
+}
+
+func (ix *Index) PostingAnd(repo string, list []uint32, trigram uint32) ([]uint32, error) {
+	v, err := ix.newView(repo)
+	if err != nil {
+		return nil, err
 	}
-	return fileids, nil
+	defer v.Close()
+	bm, err := ix.postingListBM(v, trigram, roaring.BitmapOf(list...))
+	if err != nil {
+		return nil, err
+	}
+	return bm.ToArray(), nil
 }
 
-func (ix *Index) PostingQuery(q *query.Query) ([]uint32, error) {
-	pl, err := ix.postingQuery(q, nil)
+func (ix *Index) PostingOr(repo string, list []uint32, trigram uint32) ([]uint32, error) {
+	v, err := ix.newView(repo)
 	if err != nil {
 		return nil, err
 	}
-	return ix.merge(pl)
+	defer v.Close()
+	bm, err := ix.postingListBM(v, trigram, nil)
+	if err != nil {
+		return nil, err
+	}
+	bm.Or(roaring.BitmapOf(list...))
+	return bm.ToArray(), nil
+}
+
+// merge filters fileids down to the docs that are still the current
+// contents of their file: a doc is stale once its name has been
+// re-indexed with different contents. An Index reading files as of
+// ReaderOptions.At keeps the docs that were current then instead.
+func (ix *Index) merge(repo string, fileids []uint32) ([]uint32, error) {
+	ns := namespace(repo)
+	live := fileids[:0]
+	for _, fileid := range fileids {
+		digest, ok, err := ns.lookupDigest(ix.db, fileid)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+		current, err := ix.isCurrent(ns, digest)
+		if err != nil {
+			return nil, err
+		}
+		if !current {
+			continue
+		}
+		live = append(live, fileid)
+	}
+	return live, nil
 }
 
-func (ix *Index) postingQuery(q *query.Query, restrict []uint32) (ret []uint32, err error) {
-	var list []uint32
+// isCurrent reports whether the contents with the given digest are
+// current for ix: now, or at the time it reads the files as of.
+func (ix *Index) isCurrent(ns namespace, digest string) (bool, error) {
+	if ix.pathsAt != nil {
+		return len(ix.pathsAt[string(ns)][digest]) > 0, nil
+	}
+	return ns.isCurrent(ix.db, digest)
+}
+
+// PostingQuery returns the files matching q in each of ix's repositories.
+func (ix *Index) PostingQuery(q *query.Query) ([]Hit, error) {
+	return ix.FilteredQuery(q, nil)
+}
+
+// postingQuery returns the docs in view v whose contents may match q,
+// or, if restrict is not nil, those of them in restrict. If mark is
+// pathTrigram, q is matched against the paths of the docs instead.
+// It works on bitmaps throughout, and does not modify restrict.
+func (ix *Index) postingQuery(v *view, q *query.Query, mark uint32, restrict *roaring.Bitmap) (*roaring.Bitmap, error) {
 	switch q.Op {
-	case query.QNone:
-		// nothing
 	case query.QAll:
 		if restrict != nil {
-			return restrict, err
+			return restrict.Clone(), nil
 		}
-		list, err = ix.allIndexedFiles()
+		return ix.allIndexedFiles(v.repo)
 	case query.QAnd:
-		for _, t := range q.Trigram {
-			tri := uint32(t[0])<<16 | uint32(t[1])<<8 | uint32(t[2])
+		plan, total, err := ix.planAnd(v, q, mark)
+		if err != nil {
+			return nil, err
+		}
+		var list *roaring.Bitmap
+		for i, p := range plan {
+			if p.count == 0 {
+				// No doc has the trigram, so none can match.
+				return roaring.New(), nil
+			}
+			if list != nil && skipTrigram(p.count, total, int(list.GetCardinality())) {
+				// Nor can any that follow, which are commoner.
+				if ix.Verbose {
+					log.Printf("plan: skipping %d near-universal trigrams for %d candidates", len(plan)-i, list.GetCardinality())
+				}
+				break
+			}
 			if list == nil {
-				list, err = ix.postingList(tri, restrict)
+				list, err = ix.postingListBM(v, p.trigram, restrict)
 			} else {
-				list, err = ix.postingAnd(list, tri, restrict)
+				list, err = ix.postingListBM(v, p.trigram, list)
 			}
-			if len(list) == 0 {
+			if err != nil {
 				return nil, err
 			}
+			if list.IsEmpty() {
+				return list, nil
+			}
 		}
 		for _, sub := range q.Sub {
 			if list == nil {
 				list = restrict
 			}
-			list, err = ix.postingQuery(sub, list)
-			if len(list) == 0 {
+			l, err := ix.postingQuery(v, sub, mark, list)
+			if err != nil {
 				return nil, err
 			}
+			if list = l; list.IsEmpty() {
+				return list, nil
+			}
+		}
+		if list == nil {
+			return roaring.New(), nil
 		}
+		return list, nil
 	case query.QOr:
+		lists := make([]*roaring.Bitmap, 0, len(q.Trigram)+len(q.Sub))
 		for _, t := range q.Trigram {
-			tri := uint32(t[0])<<16 | uint32(t[1])<<8 | uint32(t[2])
-			if list == nil {
-				list, err = ix.postingList(tri, restrict)
-			} else {
-				list, err = ix.postingOr(list, tri, restrict)
+			bm, err := ix.postingListBM(v, queryTrigram(q, t, mark), restrict)
+			if err != nil {
+				return nil, err
 			}
+			lists = append(lists, bm)
 		}
 		for _, sub := range q.Sub {
-			l, err := ix.postingQuery(sub, restrict)
+			bm, err := ix.postingQuery(v, sub, mark, restrict)
 			if err != nil {
 				return nil, err
 			}
-			list = mergeOr(list, l)
+			lists = append(lists, bm)
 		}
+		return union(lists), nil
 	}
-	return list, err
+	return roaring.New(), nil
 }
 
-func mergeOr(l1, l2 []uint32) []uint32 {
-	var l []uint32
-	i := 0
-	j := 0
-	for i < len(l1) || j < len(l2) {
-		switch {
-		case j == len(l2) || (i < len(l1) && l1[i] < l2[j]):
-			l = append(l, l1[i])
-			i++
-		case i == len(l1) || (j < len(l2) && l1[i] > l2[j]):
-			l = append(l, l2[j])
-			j++
-		case l1[i] == l2[j]:
-			l = append(l, l1[i])
-			i++
-			j++
-		}
-	}
-	return l
+// queryTrigram returns trigram t of q, marked with mark, and with
+// foldedTrigram if q is case-folded.
+func queryTrigram(q *query.Query, t string, mark uint32) uint32 {
+	tri := uint32(t[0])<<16 | uint32(t[1])<<8 | uint32(t[2]) | mark
+	if q.Folded {
+		tri |= foldedTrigram
+	}
+	return tri
 }
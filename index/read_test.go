@@ -2,14 +2,21 @@ package index
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"os"
+	"reflect"
+	"regexp/syntax"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/RoaringBitmap/roaring"
 	"github.com/cockroachdb/pebble"
+	"github.com/google/codesearch/query"
 )
 
 var postFiles = map[string]string{
@@ -28,46 +35,53 @@ var postFilesIndex = map[string]string{
 	"fil:5617f20f29913a5b34852df9f2a1ffac3f89412715c1b236d5e6e7e49eadbc90": "file1",
 	"fil:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855": "file0",
 	"fil:f35f09cc7c2dae701866c9ba66b7123a28e39d2636abb52ea1b068d67d3e334f": "file2",
+	"doc:00000000": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	"doc:00000001": "5617f20f29913a5b34852df9f2a1ffac3f89412715c1b236d5e6e7e49eadbc90",
+	"doc:00000002": "f35f09cc7c2dae701866c9ba66b7123a28e39d2636abb52ea1b068d67d3e334f",
+	"doc:00000003": "2d633c7d522078e4934efa3086ccea374a5feffd97c03eb5d4bd461701281245",
 	"nam:3377870dfeaaa7adf79a374d2702a3fdb13e5e5ea0dd8aa95a802ad39044a92f": "f35f09cc7c2dae701866c9ba66b7123a28e39d2636abb52ea1b068d67d3e334f",
 	"nam:56f3fd843f7ae959a8409e0ae7c067a0e862a6faa7a22bad147ee90ee5992bd7": "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
 	"nam:6f3fef6dc51c7996a74992b70d0c35f328ed909a5e07646cf0bab3383c95bb02": "2d633c7d522078e4934efa3086ccea374a5feffd97c03eb5d4bd461701281245",
 	"nam:c147efcfc2d7ea666a9e4f5187b115c90903f0fc896a56df9a6ef5d8f3fc9f31": "5617f20f29913a5b34852df9f2a1ffac3f89412715c1b236d5e6e7e49eadbc90",
-	"tri: Co:1":          "[267523926 3423166451]",
-	"tri: Ho:1":          "[3423166451]",
-	"tri: Pr:1":          "[3423166451]",
-	"tri: Se:1":          "[267523926 2101109549]",
-	"tri: We:1":          "[2101109549]",
-	"tri:Cod:1":          "[267523926 3423166451]",
-	"tri:Goo:1":          "[267523926 2101109549 3423166451]",
-	"tri:Hos:1":          "[3423166451]",
-	"tri:Pro:1":          "[3423166451]",
-	"tri:Sea:1":          "[267523926 2101109549]",
-	"tri:Web:1":          "[2101109549]",
-	"tri:arc:1":          "[267523926 2101109549]",
-	"tri:b S:1":          "[2101109549]",
-	"tri:ct :1":          "[3423166451]",
-	"tri:de :1":          "[267523926 3423166451]",
-	"tri:e C:1":          "[267523926 3423166451]",
-	"tri:e P:1":          "[3423166451]",
-	"tri:e S:1":          "[267523926]",
-	"tri:e W:1":          "[2101109549]",
-	"tri:ear:1":          "[267523926 2101109549]",
-	"tri:eb :1":          "[2101109549]",
-	"tri:ect:1":          "[3423166451]",
-	"tri:gle:1":          "[267523926 2101109549 3423166451]",
-	"tri:ing:1":          "[3423166451]",
-	"tri:jec:1":          "[3423166451]",
-	"tri:le :1":          "[267523926 2101109549 3423166451]",
-	"tri:ode:1":          "[267523926 3423166451]",
-	"tri:ogl:1":          "[267523926 2101109549 3423166451]",
-	"tri:oje:1":          "[3423166451]",
-	"tri:oog:1":          "[267523926 2101109549 3423166451]",
-	"tri:ost:1":          "[3423166451]",
-	"tri:rch:1":          "[267523926 2101109549]",
-	"tri:roj:1":          "[3423166451]",
-	"tri:sti:1":          "[3423166451]",
-	"tri:t H:1":          "[3423166451]",
-	"tri:tin:1":          "[3423166451]",
+	"ver:":               "8",
+	"seg:1":              `{"first_doc":0,"num_docs":4}`,
+	"nxt:":               "\x04\x00\x00\x00",
+	"tri: Co:1":          "[1 2]",
+	"tri: Ho:1":          "[2]",
+	"tri: Pr:1":          "[2]",
+	"tri: Se:1":          "[1 3]",
+	"tri: We:1":          "[3]",
+	"tri:Cod:1":          "[1 2]",
+	"tri:Goo:1":          "[1 2 3]",
+	"tri:Hos:1":          "[2]",
+	"tri:Pro:1":          "[2]",
+	"tri:Sea:1":          "[1 3]",
+	"tri:Web:1":          "[3]",
+	"tri:arc:1":          "[1 3]",
+	"tri:b S:1":          "[3]",
+	"tri:ct :1":          "[2]",
+	"tri:de :1":          "[1 2]",
+	"tri:e C:1":          "[1 2]",
+	"tri:e P:1":          "[2]",
+	"tri:e S:1":          "[1]",
+	"tri:e W:1":          "[3]",
+	"tri:ear:1":          "[1 3]",
+	"tri:eb :1":          "[3]",
+	"tri:ect:1":          "[2]",
+	"tri:gle:1":          "[1 2 3]",
+	"tri:ing:1":          "[2]",
+	"tri:jec:1":          "[2]",
+	"tri:le :1":          "[1 2 3]",
+	"tri:ode:1":          "[1 2]",
+	"tri:ogl:1":          "[1 2 3]",
+	"tri:oje:1":          "[2]",
+	"tri:oog:1":          "[1 2 3]",
+	"tri:ost:1":          "[2]",
+	"tri:rch:1":          "[1 3]",
+	"tri:roj:1":          "[2]",
+	"tri:sti:1":          "[2]",
+	"tri:t H:1":          "[2]",
+	"tri:tin:1":          "[2]",
 	"tri:\xff\xff\xff:1": "[]",
 }
 
@@ -125,31 +139,34 @@ func TestTrivialPosting(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ix := Open(db)
-	if l := catchErr(ix.PostingList(tri('S', 'e', 'a'))); !equalList(l, []uint32{267523926, 2101109549}) {
-		t.Errorf("PostingList(Sea) = %v, want [267523926 2101109549]", l)
+	ix, err := Open(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := catchErr(ix.PostingList("", tri('S', 'e', 'a'))); !equalList(l, []uint32{1, 3}) {
+		t.Errorf("PostingList(Sea) = %v, want [1 3]", l)
 	}
-	if l := catchErr(ix.PostingList(tri('G', 'o', 'o'))); !equalList(l, []uint32{267523926, 2101109549, 3423166451}) {
-		t.Errorf("PostingList(Goo) = %v, want [267523926 2101109549 3423166451]", l)
+	if l := catchErr(ix.PostingList("", tri('G', 'o', 'o'))); !equalList(l, []uint32{1, 2, 3}) {
+		t.Errorf("PostingList(Goo) = %v, want [1 2 3]", l)
 	}
 
-	sea := catchErr(ix.PostingList(tri('S', 'e', 'a')))
-	if l := catchErr(ix.PostingAnd(sea, tri('G', 'o', 'o'))); !equalList(l, []uint32{267523926, 2101109549}) {
-		t.Errorf("PostingList(Sea&Goo) = %v, want [267523926 2101109549]", l)
+	sea := catchErr(ix.PostingList("", tri('S', 'e', 'a')))
+	if l := catchErr(ix.PostingAnd("", sea, tri('G', 'o', 'o'))); !equalList(l, []uint32{1, 3}) {
+		t.Errorf("PostingList(Sea&Goo) = %v, want [1 3]", l)
 	}
 
-	goo := catchErr(ix.PostingList(tri('G', 'o', 'o')))
-	if l := catchErr(ix.PostingAnd(goo, tri('S', 'e', 'a'))); !equalList(l, []uint32{267523926, 2101109549}) {
-		t.Errorf("PostingList(Goo&Sea) = %v, want [267523926 2101109549]", l)
+	goo := catchErr(ix.PostingList("", tri('G', 'o', 'o')))
+	if l := catchErr(ix.PostingAnd("", goo, tri('S', 'e', 'a'))); !equalList(l, []uint32{1, 3}) {
+		t.Errorf("PostingList(Goo&Sea) = %v, want [1 3]", l)
 	}
 
-	sea = catchErr(ix.PostingList(tri('S', 'e', 'a')))
-	if l := catchErr(ix.PostingOr(sea, tri('G', 'o', 'o'))); !equalList(l, []uint32{267523926, 2101109549, 3423166451}) {
-		t.Errorf("PostingList(Sea|Goo) = %v, want [267523926 2101109549 3423166451]", l)
+	sea = catchErr(ix.PostingList("", tri('S', 'e', 'a')))
+	if l := catchErr(ix.PostingOr("", sea, tri('G', 'o', 'o'))); !equalList(l, []uint32{1, 2, 3}) {
+		t.Errorf("PostingList(Sea|Goo) = %v, want [1 2 3]", l)
 	}
-	goo = catchErr(ix.PostingList(tri('G', 'o', 'o')))
-	if l := catchErr(ix.PostingOr(goo, tri('S', 'e', 'a'))); !equalList(l, []uint32{267523926, 2101109549, 3423166451}) {
-		t.Errorf("PostingList(Goo|Sea) = %v, want [267523926 2101109549 3423166451]", l)
+	goo = catchErr(ix.PostingList("", tri('G', 'o', 'o')))
+	if l := catchErr(ix.PostingOr("", goo, tri('S', 'e', 'a'))); !equalList(l, []uint32{1, 2, 3}) {
+		t.Errorf("PostingList(Goo|Sea) = %v, want [1 2 3]", l)
 	}
 }
 
@@ -164,3 +181,330 @@ func equalList(x, y []uint32) bool {
 	}
 	return true
 }
+
+func TestPaths(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	noCompact := &WriterOptions{Repository: "a", CompactThreshold: -1}
+	addFiles(t, db, noCompact, map[string]string{"x.go": "package x\n", "y.go": "package y\n"})
+	iw := addFiles(t, db, noCompact, map[string]string{"z.go": "package zz\n"})
+	if err := iw.Delete("y.go"); err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	addFiles(t, db, &WriterOptions{Repository: "b"}, map[string]string{"x.go": "package x\n"})
+
+	ix, err := Open(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []Path
+	it := ix.Paths()
+	for it.Next() {
+		got = append(got, it.Path())
+	}
+	if err := it.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Path{
+		{Repo: "a", Name: "x.go", Size: 10},
+		{Repo: "a", Name: "z.go", Size: 11},
+		{Repo: "b", Name: "x.go", Size: 10},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Paths() = %v, want %d paths", got, len(want))
+	}
+	for i, p := range got {
+		if p.Repo != want[i].Repo || p.Name != want[i].Name || p.Size != want[i].Size {
+			t.Errorf("path %d = %s:%s (%d bytes), want %s:%s (%d bytes)", i, p.Repo, p.Name, p.Size, want[i].Repo, want[i].Name, want[i].Size)
+		}
+		if p.Segment == "" {
+			t.Errorf("%s:%s has no segment", p.Repo, p.Name)
+		}
+	}
+	if got[0].Segment == got[1].Segment {
+		t.Errorf("x.go and z.go both in segment %s, want different segments", got[0].Segment)
+	}
+	if got[0].Digest != got[2].Digest {
+		t.Errorf("same contents have digests %s and %s", got[0].Digest, got[2].Digest)
+	}
+
+	roots, err := ix.Roots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 0 {
+		t.Errorf("Roots() = %v, want none", roots)
+	}
+}
+
+func TestCaseVariants(t *testing.T) {
+	if got, want := foldTrigram(tri('A', 'z', '_')), tri('a', 'z', '_'); got != want {
+		t.Errorf("foldTrigram(Az_) = %q, want %q", trigramToString(got), trigramToString(want))
+	}
+	var got []string
+	for _, v := range caseVariants(tri('a', '1', 'b')) {
+		got = append(got, trigramToString(v))
+	}
+	sort.Strings(got)
+	if want := []string{"A1B", "A1b", "a1B", "a1b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("caseVariants(a1b) = %q, want %q", got, want)
+	}
+}
+
+func TestCaseFolded(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	search := func(re string) []string {
+		ix, err := Open(db, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits, err := ix.PostingQuery(query.RegexpQuery(mustParse(t, re)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, h := range hits {
+			name, err := ix.Name(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, name)
+		}
+		sort.Strings(got)
+		return got
+	}
+	check := func(when string, folded bool, want []string) {
+		t.Helper()
+		if got := search("(?i)readfile"); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: (?i)readfile matches %v, want %v", when, got, want)
+		}
+		if got, want := search("readfile"), []string{"b.go"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: readfile matches %v, want %v", when, got, want)
+		}
+		if n := countKeys(t, db, foldedPrefix); (n > 0) != folded {
+			t.Errorf("%s: %d case-folded posting lists", when, n)
+		}
+	}
+
+	folded := &WriterOptions{CaseFolded: true, CompactThreshold: -1}
+	addFiles(t, db, folded, map[string]string{"a.go": "func ReadFile() {}\n", "b.go": "readfile := 1\n"})
+	iw := addFiles(t, db, folded, map[string]string{"c.go": "READFILE\n", "d.go": "read_file\n"})
+	check("folded segments", true, []string{"a.go", "b.go", "c.go"})
+	if _, err := iw.GC(); err != nil {
+		t.Fatal(err)
+	}
+	check("compacted folded segments", true, []string{"a.go", "b.go", "c.go"})
+
+	// Segments without case-folded lists are searched through the
+	// case variants of each trigram, and compacting them with folded
+	// ones drops the folded lists.
+	iw = addFiles(t, db, &WriterOptions{CompactThreshold: -1}, map[string]string{"e.go": "var ReadFILE\n"})
+	check("mixed segments", true, []string{"a.go", "b.go", "c.go", "e.go"})
+	if _, err := iw.GC(); err != nil {
+		t.Fatal(err)
+	}
+	check("compacted mixed segments", false, []string{"a.go", "b.go", "c.go", "e.go"})
+
+	problems, err := Check(db, &CheckOptions{Sample: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("after GC: %v", p)
+	}
+}
+
+// benchVocabulary starts with the words that are commonest in the
+// synthetic corpus of the posting query benchmarks.
+var benchVocabulary = strings.Fields("func return err if nil error the for range string int Reader Close Index query")
+
+// openBenchCorpus returns a DB holding a synthetic corpus of n files
+// for the posting query benchmarks. The files are lines of words drawn
+// from a vocabulary with a Zipf distribution, so that, as in source
+// code, a few trigrams are in nearly every file and most in few.
+func openBenchCorpus(b *testing.B, n int) *pebble.DB {
+	db, err := pebble.Open(b.TempDir(), &pebble.Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { db.Close() })
+
+	r := rand.New(rand.NewSource(1))
+	words := append([]string(nil), benchVocabulary...)
+	for len(words) < 20000 {
+		w := make([]byte, 3+r.Intn(8))
+		for i := range w {
+			w[i] = byte('a' + r.Intn(26))
+		}
+		words = append(words, string(w))
+	}
+	zipf := rand.NewZipf(r, 1.1, 2, uint64(len(words)-1))
+
+	iw, err := Create(db, &WriterOptions{CompactThreshold: -1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	var buf strings.Builder
+	for i := 0; i < n; i++ {
+		buf.Reset()
+		for line := 0; line < 40; line++ {
+			for w := 0; w < 6; w++ {
+				buf.WriteString(words[zipf.Uint64()])
+				buf.WriteByte(' ')
+			}
+			buf.WriteByte('\n')
+		}
+		if err := iw.Add(fmt.Sprintf("f%05d.go", i), strings.NewReader(buf.String())); err != nil {
+			b.Fatal(err)
+		}
+		// Spread the files over several segments, as a
+		// repository indexed over time would be.
+		if i%(n/4) == n/4-1 {
+			if err := iw.Flush(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if err := iw.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	return db
+}
+
+func BenchmarkPostingQuery(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+	db := openBenchCorpus(b, 20000)
+	ix, err := Open(db, &ReaderOptions{CacheSize: -1})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, re := range []string{
+		"return",
+		"(?i)error",
+		"func|return|range",
+		"Reader.*Close",
+		"qzx",
+	} {
+		syn, err := syntax.Parse(re, syntax.Perl)
+		if err != nil {
+			b.Fatal(err)
+		}
+		q := query.RegexpQuery(syn)
+		b.Run(re, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				v, err := ix.newView("")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := ix.postingQuery(v, q, 0, nil); err != nil {
+					b.Fatal(err)
+				}
+				v.Close()
+			}
+		})
+	}
+}
+
+func TestDuplicatePaths(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const license = "Permission is hereby granted\n"
+	addFiles(t, db, nil, map[string]string{"a/LICENSE": license, "b/LICENSE": license, "x.go": "package x\n"})
+	iw := addFiles(t, db, nil, map[string]string{"c/LICENSE": license})
+
+	names := func(re string) (name string, names []string) {
+		ix, err := Open(db, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits, err := ix.PostingQuery(query.RegexpQuery(mustParse(t, re)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hits) == 0 {
+			return "", nil
+		}
+		if len(hits) > 1 {
+			t.Fatalf("%s matches %d docs, want 1", re, len(hits))
+		}
+		if name, err = ix.Name(hits[0]); err != nil {
+			t.Fatal(err)
+		}
+		if names, err = ix.Names(hits[0]); err != nil {
+			t.Fatal(err)
+		}
+		return name, names
+	}
+	check := func(when, wantName string, wantNames []string) {
+		t.Helper()
+		name, names := names("Permission")
+		if name != wantName || !reflect.DeepEqual(names, wantNames) {
+			t.Errorf("%s: Name = %q, Names = %q, want %q, %q", when, name, names, wantName, wantNames)
+		}
+	}
+	check("added", "a/LICENSE", []string{"a/LICENSE", "b/LICENSE", "c/LICENSE"})
+
+	// The contents stay current while any of their paths has them.
+	addFiles(t, db, nil, map[string]string{"a/LICENSE": "All rights reserved\n"})
+	check("first path changed", "b/LICENSE", []string{"b/LICENSE", "c/LICENSE"})
+	if err := iw.Delete("b/LICENSE"); err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check("second path deleted", "c/LICENSE", []string{"c/LICENSE"})
+	if _, err := iw.GC(); err != nil {
+		t.Fatal(err)
+	}
+	check("after GC", "c/LICENSE", []string{"c/LICENSE"})
+	if err := iw.Delete("c/LICENSE"); err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check("all paths deleted", "", nil)
+
+	if _, err := iw.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countKeys(t, db, linkPrefix); n != 2 {
+		t.Errorf("%d links after GC, want 2", n)
+	}
+	problems, err := Check(db, &CheckOptions{Sample: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		t.Errorf("after GC: %v", p)
+	}
+}
@@ -0,0 +1,151 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// A Root is a file or directory tree that has been added to the index,
+// recorded so that it can be walked again to bring the index up to date.
+type Root struct {
+	Repo    string    `json:"-"`
+	Path    string    `json:"path"`
+	Indexed time.Time `json:"indexed"`
+
+	// Include and Exclude are the glob patterns the root was
+	// walked with.
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// A pathState records what a path looked like when it was indexed,
+// so that unchanged files can be skipped when the root is walked again.
+// Generated and Vendored describe the file at the path, which other
+// paths with the same contents need not share.
+type pathState struct {
+	Digest    string `json:"digest"`
+	Size      int64  `json:"size"`
+	ModTime   int64  `json:"mtime"` // UnixNano
+	Generated bool   `json:"generated,omitempty"`
+	Vendored  bool   `json:"vendored,omitempty"`
+}
+
+func (ns namespace) rootKey(path string) []byte {
+	return ns.makeKey(rootPrefix, path)
+}
+
+func (ns namespace) pathKey(path string) []byte {
+	return ns.makeKey(pathPrefix, path)
+}
+
+// AddRoot records r as a root of iw's repository, replacing any
+// earlier record of the same path. r.Repo is ignored.
+func (iw *IndexWriter) AddRoot(r Root) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return iw.db.Set(iw.ns.rootKey(r.Path), buf, pebble.Sync)
+}
+
+// Roots returns the roots of iw's repository, in path order.
+func (iw *IndexWriter) Roots() ([]Root, error) {
+	return iw.ns.roots(iw.db)
+}
+
+func (ns namespace) roots(db pebble.Reader) ([]Root, error) {
+	iter := db.NewIter(&pebble.IterOptions{
+		LowerBound: ns.rootKey(""),
+		UpperBound: prefixEnd(ns.rootKey("")),
+	})
+	defer iter.Close()
+
+	var roots []Root
+	for iter.First(); iter.Valid(); iter.Next() {
+		r := Root{Repo: string(ns)}
+		if err := json.Unmarshal(iter.Value(), &r); err != nil {
+			return nil, err
+		}
+		roots = append(roots, r)
+	}
+	return roots, iter.Error()
+}
+
+// Unchanged reports whether the file name was indexed by AddFile with
+// the same size and modification time as info, and its contents are
+// still in the index.
+func (iw *IndexWriter) Unchanged(name string, info os.FileInfo) (bool, error) {
+	iw.mu.Lock()
+	pf, ok := iw.pending[name]
+	iw.mu.Unlock()
+	if ok {
+		// Changed by this segment, or by the one it resumes.
+		return pf.State != nil && pf.State.Size == info.Size() && pf.State.ModTime == info.ModTime().UnixNano(), nil
+	}
+	buf, err := getValue(iw.db, iw.ns.pathKey(name))
+	if err == pebble.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var ps pathState
+	if err := json.Unmarshal(buf, &ps); err != nil {
+		return false, err
+	}
+	if ps.Size != info.Size() || ps.ModTime != info.ModTime().UnixNano() {
+		return false, nil
+	}
+	return iw.fileExists(ps.Digest), nil
+}
+
+// DeleteMissing deletes the indexed and skipped files under root
+// that are not in seen, including those added by the segment iw is
+// writing. It returns the number of files deleted.
+func (iw *IndexWriter) DeleteMissing(root string, seen map[string]bool) (int, error) {
+	if err := iw.drain(); err != nil {
+		return 0, err
+	}
+	under := func(name string) bool {
+		return name == root || strings.HasPrefix(name, strings.TrimSuffix(root, string(filepath.Separator))+string(filepath.Separator))
+	}
+	missing := make(map[string]bool)
+	for _, key := range []func(string) []byte{iw.ns.pathKey, iw.ns.skipKey} {
+		iter := iw.db.NewIter(&pebble.IterOptions{
+			LowerBound: key(root),
+			UpperBound: prefixEnd(key(root)),
+		})
+		for iter.First(); iter.Valid(); iter.Next() {
+			name := string(bytes.TrimPrefix(iter.Key(), key("")))
+			if under(name) && !seen[name] {
+				missing[name] = true
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return 0, err
+		}
+	}
+	iw.mu.Lock()
+	for name, pf := range iw.pending {
+		switch {
+		case !under(name) || seen[name]:
+		case pf.State == nil && pf.Skip == nil:
+			delete(missing, name) // already deleted
+		default:
+			missing[name] = true
+		}
+	}
+	iw.mu.Unlock()
+	for name := range missing {
+		if err := iw.Delete(name); err != nil {
+			return 0, err
+		}
+	}
+	return len(missing), nil
+}
@@ -0,0 +1,107 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble"
+)
+
+func TestRootsAndPathState(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+	src := filepath.Join(d, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{"a.go": "package a\n", "b.go": "package b\n"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err := pebble.Open(filepath.Join(d, "index"), &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	iw, err := Create(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := filepath.Join(src, "a.go"), filepath.Join(src, "b.go")
+	for _, name := range []string{a, b} {
+		if err := iw.AddFile(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := iw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	when := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := iw.AddRoot(Root{Path: src, Indexed: when, Exclude: []string{"*.pb.go"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	roots, err := iw.Roots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 || roots[0].Path != src || !roots[0].Indexed.Equal(when) || len(roots[0].Exclude) != 1 {
+		t.Errorf("Roots() = %+v, want one root %q indexed at %v", roots, src, when)
+	}
+
+	unchanged := func(name string) bool {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := iw.Unchanged(name, info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+	if !unchanged(a) {
+		t.Errorf("Unchanged(%q) = false, want true", a)
+	}
+	if err := os.WriteFile(a, []byte("package a // changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if unchanged(a) {
+		t.Errorf("Unchanged(%q) after rewrite = true, want false", a)
+	}
+
+	n, err := iw.DeleteMissing(src, map[string]bool{a: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("DeleteMissing deleted %d files, want 1", n)
+	}
+	if err := iw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countKeys(t, db, "pth:"); n != 1 {
+		t.Errorf("%d path states after DeleteMissing, want 1", n)
+	}
+	if _, err := getValue(db, namespace("").namehashKey(hashString(b))); err != pebble.ErrNotFound {
+		t.Errorf("%s still indexed after DeleteMissing (err %v)", b, err)
+	}
+
+	// Reindexing a root that has not changed commits no segment.
+	nsegs := countKeys(t, db, segmentPrefix)
+	iw, err = Create(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countKeys(t, db, segmentPrefix); n != nsegs {
+		t.Errorf("%d segments after an empty Flush, want %d", n, nsegs)
+	}
+}
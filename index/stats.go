@@ -0,0 +1,241 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"math/bits"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring"
+	"github.com/cockroachdb/pebble"
+)
+
+// numLargest is the number of largest posting lists Stats reports.
+const numLargest = 10
+
+// Stats describes the contents of an index.
+type Stats struct {
+	Total        RepoStats   `json:"total"`
+	Repositories []RepoStats `json:"repositories"`
+}
+
+// RepoStats describes the contents of one repository, or of a whole
+// index.
+type RepoStats struct {
+	Repo string `json:"repository"`
+
+	Paths     int64 `json:"paths"`      // indexed paths
+	LiveFiles int64 `json:"live_files"` // distinct contents some path refers to
+	DeadFiles int64 `json:"dead_files"` // contents no path refers to, until compaction or kept as history
+	Skipped   int64 `json:"skipped"`    // paths not indexed
+
+	ContentBytes int64 `json:"content_bytes"` // bytes of live contents
+	StoredBytes  int64 `json:"stored_bytes"`  // bytes those contents take up after compression
+	DataBytes    int64 `json:"data_bytes"`    // bytes of all stored contents, including dead ones
+
+	Segments     int   `json:"segments"`
+	Trigrams     int64 `json:"trigrams"`      // distinct trigrams
+	PostingLists int64 `json:"posting_lists"` // one per trigram per segment
+	PostingBytes int64 `json:"posting_bytes"`
+
+	// Lengths is the distribution of posting list lengths, counting
+	// the lists of each trigram in all segments as one.
+	Lengths []Bucket `json:"lengths"`
+	// Largest are the longest posting lists, longest first.
+	Largest []Posting `json:"largest"`
+}
+
+// A Bucket counts the posting lists with lengths in [Min, Max].
+type Bucket struct {
+	Min   uint64 `json:"min"`
+	Max   uint64 `json:"max"`
+	Count int64  `json:"count"`
+}
+
+// A Posting is the posting list of a trigram.
+type Posting struct {
+	Repo    string `json:"repository"`
+	Trigram string `json:"trigram"`
+	Docs    uint64 `json:"docs"`
+}
+
+// CompressionRatio returns the ratio of ContentBytes to StoredBytes,
+// or 1 if there are no contents.
+func (s *RepoStats) CompressionRatio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.ContentBytes) / float64(s.StoredBytes)
+}
+
+// Stats computes statistics about ix's repositories. It reads the
+// whole index, so it is slow for large ones.
+func (ix *Index) Stats() (*Stats, error) {
+	snap := ix.db.NewSnapshot()
+	defer snap.Close()
+
+	st := &Stats{}
+	for _, repo := range ix.repos {
+		rs, err := namespace(repo).stats(snap)
+		if err != nil {
+			return nil, err
+		}
+		st.Repositories = append(st.Repositories, *rs)
+		st.Total.add(rs)
+	}
+	return st, nil
+}
+
+// add adds the counts in rs to s.
+func (s *RepoStats) add(rs *RepoStats) {
+	s.Paths += rs.Paths
+	s.LiveFiles += rs.LiveFiles
+	s.DeadFiles += rs.DeadFiles
+	s.Skipped += rs.Skipped
+	s.ContentBytes += rs.ContentBytes
+	s.StoredBytes += rs.StoredBytes
+	s.DataBytes += rs.DataBytes
+	s.Segments += rs.Segments
+	s.Trigrams += rs.Trigrams
+	s.PostingLists += rs.PostingLists
+	s.PostingBytes += rs.PostingBytes
+	for _, b := range rs.Lengths {
+		s.count(b.Min, b.Count)
+	}
+	for _, p := range rs.Largest {
+		s.offer(p)
+	}
+}
+
+// count adds n lists of length docs to the distribution.
+// Bucket i holds lengths in [2^i, 2^(i+1)-1].
+func (s *RepoStats) count(docs uint64, n int64) {
+	i := bits.Len64(docs) - 1
+	if i < 0 {
+		i = 0
+	}
+	for len(s.Lengths) <= i {
+		min := uint64(1) << len(s.Lengths)
+		s.Lengths = append(s.Lengths, Bucket{Min: min, Max: 2*min - 1})
+	}
+	s.Lengths[i].Count += n
+}
+
+// offer adds p to Largest if it is one of the longest lists.
+func (s *RepoStats) offer(p Posting) {
+	i := sort.Search(len(s.Largest), func(i int) bool { return s.Largest[i].Docs < p.Docs })
+	if i >= numLargest {
+		return
+	}
+	s.Largest = append(s.Largest, Posting{})
+	copy(s.Largest[i+1:], s.Largest[i:])
+	s.Largest[i] = p
+	if len(s.Largest) > numLargest {
+		s.Largest = s.Largest[:numLargest]
+	}
+}
+
+func (ns namespace) stats(db pebble.Reader) (*RepoStats, error) {
+	rs := &RepoStats{Repo: string(ns)}
+
+	segs, err := ns.segments(db)
+	if err != nil {
+		return nil, err
+	}
+	rs.Segments = len(segs)
+	live, dead, err := ns.liveDocs(db, segs, nil)
+	if err != nil {
+		return nil, err
+	}
+	rs.LiveFiles = int64(live.GetCardinality())
+	rs.DeadFiles = int64(len(dead))
+
+	// Live contents, and their sizes before compression.
+	sizes := make(map[string]int64)
+	err = ns.scan(db, pathPrefix, func(key, val []byte) error {
+		var ps pathState
+		if err := json.Unmarshal(val, &ps); err != nil {
+			return err
+		}
+		rs.Paths++
+		sizes[ps.Digest] = ps.Size
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = ns.scan(db, skipPrefix, func(key, val []byte) error {
+		rs.Skipped++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = ns.scan(db, dataPrefix, func(key, val []byte) error {
+		rs.DataBytes += int64(len(val))
+		if size, ok := sizes[string(bytes.TrimPrefix(key, ns.dataKey("")))]; ok {
+			rs.ContentBytes += size
+			rs.StoredBytes += int64(len(val))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		trigram string
+		docs    uint64
+		bm      = roaring.New()
+	)
+	finish := func() {
+		if trigram == "" {
+			return
+		}
+		rs.Trigrams++
+		rs.count(docs, 1)
+		rs.offer(Posting{Repo: string(ns), Trigram: trigram, Docs: docs})
+	}
+	err = ns.scan(db, trigramPrefix, func(key, val []byte) error {
+		tri, _, err := ns.parsePostingKey(key)
+		if err != nil {
+			return err
+		}
+		if tri == "\xff\xff\xff" {
+			// The empty list mergePost ends each segment with.
+			return nil
+		}
+		if tri != trigram {
+			finish()
+			trigram, docs = tri, 0
+		}
+		if _, err := bm.ReadFrom(bytes.NewReader(val)); err != nil {
+			return err
+		}
+		docs += bm.GetCardinality()
+		bm.Clear()
+		rs.PostingLists++
+		rs.PostingBytes += int64(len(val))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	finish()
+	return rs, nil
+}
+
+// scan calls fn for each key in the namespace with the given prefix.
+func (ns namespace) scan(db pebble.Reader, prefix string, fn func(key, val []byte) error) error {
+	iter := db.NewIter(&pebble.IterOptions{
+		LowerBound: ns.makeKey(prefix, ""),
+		UpperBound: prefixEnd(ns.makeKey(prefix, "")),
+	})
+	defer iter.Close()
+	for iter.First(); iter.Valid(); iter.Next() {
+		if err := fn(iter.Key(), iter.Value()); err != nil {
+			return err
+		}
+	}
+	return iter.Error()
+}
@@ -0,0 +1,60 @@
+package index
+
+import (
+	"os"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+)
+
+func TestStats(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	noCompact := &WriterOptions{Repository: "a", CompactThreshold: -1}
+	addFiles(t, db, noCompact, map[string]string{"x": "abcd", "y": "abcx", "bin": "\xff"})
+	addFiles(t, db, noCompact, map[string]string{"x": "abce"})
+	addFiles(t, db, &WriterOptions{Repository: "b"}, map[string]string{"z": "abc"})
+
+	ix, err := Open(db, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := ix.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Repositories) != 2 {
+		t.Fatalf("Stats() has %d repositories, want 2", len(st.Repositories))
+	}
+	a := st.Repositories[0]
+	if a.Repo != "a" || a.Paths != 2 || a.LiveFiles != 2 || a.DeadFiles != 1 || a.Skipped != 1 {
+		t.Errorf("repository a: %+v, want 2 paths, 2 live files, 1 dead, 1 skipped", a)
+	}
+	if a.Segments != 2 || a.ContentBytes != 8 || a.DataBytes != 12 {
+		t.Errorf("repository a: %+v, want 2 segments, 8 content bytes, 12 data bytes", a)
+	}
+	// abc bcd bcx bce
+	if a.Trigrams != 4 || a.PostingLists != 5 {
+		t.Errorf("repository a: %d trigrams, %d posting lists, want 4, 5", a.Trigrams, a.PostingLists)
+	}
+	if len(a.Largest) == 0 || a.Largest[0].Trigram != "abc" || a.Largest[0].Docs != 3 {
+		t.Errorf("repository a: largest posting lists %+v, want abc first with 3 docs", a.Largest)
+	}
+
+	tot := st.Total
+	if tot.Paths != 3 || tot.Trigrams != 5 || tot.Segments != 3 {
+		t.Errorf("total: %+v, want 3 paths, 5 trigrams, 3 segments", tot)
+	}
+	// Lengths: bcd, bcx, bce and b's abc have 1 doc; a's abc has 3.
+	want := []Bucket{{1, 1, 4}, {2, 3, 1}}
+	if len(tot.Lengths) != len(want) || tot.Lengths[0] != want[0] || tot.Lengths[1] != want[1] {
+		t.Errorf("total lengths = %+v, want %+v", tot.Lengths, want)
+	}
+}
@@ -0,0 +1,222 @@
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"sort"
+	"strings"
+
+	"github.com/cockroachdb/pebble"
+)
+
+// Kinds of Symbol.
+const (
+	SymbolFunc   = "func"
+	SymbolMethod = "method"
+	SymbolType   = "type"
+	SymbolConst  = "const"
+	SymbolVar    = "var"
+)
+
+// A Symbol is a top-level declaration in a Go source file.
+type Symbol struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	Recv string `json:"recv,omitempty"` // receiver type of a method, without '*'
+	Line int    `json:"line"`
+}
+
+// String returns the declaration as Go source would begin it,
+// such as "func (T) Name".
+func (s Symbol) String() string {
+	if s.Kind == SymbolMethod {
+		return fmt.Sprintf("func (%s) %s", s.Recv, s.Name)
+	}
+	return s.Kind + " " + s.Name
+}
+
+// goSymbols returns the top-level declarations of a Go source file, in
+// the order they appear. A file with syntax errors yields those that
+// could be parsed.
+func goSymbols(name string, data []byte) []Symbol {
+	fset := token.NewFileSet()
+	f, _ := parser.ParseFile(fset, name, data, parser.SkipObjectResolution)
+	if f == nil {
+		return nil
+	}
+	var syms []Symbol
+	add := func(id *ast.Ident, kind, recv string) {
+		if id == nil || id.Name == "_" {
+			return
+		}
+		syms = append(syms, Symbol{Name: id.Name, Kind: kind, Recv: recv, Line: fset.Position(id.Pos()).Line})
+	}
+	for _, decl := range f.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if d.Recv == nil || len(d.Recv.List) == 0 {
+				add(d.Name, SymbolFunc, "")
+			} else {
+				add(d.Name, SymbolMethod, recvType(d.Recv.List[0].Type))
+			}
+		case *ast.GenDecl:
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					add(s.Name, SymbolType, "")
+				case *ast.ValueSpec:
+					kind := SymbolVar
+					if d.Tok == token.CONST {
+						kind = SymbolConst
+					}
+					for _, id := range s.Names {
+						add(id, kind, "")
+					}
+				}
+			}
+		}
+	}
+	return syms
+}
+
+// recvType returns the name of a method's receiver type, dropping any
+// pointer and type parameters.
+func recvType(x ast.Expr) string {
+	for {
+		switch t := x.(type) {
+		case *ast.StarExpr:
+			x = t.X
+		case *ast.ParenExpr:
+			x = t.X
+		case *ast.IndexExpr:
+			x = t.X
+		case *ast.IndexListExpr:
+			x = t.X
+		case *ast.Ident:
+			return t.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// symbolKey returns the key recording that the contents with the
+// given digest declare a symbol named name at line. Keys sort by name,
+// so that the symbols with a given name or name prefix are found with
+// a range scan.
+func (ns namespace) symbolKey(name, digest string, line int) []byte {
+	return ns.makeKey(symbolPrefix, fmt.Sprintf("%s\x00%s:%08d", name, digest, line))
+}
+
+// parseSymbolKey returns the name and digest encoded in a key made by
+// symbolKey.
+func (ns namespace) parseSymbolKey(key []byte) (name, digest string, err error) {
+	rest := bytes.TrimPrefix(key, ns.makeKey(symbolPrefix, ""))
+	i := bytes.IndexByte(rest, 0)
+	j := bytes.LastIndexByte(rest, ':')
+	if i < 0 || j < i {
+		return "", "", fmt.Errorf("bad symbol key %q", key)
+	}
+	return string(rest[:i]), string(rest[i+1 : j]), nil
+}
+
+// setSymbols adds the symbols declared by the contents with the given
+// digest to batch.
+func (ns namespace) setSymbols(batch *pebble.Batch, digest string, syms []Symbol) error {
+	for _, s := range syms {
+		buf, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		if err := batch.Set(ns.symbolKey(s.Name, digest, s.Line), buf, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A SymbolHit is a symbol found by SymbolSearch.
+type SymbolHit struct {
+	Hit
+	Symbol
+}
+
+// SymbolSearch returns up to max (if positive) symbols of the current
+// files named query or starting with it, exact matches first. A query
+// "T.Name" matches only the methods of type T.
+func (ix *Index) SymbolSearch(query string, max int) ([]SymbolHit, error) {
+	recv, name := "", query
+	if i := strings.LastIndexByte(query, '.'); i >= 0 {
+		recv, name = query[:i], query[i+1:]
+	}
+	var hits []SymbolHit
+	for _, repo := range ix.repos {
+		ns := namespace(repo)
+		docs := make(map[string]uint32) // current digests, to doc ID
+		err := ns.scan(ix.db, symbolPrefix+name, func(key, val []byte) error {
+			_, digest, err := ns.parseSymbolKey(key)
+			if err != nil {
+				return err
+			}
+			var s Symbol
+			if err := json.Unmarshal(val, &s); err != nil {
+				return fmt.Errorf("bad symbol %q: %v", key, err)
+			}
+			if recv != "" && s.Recv != recv {
+				return nil
+			}
+			id, ok := docs[digest]
+			if !ok {
+				if id, ok, err = ix.currentDoc(ns, digest); err != nil {
+					return err
+				}
+				if !ok {
+					return nil
+				}
+				docs[digest] = id
+			}
+			hits = append(hits, SymbolHit{Hit{Repo: repo, FileID: id}, s})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		x, y := hits[i], hits[j]
+		switch {
+		case (x.Name == name) != (y.Name == name):
+			return x.Name == name
+		case len(x.Name) != len(y.Name):
+			return len(x.Name) < len(y.Name)
+		case x.Name != y.Name:
+			return x.Name < y.Name
+		case (x.Recv == "") != (y.Recv == ""):
+			return x.Recv == ""
+		case x.Repo != y.Repo:
+			return x.Repo < y.Repo
+		case x.FileID != y.FileID:
+			return x.FileID < y.FileID
+		}
+		return x.Line < y.Line
+	})
+	if max > 0 && len(hits) > max {
+		hits = hits[:max]
+	}
+	return hits, nil
+}
+
+// currentDoc returns the ID of the doc with the given contents, and
+// whether they are still the current contents of a file.
+func (ix *Index) currentDoc(ns namespace, digest string) (uint32, bool, error) {
+	id, ok, err := ns.lookupDoc(ix.db, digest)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	current, err := ix.isCurrent(ns, digest)
+	return id, current, err
+}
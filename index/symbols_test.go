@@ -0,0 +1,137 @@
+package index
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/cockroachdb/pebble"
+)
+
+const symbolsSource = `package p
+
+import "fmt"
+
+func Open(name string) (*File, error) { return nil, nil }
+
+func (f *File) Close() error { return nil }
+
+func (l List[T]) Len() int { return 0 }
+
+type (
+	File struct{}
+	List[T any] []T
+)
+
+const A, B = 1, 2
+
+var _ = fmt.Sprint
+
+var (
+	Default = &File{}
+)
+
+func broken( {
+`
+
+func TestGoSymbols(t *testing.T) {
+	want := []Symbol{
+		{"Open", SymbolFunc, "", 5},
+		{"Close", SymbolMethod, "File", 7},
+		{"Len", SymbolMethod, "List", 9},
+		{"File", SymbolType, "", 12},
+		{"List", SymbolType, "", 13},
+		{"A", SymbolConst, "", 16},
+		{"B", SymbolConst, "", 16},
+		{"Default", SymbolVar, "", 21},
+		{"broken", SymbolFunc, "", 24}, // despite the syntax error
+	}
+	if got := goSymbols("p.go", []byte(symbolsSource)); !reflect.DeepEqual(got, want) {
+		t.Errorf("goSymbols = %v, want %v", got, want)
+	}
+	if got := goSymbols("x.go", []byte("not Go\n")); len(got) != 0 {
+		t.Errorf("goSymbols of non-Go file = %v, want none", got)
+	}
+}
+
+func TestSymbolSearch(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	addFiles(t, db, nil, map[string]string{
+		"file.go":  symbolsSource,
+		"open.go":  "package q\n\nfunc OpenFile() {}\n\nfunc Opener() {}\n",
+		"other.go": "package q\n\ntype Reader struct{}\n\nfunc (r Reader) Open() {}\n",
+		"open.txt": "func Open() {}\n",
+	})
+
+	type result struct {
+		file string
+		sym  string
+		line int
+	}
+	symbolSearch := func(query string, max int) []result {
+		ix, err := Open(db, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits, err := ix.SymbolSearch(query, max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []result
+		for _, h := range hits {
+			name, err := ix.Name(h.Hit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, result{name, h.Symbol.String(), h.Line})
+		}
+		return got
+	}
+
+	for _, tt := range []struct {
+		query string
+		max   int
+		want  []result
+	}{
+		{"Open", 0, []result{
+			{"file.go", "func Open", 5},
+			{"other.go", "func (Reader) Open", 5},
+			{"open.go", "func Opener", 5},
+			{"open.go", "func OpenFile", 3},
+		}},
+		{"Open", 2, []result{
+			{"file.go", "func Open", 5},
+			{"other.go", "func (Reader) Open", 5},
+		}},
+		{"Reader.Open", 0, []result{{"other.go", "func (Reader) Open", 5}}},
+		{"File.", 0, []result{{"file.go", "func (File) Close", 7}}},
+		{"Default", 0, []result{{"file.go", "var Default", 21}}},
+		{"Missing", 0, nil},
+	} {
+		if got := symbolSearch(tt.query, tt.max); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("SymbolSearch(%q, %d) = %v, want %v", tt.query, tt.max, got, tt.want)
+		}
+	}
+
+	// Symbols of replaced contents are not found, and GC removes them.
+	iw := addFiles(t, db, nil, map[string]string{"open.go": "package q\n\nfunc Opener() {}\n"})
+	if got, want := symbolSearch("OpenF", 0), []result(nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("SymbolSearch(%q) after update = %v, want %v", "OpenF", got, want)
+	}
+	if got, want := symbolSearch("Opener", 0), []result{{"open.go", "func Opener", 3}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("SymbolSearch(%q) after update = %v, want %v", "Opener", got, want)
+	}
+	if _, err := iw.GC(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countKeys(t, db, symbolPrefix); n != 12 {
+		t.Errorf("%d symbols after GC, want 12", n)
+	}
+}
@@ -1,13 +1,14 @@
 package index
 
 import (
-	"bytes"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"runtime"
+	"strconv"
 	"sync"
+	"time"
 	"unsafe"
 
 	"github.com/RoaringBitmap/roaring"
@@ -29,30 +30,109 @@ type IndexWriter struct {
 	LogSkip bool // log information about skipped files
 	Verbose bool // log status using package log
 
-	inbuf      []byte // input buffer
+	scanner    scanner // used by Add and by AddFile with one worker
 	totalBytes int64
 
-	trigram        *sparse.Set // trigrams for the current file
+	// mu guards the fields below, which commit updates. With more
+	// than one worker, commit runs on its own goroutine.
+	mu             sync.Mutex
 	post           []postEntry // list of (trigram, file#) pairs
 	postFile       []*os.File  // flushed post entries
 	filesProcessed int
+	filesSkipped   int
+	filesDeduped   int
+	filesDeleted   int
+	contentBytes   int64 // bytes of contents added
+	storedBytes    int64 // bytes of contents after compression
 
-	repoID    []byte // TODO(tylerw): set this via API instead of hacky
+	ns        namespace // repository the files are written to
 	segmentID string
+	firstDoc  uint32 // first doc ID allocated to this segment
+	nextDoc   uint32 // next doc ID to allocate
+
+	// Changes made by this segment, which readers do not see
+	// until it is committed.
+	npending    int                     // changes recorded
+	pending     map[string]*pendingFile // latest change to each path
+	pendingDocs map[string]uint32       // docs added, by digest
+
+	compactThreshold int
+	codec            Codec
+	caseFolded       bool
+	history          time.Duration
+	now              func() time.Time // the time of commits and compactions
+	limits           Limits
+	limitRules       []LimitRule
+	workers          int
+	scanners         []scanner // one per worker
+
+	pipeMu sync.Mutex // guards pipe and closed; held while queueing a file
+	pipe   *pipeline  // pipeline for queued files, if running
+	closed bool       // Close has been called
 }
 
-// Tuning constants for detecting text files.
-// A file is assumed not to be text files (and thus not indexed)
-// if it contains an invalid UTF-8 sequences, if it is longer than maxFileLength
-// bytes, if it contains a line longer than maxLineLen bytes,
-// or if it contains more than maxTextTrigrams distinct trigrams.
-const (
-	maxFileLen      = 1 << 30
-	maxLineLen      = 2000
-	maxTextTrigrams = 20000
+// WriterOptions configures an IndexWriter.
+type WriterOptions struct {
+	// Repository names the namespace that files are written to.
+	// The zero value is the default repository.
+	Repository string
+
+	// CompactThreshold is the number of committed segments at which
+	// Flush compacts the repository. Zero means
+	// DefaultCompactThreshold; a negative value disables automatic
+	// compaction.
+	CompactThreshold int
+
+	// Codec compresses the file contents stored in the index.
+	// Contents written with any codec stay readable whatever codec
+	// later writers use.
+	Codec Codec
+
+	// Workers is the number of goroutines AddFile uses to scan files,
+	// which are still committed in order. Zero means GOMAXPROCS.
+	Workers int
+
+	// Limits sets the heuristics that decide whether a file is
+	// indexed, and LimitRules overrides them for particular files.
+	// Files that are not indexed are recorded with the reason,
+	// and listed by Index.Skipped.
+	Limits     Limits
+	LimitRules []LimitRule
+
+	// CaseFolded also writes posting lists of case-folded trigrams,
+	// so that case-insensitive queries read one list per trigram.
+	CaseFolded bool
+
+	// History is how long replaced versions of a file stay searchable
+	// with ReaderOptions.At. Zero keeps none; negative keeps all.
+	History time.Duration
+
+	// Resume continues the segment of an interrupted writer rather
+	// than discarding it.
+	Resume bool
+}
 
-	npost = 64 << 20 / 8 // 64 MB worth of post entries
-)
+// WriterStats counts the files seen by an IndexWriter.
+type WriterStats struct {
+	FilesIndexed int // files whose contents were added to the index
+	FilesSkipped int // files rejected as unreadable or not text
+	FilesDeduped int // files whose contents were already indexed
+	FilesDeleted int // files removed with Delete
+
+	ContentBytes int64 // bytes of contents added to the index
+	StoredBytes  int64 // bytes those contents take up after compression
+}
+
+// CompressionRatio returns the ratio of ContentBytes to StoredBytes,
+// or 1 if no contents have been added.
+func (s WriterStats) CompressionRatio() float64 {
+	if s.StoredBytes == 0 {
+		return 1
+	}
+	return float64(s.ContentBytes) / float64(s.StoredBytes)
+}
+
+const npost = 64 << 20 / 8 // 64 MB worth of post entries
 
 // A postEntry is an in-memory (trigram, file#) pair.
 type postEntry uint64
@@ -69,34 +149,113 @@ func makePostEntry(trigram, fileid uint32) postEntry {
 	return postEntry(trigram)<<32 | postEntry(fileid)
 }
 
-// Create returns a new IndexWriter that will write the index to file.
-func Create(db *pebble.DB) (*IndexWriter, error) {
+// Create returns a new IndexWriter that will write the index to db.
+// A nil opts is equivalent to the zero WriterOptions.
+func Create(db *pebble.DB, opts *WriterOptions) (*IndexWriter, error) {
+	if opts == nil {
+		opts = &WriterOptions{}
+	}
+	if err := validRepository(opts.Repository); err != nil {
+		return nil, err
+	}
+	if int(opts.Codec) >= len(codecNames) {
+		return nil, fmt.Errorf("unknown codec %v", opts.Codec)
+	}
 	sID, err := uuid.NewV7()
 	if err != nil {
 		return nil, err
 	}
-	return &IndexWriter{
-		db:        db,
-		trigram:   sparse.NewSet(1 << 24),
-		post:      make([]postEntry, 0, npost),
-		inbuf:     make([]byte, 16384),
-		segmentID: sID.String(),
-	}, nil
+	if err := checkVersion(db); err != nil {
+		return nil, err
+	}
+	batch := db.NewBatch()
+	if err := batch.Set(versionKey(), []byte(strconv.Itoa(FormatVersion)), nil); err != nil {
+		return nil, err
+	}
+	if err := batch.Set(repositoryKey(opts.Repository), nil, nil); err != nil {
+		return nil, err
+	}
+	if err := batch.Commit(pebble.Sync); err != nil {
+		return nil, err
+	}
+	compactThreshold := opts.CompactThreshold
+	if compactThreshold == 0 {
+		compactThreshold = DefaultCompactThreshold
+	}
+	workers := opts.Workers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	ns := namespace(opts.Repository)
+	firstDoc := uint32(0)
+	buf, err := getValue(db, ns.nextDocKey())
+	switch {
+	case err == nil:
+		firstDoc = bytesToUint32(buf)
+	case err != pebble.ErrNotFound:
+		return nil, err
+	}
+	iw := &IndexWriter{
+		db:          db,
+		scanner:     newScanner(),
+		post:        make([]postEntry, 0, npost),
+		ns:          ns,
+		segmentID:   sID.String(),
+		firstDoc:    firstDoc,
+		nextDoc:     firstDoc,
+		pending:     make(map[string]*pendingFile),
+		pendingDocs: make(map[string]uint32),
+
+		compactThreshold: compactThreshold,
+		codec:            opts.Codec,
+		caseFolded:       opts.CaseFolded,
+		history:          opts.History,
+		now:              time.Now,
+		workers:          workers,
+		limits:           opts.Limits.or(DefaultLimits),
+		limitRules:       opts.LimitRules,
+	}
+	interrupted, err := ns.pendingSegments(db)
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range interrupted {
+		if opts.Resume && i == len(interrupted)-1 {
+			err = iw.resume(id)
+		} else {
+			err = ns.discard(db, id)
+		}
+		if err != nil {
+			iw.closePost()
+			return nil, err
+		}
+	}
+	return iw, nil
 }
 
 // AddFile adds the file with the given name (opened using os.Open)
-// to the index. It logs errors using package log.
+// to the index. It logs errors using package log. With more than one
+// worker it only queues the file; later calls and Flush report errors.
 func (iw *IndexWriter) AddFile(name string) error {
+	if iw.workers > 1 {
+		return iw.queue(name)
+	}
 	f, err := os.Open(name)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	return iw.Add(name, f)
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return iw.add(name, f, info)
 }
 
+// fileExists reports whether the contents with the given digest are
+// in a committed segment.
 func (iw *IndexWriter) fileExists(fileDigest string) bool {
-	_, closer, err := iw.db.Get(filenameKey(fileDigest))
+	_, closer, err := iw.db.Get(iw.ns.filenameKey(fileDigest))
 	if err != pebble.ErrNotFound {
 		//log.Printf("File %q already indexed!!!", fileDigest)
 		closer.Close()
@@ -107,29 +266,93 @@ func (iw *IndexWriter) fileExists(fileDigest string) bool {
 
 // Add adds the file f to the index under the given name.
 // It logs errors using package log.
+// Add waits for any files queued by AddFile to be added first.
 func (iw *IndexWriter) Add(name string, f io.ReadSeeker) error {
-	hashSum, err := hashFile(f)
+	if err := iw.drain(); err != nil {
+		return err
+	}
+	return iw.add(name, f, nil)
+}
+
+// add implements Add. If info is not nil, it describes the file on
+// disk.
+func (iw *IndexWriter) add(name string, f io.ReadSeeker, info os.FileInfo) error {
+	sf, err := iw.scan(&iw.scanner, name, f, info)
 	if err != nil {
 		return err
 	}
-	digest := fmt.Sprintf("%x", hashSum)
-	fileid := bytesToUint32(hashSum[:4])
+	return iw.commit(sf)
+}
 
-	if iw.fileExists(digest) {
-		return nil
+// A scanner holds the buffers used to scan one file at a time.
+// Each worker has its own.
+type scanner struct {
+	trigram *sparse.Set // trigrams for the current file
+	inbuf   []byte      // input buffer
+}
+
+func newScanner() scanner {
+	return scanner{
+		trigram: sparse.NewSet(1 << 24),
+		inbuf:   make([]byte, 16384),
+	}
+}
+
+// A scannedFile is a file that has been read and checked by scan
+// and is ready to be committed to the index.
+type scannedFile struct {
+	name     string
+	ps       *pathState
+	indexed  bool       // contents were already in the index
+	skip     SkipReason // why the contents are not to be indexed, if they are not
+	trigrams []uint32   // distinct trigrams in the contents
+	size     int64      // bytes of contents
+	stored   []byte     // contents as stored, after compression
+	meta     *Meta
+	symbols  []Symbol // top-level declarations, if Go source
+}
+
+// scan reads f, using sc's buffers, and prepares it for commit.
+// It does not modify the index, and so can run concurrently with
+// other scans.
+func (iw *IndexWriter) scan(sc *scanner, name string, f io.ReadSeeker, info os.FileInfo) (*scannedFile, error) {
+	hashSum, size, err := hashFile(f)
+	if err != nil {
+		return nil, err
+	}
+	ps := &pathState{Digest: fmt.Sprintf("%x", hashSum), Size: size, Vendored: isVendored(name)}
+	if info != nil {
+		ps.ModTime = info.ModTime().UnixNano()
+	}
+	sf := &scannedFile{name: name, ps: ps, size: size}
+
+	if iw.fileExists(ps.Digest) {
+		// The contents are indexed, but name may have had other
+		// contents (or been deleted) since. Whether they are
+		// generated depends on the name too.
+		sf.indexed = true
+		f.Seek(0, 0)
+		head, err := io.ReadAll(io.LimitReader(f, generatedHead))
+		if err != nil {
+			return nil, err
+		}
+		ps.Generated = isGenerated(name, head)
+		return sf, nil
 	}
 
 	f.Seek(0, 0)
-	iw.trigram.Reset()
+	sc.trigram.Reset()
 	var (
 		c         = byte(0)
 		i         = 0
-		buf       = iw.inbuf[:0]
+		buf       = sc.inbuf[:0]
 		readCount = 0
 		tv        = uint32(0)
 		n         = int64(0)
 		linelen   = 0
 	)
+	lim := iw.limitsFor(name)
+	sf.skip = SkipUnreadable
 	for {
 		tv = (tv << 8) & (1<<24 - 1)
 		if i >= len(buf) {
@@ -140,10 +363,10 @@ func (iw *IndexWriter) Add(name string, f io.ReadSeeker) error {
 						break
 					}
 					log.Printf("%s: %v\n", name, err)
-					return nil
+					return sf, nil
 				}
 				log.Printf("%s: 0-length read\n", name)
-				return nil
+				return sf, nil
 			}
 			buf = buf[:n]
 			i = 0
@@ -153,68 +376,105 @@ func (iw *IndexWriter) Add(name string, f io.ReadSeeker) error {
 		i++
 		tv |= uint32(c)
 		if n++; n >= 3 {
-			iw.trigram.Add(tv)
+			sc.trigram.Add(tv)
 		}
 		if !validUTF8((tv>>8)&0xFF, tv&0xFF) {
 			if iw.LogSkip {
 				log.Printf("%s: invalid UTF-8, ignoring\n", name)
 			}
-			return nil
+			sf.skip = SkipInvalidUTF8
+			return sf, nil
 		}
-		if n > maxFileLen {
+		if n > lim.MaxFileLen {
 			if iw.LogSkip {
 				log.Printf("%s: too long, ignoring\n", name)
 			}
-			return nil
+			sf.skip = SkipTooLong
+			return sf, nil
 		}
-		if linelen++; linelen > maxLineLen {
+		if linelen++; linelen > lim.MaxLineLen {
 			if iw.LogSkip {
 				log.Printf("%s: very long lines, ignoring\n", name)
 			}
-			return nil
+			sf.skip = SkipLongLines
+			return sf, nil
 		}
 		if c == '\n' {
 			linelen = 0
 		}
 	}
-	if iw.trigram.Len() > maxTextTrigrams {
+	if sc.trigram.Len() > lim.MaxTextTrigrams {
 		if iw.LogSkip {
 			log.Printf("%s: too many trigrams, probably not text, ignoring\n", name)
 		}
-		return nil
-	}
-	iw.totalBytes += n
-
-	if iw.Verbose {
-		log.Printf("%d %d %s id %d (%q)\n", n, iw.trigram.Len(), name, fileid, digest)
+		sf.skip = SkipTooManyTrigrams
+		return sf, nil
 	}
+	sf.skip = ""
+	sf.trigrams = append([]uint32(nil), sc.trigram.Dense()...)
 
-	for _, trigram := range iw.trigram.Dense() {
-		if len(iw.post) >= cap(iw.post) {
-			if err := iw.flushPost(); err != nil {
-				return err
-			}
-		}
-		iw.post = append(iw.post, makePostEntry(trigram, fileid))
-	}
-
-	if err := iw.db.Set(filenameKey(digest), []byte(name), pebble.NoSync); err != nil {
-		return err
-	}
 	var fileBuf []byte
 	if readCount == 1 {
-		fileBuf = buf
+		// buf belongs to sc, and stored may be fileBuf itself.
+		fileBuf = append([]byte(nil), buf...)
 	} else {
 		f.Seek(0, 0)
 		fileBuf, err = io.ReadAll(f)
 		if err != nil {
-			return err
+			return nil, err
 		}
 	}
-	if err := iw.db.Set(dataKey(digest), fileBuf, pebble.NoSync); err != nil {
+	sf.meta = newMeta(name, fileBuf, ps.ModTime)
+	ps.Generated = sf.meta.Generated
+	if sf.meta.Language == "go" {
+		sf.symbols = goSymbols(name, fileBuf)
+	}
+	sf.stored, err = encodeContents(iw.codec, fileBuf)
+	if err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+// commit adds a scanned file to the index, allocating it the next doc
+// ID unless its contents are already indexed. Files are committed one
+// at a time, in the order they were added.
+func (iw *IndexWriter) commit(sf *scannedFile) error {
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+
+	name, digest := sf.name, sf.ps.Digest
+	if sf.skip != "" {
+		iw.filesSkipped++
+		return iw.stage(&pendingFile{Name: name, Skip: &SkippedFile{Reason: sf.skip, Size: sf.size}})
+	}
+	// Another file with the same contents may have been committed
+	// since sf was scanned.
+	if _, ok := iw.pendingDocs[digest]; ok || sf.indexed || iw.fileExists(digest) {
+		iw.filesDeduped++
+		return iw.stage(&pendingFile{Name: name, State: sf.ps})
+	}
+	iw.totalBytes += sf.size
+
+	fileid := iw.nextDoc
+	iw.nextDoc++
+
+	if iw.Verbose {
+		log.Printf("%d %d %s id %d (%q)\n", sf.size, len(sf.trigrams), name, fileid, digest)
+	}
+
+	if err := iw.addPost(sf.trigrams, fileid); err != nil {
 		return err
 	}
-	if err := iw.db.Set(namehashKey(hashString(name)), []byte(digest), pebble.NoSync); err != nil {
+
+	// The contents are stored before the change that refers to
+	// them, so that a resumed segment finds them.
+	if err := iw.db.Set(iw.ns.dataKey(digest), sf.stored, pebble.NoSync); err != nil {
+		return err
+	}
+	iw.contentBytes += sf.size
+	iw.storedBytes += int64(len(sf.stored))
+	if err := iw.stage(&pendingFile{Name: name, Doc: &fileid, State: sf.ps, Meta: sf.meta, Symbols: sf.symbols}); err != nil {
 		return err
 	}
 
@@ -223,21 +483,126 @@ func (iw *IndexWriter) Add(name string, f io.ReadSeeker) error {
 	return nil
 }
 
+// addPost adds post entries for the trigrams of doc fileid, and for
+// their case-folded forms if iw writes those. Docs must be added in
+// order of ID.
+func (iw *IndexWriter) addPost(trigrams []uint32, fileid uint32) error {
+	if iw.caseFolded {
+		folded := make(map[uint32]bool)
+		for _, trigram := range trigrams {
+			folded[foldTrigram(trigram)|foldedTrigram] = true
+		}
+		all := make([]uint32, 0, len(trigrams)+len(folded))
+		all = append(all, trigrams...)
+		for trigram := range folded {
+			all = append(all, trigram)
+		}
+		trigrams = all
+	}
+	for _, trigram := range trigrams {
+		if len(iw.post) >= cap(iw.post) {
+			if err := iw.flushPost(); err != nil {
+				return err
+			}
+		}
+		iw.post = append(iw.post, makePostEntry(trigram, fileid))
+	}
+	return nil
+}
+
+// Delete removes the file with the given name from the index.
+// Its contents stay in the index, but no longer match searches,
+// until they are reclaimed by GC.
+// Delete waits for any files queued by AddFile to be added first.
+func (iw *IndexWriter) Delete(name string) error {
+	if err := iw.drain(); err != nil {
+		return err
+	}
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+	if err := iw.stage(&pendingFile{Name: name}); err != nil {
+		return err
+	}
+	iw.filesDeleted++
+	return nil
+}
+
+// Stats returns counts of the files added to iw so far.
+func (iw *IndexWriter) Stats() WriterStats {
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+	return WriterStats{
+		FilesIndexed: iw.filesProcessed,
+		FilesSkipped: iw.filesSkipped,
+		FilesDeduped: iw.filesDeduped,
+		FilesDeleted: iw.filesDeleted,
+		ContentBytes: iw.contentBytes,
+		StoredBytes:  iw.storedBytes,
+	}
+}
+
+// Flush commits the files added since the last Flush as one segment,
+// visible all at once, and compacts if the threshold is reached.
 func (iw *IndexWriter) Flush() error {
-	iw.mergePost()
+	if err := iw.drain(); err != nil {
+		return err
+	}
+	if iw.npending == 0 {
+		return nil
+	}
+	if err := iw.mergePost(); err != nil {
+		return err
+	}
+	if iw.compactThreshold > 0 {
+		segs, err := iw.ns.segments(iw.db)
+		if err != nil {
+			return err
+		}
+		if len(segs) >= iw.compactThreshold {
+			log.Printf("%d segments, compacting", len(segs))
+			if err := iw.Compact(); err != nil {
+				return err
+			}
+		}
+	}
 	if err := iw.db.Flush(); err != nil {
 		return err
 	}
 	return nil
 }
 
-// flushPost writes iw.post to a new temporary file and
-// clears the slice.
+// Close releases the resources of iw, discarding any changes made
+// since the last Flush.
+func (iw *IndexWriter) Close() error {
+	iw.pipeMu.Lock()
+	defer iw.pipeMu.Unlock()
+	if iw.closed {
+		return nil
+	}
+	iw.closed = true
+	iw.abort()
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+	iw.closePost()
+	iw.scanners = nil
+	if iw.npending == 0 {
+		return nil
+	}
+	iw.npending = 0
+	iw.pending = make(map[string]*pendingFile)
+	iw.pendingDocs = make(map[string]uint32)
+	return iw.ns.discard(iw.db, iw.segmentID)
+}
+
+// flushPost writes iw.post to a new, already unlinked, temporary file
+// and clears the slice.
 func (iw *IndexWriter) flushPost() error {
 	w, err := os.CreateTemp("", "csearch-index")
 	if err != nil {
 		return err
 	}
+	os.Remove(w.Name())
+	iw.postFile = append(iw.postFile, w)
 	if iw.Verbose {
 		log.Printf("flush %d entries to %s", len(iw.post), w.Name())
 	}
@@ -255,13 +620,23 @@ func (iw *IndexWriter) flushPost() error {
 
 	iw.post = iw.post[:0]
 	w.Seek(0, 0)
-	iw.postFile = append(iw.postFile, w)
 	return nil
 }
 
+// closePost closes and removes the files written by flushPost.
+func (iw *IndexWriter) closePost() {
+	for _, f := range iw.postFile {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	iw.postFile = nil
+}
+
 // mergePost reads the flushed index entries and merges them
-// into posting lists, writing the resulting lists to out.
+// into posting lists, writing the resulting lists to out along with
+// the lists of the trigrams of the paths the segment changed.
 func (iw *IndexWriter) mergePost() error {
+	defer iw.closePost()
 	var h postHeap
 
 	log.Printf("merge %d files + mem", len(iw.postFile))
@@ -290,24 +665,15 @@ func (iw *IndexWriter) mergePost() error {
 
 	eg := new(errgroup.Group)
 	eg.SetLimit(runtime.GOMAXPROCS(0))
-	writeDocIDs := func(key []byte, ids []uint32) error {
-		buf := new(bytes.Buffer)
+	writeDocIDs := func(prefix, trigram string, ids []uint32) error {
 		pl := roaring.BitmapOf(ids...)
-		if _, err := pl.WriteTo(buf); err != nil {
-			return err
-		}
 		mu.Lock()
 		defer mu.Unlock()
 
-		if err := batch.Set(key, buf.Bytes(), nil); err != nil {
+		if _, err := iw.ns.setList(batch, prefix, trigram, iw.segmentID, pl); err != nil {
 			return err
 		}
-		if batch.Len() >= 64<<20 {
-			if err := flushBatch(); err != nil {
-				return err
-			}
-		}
-		return nil
+		return commitIfFull(iw.db, &batch)
 	}
 
 	npost := 0
@@ -324,20 +690,61 @@ func (iw *IndexWriter) mergePost() error {
 			docIDs = append(docIDs, e.fileid())
 			nfile++
 		}
+		prefix := trigramPrefix
+		if trigram&foldedTrigram != 0 {
+			prefix = foldedPrefix
+		}
+		triString := trigramToString(trigram &^ foldedTrigram)
 		eg.Go(func() error {
-			triString := trigramToString(trigram)
-			triKey := append(trigramKey(triString), []byte(":"+iw.segmentID)...)
-			return writeDocIDs(triKey, docIDs)
+			return writeDocIDs(prefix, triString, docIDs)
 		})
 
 		if trigram == 1<<24-1 {
 			break
 		}
 	}
-	eg.Wait()
-	err := flushBatch()
+	paths, err := iw.pathPosts()
+	if err != nil {
+		return err
+	}
+	for _, trigram := range sortedTrigrams(paths) {
+		triString, docIDs := trigramToString(trigram), paths[trigram]
+		eg.Go(func() error {
+			return writeDocIDs(pathListPrefix, triString, docIDs)
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return err
+	}
+
+	// Record the segment last, so readers see all of it or none.
+	now := iw.now()
+	if err := iw.applyPending(batch, now); err != nil {
+		return err
+	}
+	si := &segmentInfo{FirstDoc: iw.firstDoc, NumDocs: iw.nextDoc - iw.firstDoc, Folded: iw.caseFolded, Committed: now.UnixNano()}
+	if err := batch.Set(iw.ns.segmentKey(iw.segmentID), si.encode(), nil); err != nil {
+		return err
+	}
+	if err := batch.Set(iw.ns.nextDocKey(), uint32ToBytes(iw.nextDoc), nil); err != nil {
+		return err
+	}
+	if err := flushBatch(); err != nil {
+		return err
+	}
 	log.Printf("Wrote %d posting lists", npost)
-	return err
+	iw.post = iw.post[:0]
+	iw.npending = 0
+	iw.pending = make(map[string]*pendingFile)
+	iw.pendingDocs = make(map[string]uint32)
+
+	// Files added after this start a new segment.
+	sID, err := uuid.NewV7()
+	if err != nil {
+		return err
+	}
+	iw.segmentID, iw.firstDoc = sID.String(), iw.nextDoc
+	return nil
 }
 
 // A postChunk represents a chunk of post entries flushed to disk or
@@ -519,4 +926,27 @@ func sortPost(post []postEntry) {
 		sortN[r]++
 		tmp[o] = p
 	}
+
+	// The sorted entries are back in the caller's slice, now tmp.
+	// Case-folded entries sort after all the others.
+	n := 0
+	for _, p := range tmp {
+		if p.trigram()&foldedTrigram == 0 {
+			n++
+		}
+	}
+	if n == len(tmp) {
+		return
+	}
+	i, j := 0, n
+	for _, p := range tmp {
+		if p.trigram()&foldedTrigram == 0 {
+			post[i] = p
+			i++
+		} else {
+			post[j] = p
+			j++
+		}
+	}
+	copy(tmp, post)
 }
@@ -5,11 +5,18 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp/syntax"
+	"runtime"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/RoaringBitmap/roaring"
 	"github.com/cockroachdb/pebble"
+	"github.com/google/codesearch/query"
 )
 
 var trivialFiles = map[string]string{
@@ -40,18 +47,35 @@ var trivialIndex = map[string]string{
 	"nam:865ab0d317f36965e43d20d275b545a6773137adad19db1d61ecb8032f473e0b": "75a11da44c802486bc6f65640aa48a730f0f684c5c07a42ba3cd1735eb3fb070",
 	"nam:9a8363aff25b5ffb5120eeb66d735bfd225d6e27d0a1ce6afc2a6b177bb94336": "f09bab9e688e84d242a75c95e13c6a3855f0ebbeae1231bd63232b926bee8cc2",
 	"nam:c147efcfc2d7ea666a9e4f5187b115c90903f0fc896a56df9a6ef5d8f3fc9f31": "6dba9d80d5c3ac293f1947c1457ea897869ebb556045095ffb3f06b14da2f7f0",
-	"tri:\na\n:1":        "[2157820525]",
-	"tri:\nab:1":         "[2567401026 2572128214]",
-	"tri:\nda:1":         "[1322781010]",
-	"tri:\nxy:1":         "[2662046704]",
-	"tri:ab\n:1":         "[2572128214]",
-	"tri:abc:1":          "[1322781010 2567401026]",
-	"tri:bc\n:1":         "[1322781010 2567401026]",
-	"tri:dab:1":          "[1322781010]",
-	"tri:xyz:1":          "[2662046704]",
-	"tri:yzw:1":          "[2662046704]",
-	"tri:zw\n:1":         "[2662046704]",
+	"doc:00000000":       "5209d84ebb2c8deaf291693a3b3e41963640f8ee4f4ccc855fde6bfd920db809",
+	"doc:00000001":       "75a11da44c802486bc6f65640aa48a730f0f684c5c07a42ba3cd1735eb3fb070",
+	"doc:00000002":       "6dba9d80d5c3ac293f1947c1457ea897869ebb556045095ffb3f06b14da2f7f0",
+	"doc:00000003":       "426e0799711d0ae24f9cf63761e97f8e2d0a5cf4695d6c95721645a352fd8d98",
+	"doc:00000004":       "f09bab9e688e84d242a75c95e13c6a3855f0ebbeae1231bd63232b926bee8cc2",
+	"doc:00000005":       "d68f4f99347a5c4b1f844a7432f02e375d8704dac222bb1403e343988a19e122",
+	"ver:":               "8",
+	"seg:1":              `{"first_doc":0,"num_docs":6,"committed":1000000000}`,
+	"nxt:":               "\x06\x00\x00\x00",
+	"tri:\na\n:1":        "[2]",
+	"tri:\nab:1":         "[3 5]",
+	"tri:\nda:1":         "[0]",
+	"tri:\nxy:1":         "[4]",
+	"tri:ab\n:1":         "[5]",
+	"tri:abc:1":          "[0 3]",
+	"tri:bc\n:1":         "[0 3]",
+	"tri:dab:1":          "[0]",
+	"tri:xyz:1":          "[4]",
+	"tri:yzw:1":          "[4]",
+	"tri:zw\n:1":         "[4]",
 	"tri:\xff\xff\xff:1": "[]",
+
+	"met:00000001":                       `{"size":2,"lines":2,"mtime":"0001-01-01T00:00:00Z"}`,
+	"att:size=0000000000000002:00000001": "",
+
+	"cnt:tri:abc:1":          "\x02\x00\x00\x00",
+	"cnt:tri:\nab:1":         "\x02\x00\x00\x00",
+	"cnt:tri:xyz:1":          "\x01\x00\x00\x00",
+	"cnt:tri:\xff\xff\xff:1": "\x00\x00\x00\x00",
 }
 
 func readIndex(t *testing.T, dir string) map[string]string {
@@ -89,14 +113,21 @@ func TestTrivialWrite(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	iw, err := Create(db)
+	iw, err := Create(db, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	iw.segmentID = "1"
-	for name, contents := range trivialFiles {
-		err := iw.Add(name, strings.NewReader(contents))
+	iw.now = func() time.Time { return time.Unix(1, 0) }
+	// Doc IDs are allocated in the order files are added.
+	names := make([]string, 0, len(trivialFiles))
+	for name := range trivialFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := iw.Add(name, strings.NewReader(trivialFiles[name]))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -114,3 +145,199 @@ func TestTrivialWrite(t *testing.T) {
 		}
 	}
 }
+
+func TestRepositories(t *testing.T) {
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	repoFiles := map[string]map[string]string{
+		"alpha": {"main.go": "package alpha\n", "util.go": "func shared() {}\n"},
+		"beta":  {"main.go": "package beta\n", "util.go": "func shared() { return }\n"},
+	}
+	for repo, files := range repoFiles {
+		iw, err := Create(db, &WriterOptions{Repository: repo})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, contents := range files {
+			if err := iw.Add(name, strings.NewReader(contents)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := iw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func(opts *ReaderOptions, re string) []string {
+		ix, err := Open(db, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits, err := ix.PostingQuery(query.RegexpQuery(mustParse(t, re)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, h := range hits {
+			name, err := ix.Name(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, h.Repo+"/"+name)
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	if got, want := search(nil, `shared`), []string{"alpha/util.go", "beta/util.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search all for shared = %v, want %v", got, want)
+	}
+	if got, want := search(&ReaderOptions{Repositories: []string{"beta"}}, `shared`), []string{"beta/util.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search beta for shared = %v, want %v", got, want)
+	}
+	if got, want := search(nil, `package alpha`), []string{"alpha/main.go"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("search all for package alpha = %v, want %v", got, want)
+	}
+	if _, err := Create(db, &WriterOptions{Repository: "bad:name"}); err == nil {
+		t.Errorf("Create with repository %q succeeded, want error", "bad:name")
+	}
+}
+
+func mustParse(t *testing.T, re string) *syntax.Regexp {
+	r, err := syntax.Parse(re, syntax.Perl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestWorkers(t *testing.T) {
+	src, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(src)
+
+	var names []string
+	for i := 0; i < 50; i++ {
+		name := filepath.Join(src, fmt.Sprintf("f%02d.go", i))
+		// Every fifth file repeats an earlier one's contents,
+		// and every seventh is not text.
+		text := fmt.Sprintf("package p%d\n\nfunc f() int { return %d }\n", i%5*5, i*i)
+		if i%7 == 3 {
+			text = "\xff\xfe binary"
+		}
+		if err := os.WriteFile(name, []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+
+	index := func(workers int) map[string]string {
+		d, _ := os.MkdirTemp("", "test")
+		defer os.RemoveAll(d)
+		db, err := pebble.Open(d, &pebble.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		iw, err := Create(db, &WriterOptions{Workers: workers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		iw.segmentID = "1"
+		iw.now = func() time.Time { return time.Unix(1, 0) }
+		for _, name := range names {
+			if err := iw.AddFile(name); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := iw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if st := iw.Stats(); st.FilesIndexed+st.FilesDeduped+st.FilesSkipped != len(names) {
+			t.Errorf("workers=%d: stats %+v do not add up to %d files", workers, st, len(names))
+		}
+		db.Close()
+		return readIndex(t, d)
+	}
+
+	want := index(1)
+	for _, workers := range []int{2, 8} {
+		if got := index(workers); !reflect.DeepEqual(got, want) {
+			t.Errorf("index with %d workers differs from index with 1", workers)
+		}
+	}
+}
+
+func TestCloseCancelled(t *testing.T) {
+	src, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(src)
+	for i := 0; i < 200; i++ {
+		text := fmt.Sprintf("package p\n\nfunc f%d() {}\n", i)
+		if err := os.WriteFile(filepath.Join(src, fmt.Sprintf("f%03d.go", i)), []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, _ := os.MkdirTemp("", "test")
+	defer os.RemoveAll(d)
+	db, err := pebble.Open(d, &pebble.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	baseline := pipelineGoroutines()
+
+	iw, err := Create(db, &WriterOptions{Workers: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Give up halfway through, as an Index request that is cancelled
+	// does, with files still queued.
+	for i := 0; i < 100; i++ {
+		if err := iw.AddFile(filepath.Join(src, fmt.Sprintf("f%03d.go", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := iw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The workers and the committer have finished once Close returns,
+	// but may not have exited yet.
+	for i := 0; pipelineGoroutines() > baseline; i++ {
+		if i == 100 {
+			t.Fatalf("%d pipeline goroutines after Close, want %d", pipelineGoroutines(), baseline)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := countKeys(t, db, pendingPrefix); n != 0 {
+		t.Errorf("%d pnd: keys after Close, want 0", n)
+	}
+	if got := search(t, db, "func"); len(got) != 0 {
+		t.Errorf("func matches %d files after Close, want none", len(got))
+	}
+	if err := iw.AddFile(filepath.Join(src, "f000.go")); err != errClosed {
+		t.Errorf("AddFile after Close = %v, want %v", err, errClosed)
+	}
+	if err := iw.Flush(); err != errClosed {
+		t.Errorf("Flush after Close = %v, want %v", err, errClosed)
+	}
+}
+
+// pipelineGoroutines returns the number of goroutines running the
+// workers and committers of writers' pipelines.
+func pipelineGoroutines() int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	n := 0
+	for _, g := range strings.Split(string(buf), "\n\n") {
+		if strings.Contains(g, "startPipeline.func") {
+			n++
+		}
+	}
+	return n
+}
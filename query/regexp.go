@@ -23,6 +23,11 @@ type Query struct {
 	Op      QueryOp
 	Trigram []string
 	Sub     []*Query
+
+	// Folded reports that the query is case-folded: its trigrams
+	// are in ASCII lower case, and each stands for all of its ASCII
+	// case variants. It is set on every node of a folded query.
+	Folded bool
 }
 
 type QueryOp int
@@ -281,6 +286,13 @@ func (q *Query) andTrigrams(t stringSet) *Query {
 }
 
 func (q *Query) String() string {
+	if q != nil && q.Folded {
+		return "(?i)" + q.string()
+	}
+	return q.string()
+}
+
+func (q *Query) string() string {
 	if q == nil {
 		return "?"
 	}
@@ -320,9 +332,9 @@ func (q *Query) String() string {
 		if len(q.Trigram) > 0 {
 			s += sjoin
 		}
-		s += q.Sub[0].String()
+		s += q.Sub[0].string()
 		for i := 1; i < len(q.Sub); i++ {
-			s += sjoin + q.Sub[i].String()
+			s += sjoin + q.Sub[i].string()
 		}
 	}
 	s += end
@@ -330,13 +342,93 @@ func (q *Query) String() string {
 }
 
 // RegexpQuery returns a Query for the given regexp.
+//
+// If the regexp folds case, as (?i) patterns do, the query is
+// case-folded: each alternation of the case variants of a trigram
+// becomes the single lower-case trigram, to be looked up in an index
+// of folded trigrams.
 func RegexpQuery(re *syntax.Regexp) *Query {
 	info := analyze(re)
 	info.simplify(true)
 	info.addExact()
+	if foldsCase(re) {
+		return info.match.fold()
+	}
 	return info.match
 }
 
+// foldsCase reports whether any literal in re matches case-insensitively.
+func foldsCase(re *syntax.Regexp) bool {
+	if re.Op == syntax.OpLiteral && re.Flags&syntax.FoldCase != 0 {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if foldsCase(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+// fold returns the case-folded form of q. Folding only ever widens
+// a query, so it is safe for any query, but it loses nothing only
+// when every trigram appears alongside its case variants.
+func (q *Query) fold() *Query {
+	if q.Op == QAll || q.Op == QNone {
+		return q
+	}
+	f := &Query{Op: q.Op, Folded: true}
+	seen := make(map[string]bool)
+	var add func(s *Query)
+	add = func(s *Query) {
+		// Case variants fold to the same trigrams and subqueries,
+		// which are added only once. A query with a single
+		// trigram or subquery means the same under either op, and
+		// one with f's op is merged into f.
+		for len(s.Trigram) == 0 && len(s.Sub) == 1 {
+			s = s.Sub[0]
+		}
+		if s.Op == f.Op || len(s.Trigram) == 1 && len(s.Sub) == 0 {
+			for _, t := range s.Trigram {
+				if !seen[t] {
+					seen[t] = true
+					f.Trigram = append(f.Trigram, t)
+				}
+			}
+			for _, sub := range s.Sub {
+				add(sub)
+			}
+			return
+		}
+		if key := s.string(); !seen[key] {
+			seen[key] = true
+			f.Sub = append(f.Sub, s)
+		}
+	}
+	for _, t := range q.Trigram {
+		add(&Query{Op: q.Op, Trigram: []string{foldTrigram(t)}, Folded: true})
+	}
+	for _, sub := range q.Sub {
+		add(sub.fold())
+	}
+	sort.Strings(f.Trigram)
+	if len(f.Trigram) == 0 && len(f.Sub) == 1 {
+		return f.Sub[0]
+	}
+	return f
+}
+
+// foldTrigram returns t with ASCII upper-case letters made lower case.
+func foldTrigram(t string) string {
+	b := []byte(t)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
 // A regexpInfo summarizes the results of analyzing a regexp.
 type regexpInfo struct {
 	// canEmpty records whether the regexp matches the empty string
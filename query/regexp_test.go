@@ -61,13 +61,17 @@ var queryTests = []struct {
 
 	{`(?s).`, `+`},
 
-	// Expanding case.
-	{`(?i)a~~`, `("A~~"|"a~~")`},
-	{`(?i)ab~`, `("AB~"|"Ab~"|"aB~"|"ab~")`},
-	{`(?i)abc`, `("ABC"|"ABc"|"AbC"|"Abc"|"aBC"|"aBc"|"abC"|"abc")`},
-	{`(?i)abc|def`, `("ABC"|"ABc"|"AbC"|"Abc"|"DEF"|"DEf"|"DeF"|"Def"|"aBC"|"aBc"|"abC"|"abc"|"dEF"|"dEf"|"deF"|"def")`},
-	{`(?i)abcd`, `("ABC"|"ABc"|"AbC"|"Abc"|"aBC"|"aBc"|"abC"|"abc") ("BCD"|"BCd"|"BcD"|"Bcd"|"bCD"|"bCd"|"bcD"|"bcd")`},
-	{`(?i)abc|abc`, `("ABC"|"ABc"|"AbC"|"Abc"|"aBC"|"aBc"|"abC"|"abc")`},
+	// Folding case.
+	{`(?i)a~~`, `(?i)"a~~"`},
+	{`(?i)ab~`, `(?i)"ab~"`},
+	{`(?i)abc`, `(?i)"abc"`},
+	{`(?i)abc|def`, `(?i)("abc"|"def")`},
+	{`(?i)abcd`, `(?i)"abc" "bcd"`},
+	{`(?i)abc|abc`, `(?i)"abc"`},
+	{`(?i)ab(cd|ef)`, `(?i)("abc" "bcd")|("abe" "bef")`},
+	{`(?i)Abc.*DEF`, `(?i)"abc" "def"`},
+	{`(?i:abc)DEF`, `(?i)"abc" "bcd" "cde" "def"`},
+	{`(?i)ab`, `+`},
 
 	// Word boundary.
 	{`\b`, `+`},
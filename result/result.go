@@ -11,10 +11,25 @@ type Result struct {
 	Count    int
 	Filename string
 	Snippets [][]byte
+
+	// Duplicates is the number of other files with the same contents
+	// as Filename, when they are collapsed into this result.
+	Duplicates int
 }
 
 func (r Result) String() string {
-	out := fmt.Sprintf("%s [%d matches]\n", r.Filename, r.Count)
+	name := r.Filename
+	if r.Project != "" {
+		name = r.Project + ":" + name
+	}
+	out := fmt.Sprintf("%s [%d matches]", name, r.Count)
+	switch {
+	case r.Duplicates == 1:
+		out += " (also in 1 other file)"
+	case r.Duplicates > 1:
+		out += fmt.Sprintf(" (also in %d other files)", r.Duplicates)
+	}
+	out += "\n"
 	for _, snip := range r.Snippets {
 		out += fmt.Sprintf("  %s", string(snip))
 	}
@@ -26,6 +41,7 @@ func (r Result) ToProto() *srpb.Result {
 		Filename:   r.Filename,
 		MatchCount: int32(r.Count),
 		Repo:       r.Project,
+		Duplicates: int32(r.Duplicates),
 	}
 	for _, s := range r.Snippets {
 		p.Snippets = append(p.Snippets, &srpb.Snippet{
@@ -0,0 +1,108 @@
+package walk
+
+import (
+	"path"
+	"strings"
+)
+
+// An ignoreList holds the rules of the ignore files in one directory.
+type ignoreList struct {
+	dir   string // slash-separated path relative to the root
+	rules []rule
+}
+
+// A rule is one pattern from an ignore file.
+type rule struct {
+	elems   []string // pattern split at slashes; "**" matches any number of elements
+	negate  bool
+	dirOnly bool
+}
+
+// parseIgnore parses the rules in the text of an ignore file.
+func parseIgnore(text string) []rule {
+	var rules []rule
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		// Trailing spaces are dropped unless escaped.
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var r rule
+		switch {
+		case line[0] == '!':
+			r.negate = true
+			line = line[1:]
+		case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		anchored := strings.Contains(line, "/")
+		r.elems = strings.Split(strings.TrimPrefix(line, "/"), "/")
+		if !anchored {
+			r.elems = append([]string{"**"}, r.elems...)
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// ignored reports whether the file or directory rel, a slash-separated
+// path relative to the root, is ignored by lists.
+func ignored(lists []*ignoreList, rel string, isDir bool) bool {
+	for i := len(lists) - 1; i >= 0; i-- {
+		l := lists[i]
+		sub := rel
+		if l.dir != "" {
+			sub = strings.TrimPrefix(rel, l.dir+"/")
+		}
+		elems := strings.Split(sub, "/")
+		for j := len(l.rules) - 1; j >= 0; j-- {
+			r := l.rules[j]
+			if r.dirOnly && !isDir {
+				continue
+			}
+			if matchElems(r.elems, elems) {
+				return !r.negate
+			}
+		}
+	}
+	return false
+}
+
+// matchElems reports whether the path elements name match the
+// pattern elements pat.
+func matchElems(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			pat = pat[1:]
+			if len(pat) == 0 {
+				// A trailing ** matches everything inside,
+				// but not the directory itself.
+				return len(name) > 0
+			}
+			for i := 0; i < len(name); i++ {
+				if matchElems(pat, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
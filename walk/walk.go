@@ -0,0 +1,163 @@
+// Package walk walks file trees to be indexed, leaving out the files
+// that ignore files and glob patterns exclude.
+//
+// Ignore files use .gitignore syntax: blank lines and lines starting
+// with # are ignored; a leading ! negates a pattern; a trailing /
+// matches only directories; a pattern containing any other / is
+// relative to the directory holding the ignore file, and otherwise
+// matches a name at any depth below it; ** matches any number of
+// directories. The last matching rule wins, and rules in deeper
+// ignore files override those in shallower ones. A file in an ignored
+// directory cannot be re-included, because the directory is not read.
+package walk
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// DefaultIgnoreFiles are the ignore files honored when Options does not
+// say otherwise. Rules in .csearchignore come after those in .gitignore,
+// so it can re-include files that git ignores.
+var DefaultIgnoreFiles = []string{".gitignore", ".csearchignore"}
+
+// Options configures Walk.
+type Options struct {
+	// Include and Exclude are glob patterns matched against each
+	// file's base name and its slash-separated path relative to the
+	// root. If Include is non-empty, only matching files are walked.
+	// Excludes also prune matching directories.
+	Include []string
+	Exclude []string
+
+	// IgnoreFiles names the ignore files honored in each directory,
+	// in increasing order of precedence. Nil means DefaultIgnoreFiles;
+	// an empty slice disables ignore files.
+	IgnoreFiles []string
+}
+
+// A WalkFunc is called by Walk for each regular file it visits.
+// If it returns an error, Walk stops and returns that error.
+type WalkFunc func(path string, info os.FileInfo) error
+
+// Walk calls fn for each regular file in the tree rooted at root, in
+// lexical order, that is not ignored. Names that are hidden or look
+// like editor temporaries (starting with '.', '#' or '~', or ending
+// in '~') are always skipped. Errors reading the tree below root are
+// logged using package log and the unreadable parts skipped.
+func Walk(root string, opts *Options, fn WalkFunc) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	w := &walker{opts: opts, ignoreFiles: opts.IgnoreFiles, fn: fn}
+	if w.ignoreFiles == nil {
+		w.ignoreFiles = DefaultIgnoreFiles
+	}
+	info, err := os.Lstat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return fn(root, info)
+	}
+	return w.walkDir(root, "", nil)
+}
+
+type walker struct {
+	opts        *Options
+	ignoreFiles []string
+	fn          WalkFunc
+}
+
+// walkDir walks the directory dir, whose slash-separated path relative
+// to the root is rel ("" for the root itself). lists holds the rules
+// of the ignore files in dir's ancestors, outermost first.
+func (w *walker) walkDir(dir, rel string, lists []*ignoreList) error {
+	lists = w.loadIgnores(dir, rel, lists)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("%s: %s", dir, err)
+		return nil
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if hidden(name) {
+			continue
+		}
+		p := filepath.Join(dir, name)
+		r := path.Join(rel, name)
+		if ignored(lists, r, e.IsDir()) || matchAny(w.opts.Exclude, r) {
+			continue
+		}
+		if e.IsDir() {
+			if err := w.walkDir(p, r, lists); err != nil {
+				return err
+			}
+			continue
+		}
+		if !e.Type().IsRegular() {
+			continue
+		}
+		if len(w.opts.Include) > 0 && !matchAny(w.opts.Include, r) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			log.Printf("%s: %s", p, err)
+			continue
+		}
+		if err := w.fn(p, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadIgnores returns lists followed by the rules of the ignore files
+// in dir, if it has any.
+func (w *walker) loadIgnores(dir, rel string, lists []*ignoreList) []*ignoreList {
+	var l *ignoreList
+	for _, name := range w.ignoreFiles {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("%s: %s", filepath.Join(dir, name), err)
+			}
+			continue
+		}
+		if l == nil {
+			l = &ignoreList{dir: rel}
+		}
+		l.rules = append(l.rules, parseIgnore(string(data))...)
+	}
+	if l == nil {
+		return lists
+	}
+	// Do not let sibling directories share an appended slice.
+	return append(lists[:len(lists):len(lists)], l)
+}
+
+// hidden reports whether name is a hidden or temporary file.
+func hidden(name string) bool {
+	return name[0] == '.' || name[0] == '#' || name[0] == '~' || name[len(name)-1] == '~'
+}
+
+// matchAny reports whether any of the glob patterns matches rel
+// or its base name.
+func matchAny(patterns []string, rel string) bool {
+	base := path.Base(rel)
+	for _, pat := range patterns {
+		if ok, _ := path.Match(pat, base); ok {
+			return true
+		}
+		if ok, _ := path.Match(pat, rel); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package walk
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var tree = map[string]string{
+	".gitignore":             "# build outputs\n*.o\nbuild/\n/top.txt\nnode_modules\n",
+	".csearchignore":         "!keep.o\n",
+	"a.go":                   "",
+	"a.o":                    "",
+	"keep.o":                 "",
+	"top.txt":                "",
+	"build/out.go":           "",
+	"node_modules/x/x.js":    "",
+	"sub/.gitignore":         "!b.o\ngen/**\ndocs/*.md\n",
+	"sub/b.o":                "",
+	"sub/c.o":                "",
+	"sub/top.txt":            "",
+	"sub/build":              "",
+	"sub/gen/a/g.go":         "",
+	"sub/docs/x.md":          "",
+	"sub/docs/deep/y.md":     "",
+	"sub/.hidden/z.go":       "",
+	"vendor/lib/lib.go":      "",
+	"vendor/lib/lib_test.go": "",
+}
+
+func makeTree(t *testing.T) string {
+	root := t.TempDir()
+	for name, text := range tree {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func walkTree(t *testing.T, root string, opts *Options) []string {
+	var got []string
+	err := Walk(root, opts, func(path string, info os.FileInfo) error {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		got = append(got, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+var walkTests = []struct {
+	opts *Options
+	want []string
+}{
+	{
+		nil,
+		[]string{
+			"a.go",
+			"keep.o",
+			"sub/b.o",
+			"sub/build",
+			"sub/docs/deep/y.md",
+			"sub/top.txt",
+			"vendor/lib/lib.go",
+			"vendor/lib/lib_test.go",
+		},
+	},
+	{
+		&Options{Exclude: []string{"vendor", "*.o"}},
+		[]string{
+			"a.go",
+			"sub/build",
+			"sub/docs/deep/y.md",
+			"sub/top.txt",
+		},
+	},
+	{
+		&Options{Include: []string{"*.go"}, Exclude: []string{"*_test.go"}},
+		[]string{
+			"a.go",
+			"vendor/lib/lib.go",
+		},
+	},
+	{
+		&Options{Include: []string{"sub/*"}, IgnoreFiles: []string{}},
+		[]string{
+			"sub/b.o",
+			"sub/build",
+			"sub/c.o",
+			"sub/top.txt",
+		},
+	},
+}
+
+func TestWalk(t *testing.T) {
+	root := makeTree(t)
+	for _, tt := range walkTests {
+		if got := walkTree(t, root, tt.opts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Walk(%+v) = %q, want %q", tt.opts, got, tt.want)
+		}
+	}
+}
+
+var ignoreTests = []struct {
+	rules string
+	path  string
+	isDir bool
+	want  bool
+}{
+	{"*.o", "a/b/c.o", false, true},
+	{"*.o\n!c.o", "a/b/c.o", false, false},
+	{"b/c.o", "a/b/c.o", false, false},
+	{"a/**/c.o", "a/b/x/c.o", false, true},
+	{"a/**/c.o", "a/c.o", false, true},
+	{"**/b", "a/b", true, true},
+	{"a/**", "a", true, false},
+	{"a/**", "a/b", false, true},
+	{"out/", "x/out", false, false},
+	{"out/", "x/out", true, true},
+	{`\#x`, "#x", false, true},
+	{`\!x`, "!x", false, true},
+	{"x   ", "x", false, true},
+	{`x\ `, "x ", false, true},
+}
+
+func TestIgnore(t *testing.T) {
+	for _, tt := range ignoreTests {
+		lists := []*ignoreList{{rules: parseIgnore(tt.rules)}}
+		if got := ignored(lists, tt.path, tt.isDir); got != tt.want {
+			t.Errorf("rules %q: ignored(%q, %v) = %v, want %v", tt.rules, tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}